@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"flag"
+	gproxy "g-proxy"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	server := flag.String("server", "", "跳板机上的隧道地址, 例如jump:7000")
+	secret := flag.String("secret", "", "和跳板机-tunnel-secret相同的密钥")
+	services := flag.String("services", "", "注册的服务, 格式name=host:port, 多个用逗号分隔")
+	flag.Parse()
+	if *server == "" || *secret == "" || *services == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	targets := make(map[string]string)
+	for _, s := range strings.Split(*services, ",") {
+		name, addr, ok := strings.Cut(strings.TrimSpace(s), "=")
+		if !ok || name == "" || addr == "" {
+			log.Fatalf("invalid service %q", s)
+		}
+		targets[name] = addr
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := gproxy.NewTunnelAgent(*server, *secret, targets).Run(ctx); err != nil {
+		log.Fatalf("tunnel agent: %v", err)
+	}
+}
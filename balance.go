@@ -0,0 +1,123 @@
+package gproxy
+
+import (
+	"hash/fnv"
+	"net"
+	"sync/atomic"
+)
+
+// 多个后端时选择后端的方式
+const (
+	BalanceRoundRobin = "roundrobin" // 默认, 轮流选择
+	BalanceLeastConn  = "leastconn"  // 选择当前连接数最少的
+	BalanceSource     = "source"     // 按客户端IP哈希, 同一个客户端总是连到同一个后端
+)
+
+// balancer 为每个新的客户端连接选择一个后端, 跳过健康检查失败的后端。
+// 在evPoll和HTTP的goroutine中都会用到
+type balancer struct {
+	policy   string
+	backends []*net.TCPAddr
+	conns    []atomic.Int32 // 每个后端当前的连接数
+	up       []atomic.Bool  // 健康检查的结果, 不检查时总是true
+	next     atomic.Uint32
+}
+
+func newBalancer(policy string, backends []*net.TCPAddr) *balancer {
+	b := &balancer{
+		policy:   policy,
+		backends: backends,
+		conns:    make([]atomic.Int32, len(backends)),
+		up:       make([]atomic.Bool, len(backends)),
+	}
+	for i := range b.up {
+		b.up[i].Store(true)
+	}
+	return b
+}
+
+// pick 选择一个上线的后端并增加它的连接数, 连接结束时调用release。
+// 尽量不选择skip(刚刚连接失败的后端), 没有其他可用的后端时才选它, 都不可用时返回-1
+func (b *balancer) pick(client net.IP, skip int) int {
+	i := b.choose(client, func(i int) bool { return i != skip && b.up[i].Load() })
+	if i < 0 && skip >= 0 && b.up[skip].Load() {
+		i = skip
+	}
+	if i >= 0 {
+		b.conns[i].Add(1)
+	}
+	return i
+}
+
+func (b *balancer) choose(client net.IP, usable func(i int) bool) int {
+	n := len(b.backends)
+	if n == 0 {
+		return -1
+	}
+	switch b.policy {
+	case BalanceSource:
+		// 哈希到的后端不可用时顺延到下一个, 其他客户端不受影响
+		start := 0
+		if client != nil {
+			h := fnv.New32a()
+			h.Write(client.To16())
+			start = int(h.Sum32() % uint32(n))
+		}
+		for j := 0; j < n; j++ {
+			if k := (start + j) % n; usable(k) {
+				return k
+			}
+		}
+	case BalanceLeastConn:
+		// 从轮转的位置开始找, 连接数相同时不会总是选第一个
+		start := int(b.next.Add(1) % uint32(n))
+		best := -1
+		for j := 0; j < n; j++ {
+			k := (start + j) % n
+			if usable(k) && (best < 0 || b.conns[k].Load() < b.conns[best].Load()) {
+				best = k
+			}
+		}
+		return best
+	default:
+		start := int((b.next.Add(1) - 1) % uint32(n))
+		for j := 0; j < n; j++ {
+			if k := (start + j) % n; usable(k) {
+				return k
+			}
+		}
+	}
+	return -1
+}
+
+func (b *balancer) release(i int) {
+	b.conns[i].Add(-1)
+}
+
+// BackendStatus /query?mode=health返回的后端状态
+type BackendStatus struct {
+	Addr  string
+	Up    bool
+	Conns int32
+}
+
+func (b *balancer) status() []BackendStatus {
+	s := make([]BackendStatus, len(b.backends))
+	for i := range b.backends {
+		s[i] = BackendStatus{
+			Addr:  b.backends[i].String(),
+			Up:    b.up[i].Load(),
+			Conns: b.conns[i].Load(),
+		}
+	}
+	return s
+}
+
+// clientIP 从"ip:port"中取出客户端IP
+func clientIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,80 @@
+package gproxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testBackends(n int) []*net.TCPAddr {
+	backends := make([]*net.TCPAddr, n)
+	for i := range backends {
+		backends[i] = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000 + i}
+	}
+	return backends
+}
+
+func TestBalancer(t *testing.T) {
+	t.Run("轮流选择", func(t *testing.T) {
+		b := newBalancer("", testBackends(3))
+		for i := 0; i < 9; i++ {
+			assert.Equal(t, i%3, b.pick(nil, -1))
+		}
+	})
+
+	t.Run("连接数最少", func(t *testing.T) {
+		b := newBalancer(BalanceLeastConn, testBackends(3))
+		first := b.pick(nil, -1)
+		second := b.pick(nil, -1)
+		third := b.pick(nil, -1)
+		assert.ElementsMatch(t, []int{0, 1, 2}, []int{first, second, third})
+		b.release(second)
+		assert.Equal(t, second, b.pick(nil, -1))
+		b.release(first)
+		b.release(first)
+		assert.Equal(t, first, b.pick(nil, -1))
+	})
+
+	t.Run("客户端IP哈希", func(t *testing.T) {
+		b := newBalancer(BalanceSource, testBackends(3))
+		seen := make(map[int]bool)
+		for i := 0; i < 50; i++ {
+			ip := net.IPv4(10, 0, 0, byte(i))
+			j := b.pick(ip, -1)
+			assert.Equal(t, j, b.pick(ip, -1)) // 同一个客户端总是同一个后端
+			seen[j] = true
+		}
+		assert.Equal(t, 3, len(seen))
+		assert.Equal(t, b.pick(clientIP("10.0.0.1:1234"), -1), b.pick(clientIP("10.0.0.1:5678"), -1))
+	})
+}
+
+func TestRegisterBackends(t *testing.T) {
+	newRequest := func(params url.Values) *http.Request {
+		request, _ := http.NewRequest(http.MethodPost, "/register", nil)
+		request.Form = params
+		return request
+	}
+
+	params := url.Values{"name": {"build"}, "host": {"10.0.0.1", "10.0.0.2", "::1"},
+		"port": {"80", "81", "82"}, "balance": {BalanceLeastConn}}
+	name, entry, err := getRegisterParams(newRequest(params))
+	assert.Nil(t, err)
+	assert.Equal(t, "build", name)
+	assert.Equal(t, BalanceLeastConn, entry.Balance)
+	assert.Equal(t, 3, len(entry.Backends))
+	assert.Equal(t, "[::1]:82", entry.Backends[2].String())
+	assert.Equal(t, entry.Backends[0], entry.Server)
+
+	params.Set("balance", "random")
+	_, _, err = getRegisterParams(newRequest(params))
+	assert.NotNil(t, err)
+
+	params.Del("balance")
+	params["port"] = []string{"80"}
+	_, _, err = getRegisterParams(newRequest(params))
+	assert.NotNil(t, err)
+}
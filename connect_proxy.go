@@ -0,0 +1,151 @@
+package gproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	epio "g-proxy/epio"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+)
+
+// connectStream 读取HTTP CONNECT请求并认证, 目标的主机名是注册的服务名, 端口被忽略
+type connectStream struct {
+	resolve func(name string) *PortProxy
+	users   map[string]string // Basic认证的用户名和密码
+	buf     []byte
+	name    string
+	proxy   *PortProxy
+}
+
+// newConnectProxyC HTTP CONNECT端口上的客户端连接, 认证之后才知道转发到哪个服务
+func newConnectProxyC(c *epio.Connector, resolve func(name string) *PortProxy, users map[string]string) *ProxyC {
+	pc := newProxyPair(c)
+	pc.tunnel = &connectStream{resolve: resolve, users: users}
+	return pc
+}
+
+// connectResponse CONNECT请求的回复, 失败时回复之后关闭连接
+func connectResponse(status int, header string) []byte {
+	if status == http.StatusOK {
+		return []byte("HTTP/1.1 200 Connection Established\r\n\r\n")
+	}
+	text := strconv.Itoa(status) + " " + http.StatusText(status)
+	return []byte("HTTP/1.1 " + text + "\r\n" + header + "Content-Type: text/plain\r\nContent-Length: " +
+		strconv.Itoa(len(text)+1) + "\r\nConnection: close\r\n\r\n" + text + "\n")
+}
+
+// feed 读取请求头, 返回出错时回复客户端的数据。
+// 选出服务之后rest是客户端紧接着请求头发来的数据
+func (s *connectStream) feed(data []byte) (reply, rest []byte, err error) {
+	s.buf = append(s.buf, data...)
+	end := headerEnd(s.buf)
+	if end < 0 {
+		if len(s.buf) > maxHTTPHeader {
+			return connectResponse(http.StatusRequestHeaderFieldsTooLarge, ""), nil, errHeaderTooLarge
+		}
+		return nil, nil, nil
+	}
+	header, rest := s.buf[:end], s.buf[end:]
+	s.buf = nil
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil {
+		return connectResponse(http.StatusBadRequest, ""), nil, err
+	}
+	if req.Method != http.MethodConnect {
+		return connectResponse(http.StatusMethodNotAllowed, "Allow: CONNECT\r\n"), nil,
+			errors.New("method " + req.Method + " not allowed")
+	}
+	user, ok := s.authenticate(req)
+	if !ok {
+		return connectResponse(http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"gproxy\"\r\n"), nil,
+			errors.New("authentication failed for " + strconv.Quote(user))
+	}
+	s.name = req.Host
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		s.name = host
+	}
+	if s.proxy = s.resolve(s.name); s.proxy == nil {
+		return connectResponse(http.StatusNotFound, ""), nil, errors.New("no service " + s.name)
+	}
+	return nil, rest, nil
+}
+
+// authenticate 检查Proxy-Authorization中的Basic认证, 返回请求中的用户名
+func (s *connectStream) authenticate(req *http.Request) (string, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", false
+	}
+	// http.Request.BasicAuth只读取Authorization
+	r := &http.Request{Header: http.Header{"Authorization": {auth}}}
+	user, pass, ok := r.BasicAuth()
+	if !ok || user == "" || pass == "" {
+		return "", false
+	}
+	want, found := s.users[user]
+	return user, found && subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1
+}
+
+// readConnect 认证之后按目标服务名连接后端, 连接成功之后在ProxyS.OnOpen中回复200
+func (p *ProxyC) readConnect(fd int, evPollSharedBuff []byte, now int64) bool {
+	for {
+		n, err := epio.Read(fd, evPollSharedBuff)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				return true
+			}
+			return p.dropConnect(err.Error())
+		}
+		if n == 0 {
+			return p.dropConnect("closed before connect")
+		}
+		reply, rest, err := p.tunnel.feed(evPollSharedBuff[:n])
+		if err != nil {
+			epio.Write(fd, reply) // 客户端在等待回复, 不会写满
+			return p.dropConnect(err.Error())
+		}
+		if p.tunnel.proxy != nil {
+			p.replyOK = connectResponse(http.StatusOK, "")
+			p.replyFail = connectResponse(http.StatusBadGateway, "")
+			return p.routeTo(fd, p.tunnel.proxy, now, rest)
+		}
+	}
+}
+
+// dropConnect CONNECT请求失败, 返回false由evPoll关闭连接
+func (p *ProxyC) dropConnect(reason string) bool {
+	fmt.Println("ProxyC: http connect " + reason)
+	p.cancelHelloTimer()
+	p.sess.reason = closeByCONNECT
+	return false
+}
+
+// ListenCONNECT 在addr上接受HTTP CONNECT隧道, 请求必须带有users中的用户名和密码(Basic认证),
+// CONNECT的主机名是注册的服务名, 不需要先调用/forwarding。addr的格式同epio.NewAcceptor。
+// 用户名和密码都不能为空
+func (p *ProxyServer) ListenCONNECT(addr string, users map[string]string) error {
+	if len(users) == 0 {
+		return errors.New("ListenCONNECT: no users")
+	}
+	for user, pass := range users {
+		if user == "" || pass == "" {
+			return errors.New("ListenCONNECT: empty user or password")
+		}
+	}
+	_, err := epio.NewAcceptor(p.forAccept, p.forNewFd,
+		func() epio.EvHandler { return newConnectProxyC(p.connector, p.lookupService, users) },
+		addr,
+		epio.ListenBacklog(256),
+		epio.SockRcvBufSize(8*1024))
+	if err != nil {
+		return err
+	}
+	log.Printf("正在侦听CONNECT: %s\n", addr)
+	return nil
+}
@@ -0,0 +1,95 @@
+package gproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	epio "g-proxy/epio"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectRelay(t *testing.T) {
+	forAccept, forNewFd, connector := startReactors(t)
+	services := map[string]*PortProxy{
+		"echo": {Server: tcpAddr(t, echoServer(t))},
+		"dead": {Server: deadAddr(t)},
+	}
+	for _, proxy := range services {
+		proxy.resetBalancer()
+	}
+	users := map[string]string{"alice": "secret"}
+	_, err := epio.NewAcceptor(forAccept, forNewFd,
+		func() epio.EvHandler {
+			return newConnectProxyC(connector, func(name string) *PortProxy { return services[name] }, users)
+		}, "127.0.0.1:33519")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// connect 发送CONNECT请求, 返回响应和之后用于隧道的连接
+	connect := func(method, target, auth string) (*http.Response, net.Conn, *bufio.Reader) {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:33519", 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		req := method + " " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+		if auth != "" {
+			req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(auth)) + "\r\n"
+		}
+		conn.Write([]byte(req + "\r\n"))
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, &http.Request{Method: method})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return resp, conn, r
+	}
+
+	t.Run("认证之后建立隧道", func(t *testing.T) {
+		resp, conn, r := connect("CONNECT", "echo:443", "alice:secret")
+		defer conn.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		conn.Write([]byte("ping"))
+		got := make([]byte, 4)
+		_, err := io.ReadFull(r, got)
+		assert.Nil(t, err)
+		assert.Equal(t, "ping", string(got))
+	})
+
+	for _, c := range []struct {
+		name, method, target, auth string
+		status                     int
+	}{
+		{"没有认证", "CONNECT", "echo:443", "", http.StatusProxyAuthRequired},
+		{"密码错误", "CONNECT", "echo:443", "alice:wrong", http.StatusProxyAuthRequired},
+		{"未知用户", "CONNECT", "echo:443", "bob:secret", http.StatusProxyAuthRequired},
+		{"空的用户名和密码", "CONNECT", "echo:443", ":", http.StatusProxyAuthRequired},
+		{"不是CONNECT", "GET", "http://echo/", "alice:secret", http.StatusMethodNotAllowed},
+		{"没有注册的服务", "CONNECT", "other:443", "alice:secret", http.StatusNotFound},
+		{"后端连接失败", "CONNECT", "dead:443", "alice:secret", http.StatusBadGateway},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			resp, conn, _ := connect(c.method, c.target, c.auth)
+			defer conn.Close()
+			assert.Equal(t, c.status, resp.StatusCode)
+			if c.status == http.StatusProxyAuthRequired {
+				assert.Equal(t, `Basic realm="gproxy"`, resp.Header.Get("Proxy-Authenticate"))
+			}
+		})
+	}
+
+	t.Run("不接受空的用户名或密码", func(t *testing.T) {
+		p := &ProxyServer{}
+		assert.NotNil(t, p.ListenCONNECT("127.0.0.1:0", nil))
+		assert.NotNil(t, p.ListenCONNECT("127.0.0.1:0", map[string]string{"": ""}))
+		assert.NotNil(t, p.ListenCONNECT("127.0.0.1:0", map[string]string{"alice": ""}))
+		assert.NotNil(t, p.ListenCONNECT("127.0.0.1:0", map[string]string{"": "secret"}))
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -20,6 +21,7 @@ type Acceptor struct {
 
 	reuseAddr        bool // SO_REUSEADDR
 	reusePort        bool // SO_REUSEPORT
+	ipv6Only         bool // IPV6_V6ONLY
 	fd               int
 	sockRcvBufSize   int // ignore equal 0
 	listenBacklog    int
@@ -28,7 +30,8 @@ type Acceptor struct {
 	reactor          *Reactor
 	newFdBindReactor *Reactor
 	addr             string
-	Close            chan struct{}
+	Close            chan struct{} // closed after the listener is closed
+	closeOnce        sync.Once
 }
 
 // NewAcceptor return an acceptor
@@ -46,6 +49,7 @@ func NewAcceptor(acceptorBindReactor *Reactor, newFdBindReactor *Reactor,
 		sockRcvBufSize:   evOptions.sockRcvBufSize,
 		reuseAddr:        evOptions.reuseAddr,
 		reusePort:        evOptions.reusePort,
+		ipv6Only:         evOptions.ipv6Only,
 		addr:             addr,
 		Close:            make(chan struct{}),
 	}
@@ -60,7 +64,7 @@ func NewAcceptor(acceptorBindReactor *Reactor, newFdBindReactor *Reactor,
 }
 
 // open create a listen fd
-// The addr format 192.168.0.1:8080 or :8080 or unix:/tmp/xxxx.sock
+// The addr format 192.168.0.1:8080 or :8080 or [::]:8080 or unix:/tmp/xxxx.sock
 func (a *Acceptor) open() error {
 	p := strings.Index(a.addr, ":")
 	if p < 0 || p >= (len(a.addr)-1) {
@@ -75,13 +79,29 @@ func (a *Acceptor) open() error {
 	return a.tcpListen()
 }
 
-// The addr format 192.168.0.1:8080 or :8080
+// The addr format 192.168.0.1:8080 or :8080 or [::1]:8080
 func (a *Acceptor) tcpListen() error {
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	sa, err := addr2SA(a.addr)
+	if err != nil {
+		return err
+	}
+	fd, err := syscall.Socket(sockFamily(sa), syscall.SOCK_STREAM, 0)
 	if err != nil {
 		return errors.New("Socket in Acceptor.open: " + err.Error())
 	}
 
+	if _, ok := sa.(*syscall.SockaddrInet6); ok {
+		// [::]:8080 在ipv6Only为false时同时接受ipv4连接(dual-stack)
+		v := 0
+		if a.ipv6Only {
+			v = 1
+		}
+		if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, v); err != nil {
+			syscall.Close(fd)
+			return errors.New("Set IPV6_V6ONLY in Acceptor.open: " + err.Error())
+		}
+	}
+
 	if a.reuseAddr {
 		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
 			syscall.Close(fd)
@@ -109,11 +129,6 @@ func (a *Acceptor) tcpListen() error {
 		}
 	}
 
-	sa, err := addr2SA(a.addr)
-	if err != nil {
-		syscall.Close(fd)
-		return err
-	}
 	if err := a.listen(fd, sa); err != nil {
 		syscall.Close(fd)
 		return err
@@ -121,29 +136,56 @@ func (a *Acceptor) tcpListen() error {
 	return nil
 }
 
+// addr2SA The addr format 192.168.1.1:80 or :80 or [::1]:80 or [fe80::1%eth0]:80
+//
+// An empty host means 0.0.0.0, use [::] for an ipv6 wildcard address
 func addr2SA(addr string) (syscall.Sockaddr, error) {
-	ip := "0.0.0.0"
-	var port int64
-	ipp := strings.Split(addr, ":")
-	if len(ipp) != 2 {
-		return nil, errors.New("address is invalid! 192.168.1.1:80 or :80")
-	}
-	if len(ipp[0]) > 0 {
-		ip = ipp[0]
-	}
-	ip4 := net.ParseIP(ip)
-	if ip4 == nil {
-		return nil, errors.New("address is invalid! 192.168.1.1:80 or :80")
+	host, portS, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.New("address is invalid! 192.168.1.1:80 or [::1]:80 or :80")
 	}
-	port, _ = strconv.ParseInt(ipp[1], 10, 64)
+	port, _ := strconv.ParseInt(portS, 10, 64)
 	if port < 1 || port > 65535 {
 		return nil, errors.New("port must in (0, 65536)")
 	}
-	sa := syscall.SockaddrInet4{Port: int(port)}
-	copy(sa.Addr[:], ip4.To4())
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	zone := ""
+	if i := strings.LastIndexByte(host, '%'); i > 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("address is invalid! 192.168.1.1:80 or [::1]:80 or :80")
+	}
+	if ip4 := ip.To4(); ip4 != nil && !strings.Contains(host, ":") {
+		sa := syscall.SockaddrInet4{Port: int(port)}
+		copy(sa.Addr[:], ip4)
+		return &sa, nil
+	}
+	sa := syscall.SockaddrInet6{Port: int(port)}
+	copy(sa.Addr[:], ip.To16())
+	if zone != "" {
+		if ifi, err := net.InterfaceByName(zone); err == nil {
+			sa.ZoneId = uint32(ifi.Index)
+		} else if idx, err := strconv.ParseUint(zone, 10, 32); err == nil {
+			sa.ZoneId = uint32(idx)
+		} else {
+			return nil, errors.New("address zone is invalid: " + zone)
+		}
+	}
 	return &sa, nil
 }
 
+// sockFamily returns AF_INET6 for ipv6 sockaddr, otherwise AF_INET
+func sockFamily(sa syscall.Sockaddr) int {
+	if _, ok := sa.(*syscall.SockaddrInet6); ok {
+		return syscall.AF_INET6
+	}
+	return syscall.AF_INET
+}
+
 // The addr format /tmp/xxx.sock
 func (a *Acceptor) udsListen() error {
 	addr := a.addr[5:]
@@ -201,10 +243,21 @@ func (a *Acceptor) OnRead(fd int, evPollSharedBuff []byte, now int64) bool {
 	return true
 }
 
-// OnClose will not happen
+// Stop closes the listener in its evPoll goroutine, a.Close will be closed after that
+func (a *Acceptor) Stop() error {
+	return a.reactor.Post(a, func() {
+		if a.reactor.RemoveEvHandler(a, a.fd) == nil {
+			a.OnClose(a.fd)
+		}
+	})
+}
+
+// OnClose closes the listener when Stop or Reactor.Stop
 func (a *Acceptor) OnClose(fd int) {
-	syscall.Close(fd)
-	close(a.Close)
+	a.closeOnce.Do(func() {
+		syscall.Close(fd)
+		close(a.Close)
+	})
 }
 
 func (a *Acceptor) OnConnectFail(err error) {
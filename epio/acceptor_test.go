@@ -135,3 +135,49 @@ func ShortConnect(t *testing.T, proxy_addr string) {
 	fmt.Printf("[ShortConnect] total RW bytes: %d, %d/100\n", total, cnt)
 	proxy_cnn.Close()
 }
+
+func TestAddr2SA(t *testing.T) {
+	for addr, want := range map[string]string{
+		"192.168.1.1:80":       "192.168.1.1:80",
+		":80":                  "0.0.0.0:80",
+		"[::1]:80":             "[::1]:80",
+		"[::]:80":              "[::]:80",
+		"[::ffff:10.0.0.1]:80": "10.0.0.1:80", // dual-stack下ipv4客户端的地址
+	} {
+		sa, err := addr2SA(addr)
+		assert.Nil(t, err, addr)
+		assert.Equal(t, want, sa2Addr(sa))
+	}
+	sa, _ := addr2SA("[::ffff:10.0.0.1]:80")
+	assert.Equal(t, syscall.AF_INET6, sockFamily(sa))
+	sa, _ = addr2SA("10.0.0.1:80")
+	assert.Equal(t, syscall.AF_INET, sockFamily(sa))
+
+	for _, addr := range []string{"::1:80", "1.2.3.4", "[::1]:0", "abc:80", "[fe80::1%nosuchif]:80"} {
+		_, err := addr2SA(addr)
+		assert.NotNil(t, err, addr)
+	}
+}
+
+func TestAcceptorIPv6(t *testing.T) {
+	buffPool = &sync.Pool{
+		New: func() any {
+			return make([]byte, 4096)
+		},
+	}
+	r, err := NewReactor(EvPollNum(1))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go r.Run()
+	_, err = NewAcceptor(r, r, func() EvHandler { return new(Http) }, "[::]:3143")
+	if err != nil {
+		t.Skip("ipv6 unavailable: " + err.Error())
+	}
+	ShortConnect(t, "[::1]:3143")
+	ShortConnect(t, "127.0.0.1:3143") // dual-stack
+
+	_, err = NewAcceptor(r, r, func() EvHandler { return new(Http) }, "[::1]:3144", IPv6Only(true))
+	assert.Nil(t, err)
+	ShortConnect(t, "[::1]:3144")
+}
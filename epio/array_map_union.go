@@ -59,3 +59,41 @@ func (am *ArrayMapUnion[T]) Delete(i int) {
 	}
 	am.sMap.Delete(i)
 }
+
+// Swap stores v for a key and returns the previous value, or nil if no
+func (am *ArrayMapUnion[T]) Swap(i int, v *T) *T {
+	if i < am.arrSize {
+		return am.arr[i].Swap(v)
+	}
+	if old, ok := am.sMap.Swap(i, v); ok {
+		return old.(*T)
+	}
+	return nil
+}
+
+// LoadAndDelete deletes the value for a key, returning the previous value, or nil if no
+func (am *ArrayMapUnion[T]) LoadAndDelete(i int) *T {
+	if i < am.arrSize {
+		return am.arr[i].Swap(nil)
+	}
+	if v, ok := am.sMap.LoadAndDelete(i); ok {
+		return v.(*T)
+	}
+	return nil
+}
+
+// Range calls f sequentially for each value present in the array/map.
+// If f returns false, range stops the iteration.
+// Values may be stored or deleted concurrently, like sync.Map.Range
+func (am *ArrayMapUnion[T]) Range(f func(i int, v *T) bool) {
+	for i := range am.arr {
+		if v := am.arr[i].Load(); v != nil {
+			if !f(i, v) {
+				return
+			}
+		}
+	}
+	am.sMap.Range(func(k, v any) bool {
+		return f(k.(int), v.(*T))
+	})
+}
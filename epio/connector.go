@@ -2,8 +2,6 @@ package epio
 
 import (
 	"errors"
-	"net"
-	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
@@ -43,7 +41,7 @@ func NewConnector(r *Reactor, opts ...Option) (*Connector, error) {
 // Connect asynchronously to the specified address and there may also be an immediate result.
 // Please check the return value
 //
-// The addr format 192.168.0.1:8080 or unix:/tmp/xxxx.sock
+// The addr format 192.168.0.1:8080 or [::1]:8080 or unix:/tmp/xxxx.sock
 // The domain name format, such as qq.com:8080, is not supported.
 // You need to manually extract the IP address using gethostbyname.
 //
@@ -62,9 +60,13 @@ func (c *Connector) Connect(addr string, eh EvHandler, timeout int64) error {
 	return c.tcpConnect(addr, eh, timeout)
 }
 
-// The addr format 192.168.0.1:8080
+// The addr format 192.168.0.1:8080 or [::1]:8080
 func (c *Connector) tcpConnect(addr string, eh EvHandler, timeout int64) error {
-	fd, err := syscall.Socket(syscall.AF_INET,
+	sa, err := addr2SA(addr)
+	if err != nil {
+		return err
+	}
+	fd, err := syscall.Socket(sockFamily(sa),
 		syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
 	if err != nil {
 		return errors.New("Socket in connector.open: " + err.Error())
@@ -83,29 +85,7 @@ func (c *Connector) tcpConnect(addr string, eh EvHandler, timeout int64) error {
 		}
 	}
 
-	ip := "0.0.0.0"
-	var port int64
-	ipp := strings.Split(addr, ":")
-	if len(ipp) != 2 {
-		syscall.Close(fd)
-		return errors.New("address is invalid! 192.168.1.1:80")
-	}
-	if len(ipp[0]) > 0 {
-		ip = ipp[0]
-	}
-	ip4 := net.ParseIP(ip)
-	if ip4 == nil {
-		syscall.Close(fd)
-		return errors.New("address is invalid! 192.168.1.1:80")
-	}
-	port, _ = strconv.ParseInt(ipp[1], 10, 64)
-	if port < 1 || port > 65535 {
-		syscall.Close(fd)
-		return errors.New("port must in (0, 65536)")
-	}
-	sa := syscall.SockaddrInet4{Port: int(port)}
-	copy(sa.Addr[:], ip4.To4())
-	return c.connect(fd, &sa, eh, timeout)
+	return c.connect(fd, sa, eh, timeout)
 }
 
 func (c *Connector) udsConnect(addr string, eh EvHandler, timeout int64) error {
@@ -139,7 +119,12 @@ func (c *Connector) connect(fd int, sa syscall.Sockaddr, eh EvHandler, timeout i
 			syscall.Close(fd)
 			return errors.New("InPorgress AddEvHandler in connector.Connect: " + err.Error())
 		}
-		reactor.ScheduleTimer(inh, timeout, 0)
+		if t, err := reactor.ScheduleTimer(inh, timeout, 0); err == nil {
+			inh.timer.Store(t)
+			if inh.progressDone.Load() == 1 { // I/O事件已经先到了
+				t.Cancel()
+			}
+		}
 		return nil
 	} else if err == nil { // success
 		eh.setReactor(reactor)
@@ -160,6 +145,14 @@ type inProgressConnect struct {
 	eh           EvHandler
 	r            *Reactor
 	progressDone atomic.Int32 // Only process one I/O event or timer event
+	timer        atomic.Pointer[Timer]
+}
+
+// cancelTimer the connect result has been caught by I/O event
+func (p *inProgressConnect) cancelTimer() {
+	if t := p.timer.Load(); t != nil {
+		t.Cancel()
+	}
 }
 
 // Called by reactor when asynchronous connections fail.
@@ -167,6 +160,7 @@ func (p *inProgressConnect) OnRead(fd int, evPollSharedBuff []byte, now int64) b
 	if !p.progressDone.CompareAndSwap(0, 1) {
 		return true
 	}
+	p.cancelTimer()
 	p.eh.OnConnectFail(ErrConnectFail)
 	return false // goto p.OnClose()
 }
@@ -176,6 +170,7 @@ func (p *inProgressConnect) OnWrite(fd int, now int64) bool {
 	if !p.progressDone.CompareAndSwap(0, 1) {
 		return true
 	}
+	p.cancelTimer()
 	// From here on, the `fd` resources will be managed by h.
 	p.r.RemoveEvHandler(p, fd)
 	p.fd = -1 //
@@ -194,10 +189,17 @@ func (p *inProgressConnect) OnTimeout(now int64) bool {
 
 	// i/o event not catched
 	p.eh.OnConnectFail(ErrConnectTimeout)
+	p.r.RemoveEvHandler(p, p.fd)
+	p.OnClose(p.fd)
 	return false
 }
 
+// OnClose is also called by reactor on EPOLLERR/EPOLLHUP, e.g. connection refused
 func (p *inProgressConnect) OnClose(fd int) {
+	if p.progressDone.CompareAndSwap(0, 1) {
+		p.cancelTimer()
+		p.eh.OnConnectFail(ErrConnectFail)
+	}
 	if p.fd != -1 {
 		syscall.Close(p.fd)
 		p.fd = -1
@@ -0,0 +1,55 @@
+package epio
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type connectResult struct {
+	Event
+	ret chan error
+}
+
+func (c *connectResult) OnOpen(fd int, now int64) bool {
+	Close(fd)
+	c.ret <- nil
+	return true
+}
+func (c *connectResult) OnConnectFail(err error) {
+	c.ret <- err
+}
+
+func TestConnectorRefused(t *testing.T) {
+	r, err := NewReactor(EvPollNum(1))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go r.Run()
+	defer r.Stop(context.Background())
+	c, err := NewConnector(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	h := &connectResult{ret: make(chan error, 1)}
+	if err := c.Connect(addr, h, 10000); err != nil {
+		return // 立即返回了ECONNREFUSED
+	}
+	select {
+	case err := <-h.ret:
+		assert.Equal(t, ErrConnectFail, err) // 不需要等到超时
+	case <-time.After(3 * time.Second):
+		t.Fatal("OnConnectFail not called")
+	}
+}
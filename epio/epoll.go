@@ -3,6 +3,7 @@ package epio
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -21,8 +22,14 @@ type evPoll struct {
 	evPollSharedBuff []byte
 
 	evHandlerMap *ArrayMapUnion[evData] // Refer to https://zhuanlan.zhihu.com/p/640712548
+	handlerNum   atomic.Int32           // evHandlerMap中的数量, 包括evPollWakeup
 	timer        timer
 	evPollWakeup Notifier
+	stopping     atomic.Bool
+
+	postMtx    sync.Mutex
+	postQ      []func() // Reactor.Post投递的任务, 在evPoll的goroutine中执行
+	postClosed bool
 }
 
 func (ep *evPoll) open(evReadyNum, evPollSharedBuffSize, evDataArrSize int, timer timer) error {
@@ -50,35 +57,146 @@ func (ep *evPoll) open(evReadyNum, evPollSharedBuffSize, evDataArrSize int, time
 	return nil
 }
 func (ep *evPoll) add(fd int, events uint32, eh EvHandler) error {
+	if ep.stopping.Load() {
+		return errors.New("evpoll stopped")
+	}
 	eh.setEvPoll(ep)
 
 	ev := syscall.EpollEvent{Events: events}
 	ed := &evData{fd: fd, eh: eh}
-	ep.evHandlerMap.Store(fd, ed) // 让evHandlerMap 来控制eh的生命周期, 不然会被gc回收的
+	// 让evHandlerMap 来控制eh的生命周期, 不然会被gc回收的
+	if ep.evHandlerMap.Swap(fd, ed) == nil {
+		ep.handlerNum.Add(1)
+	}
 	*(**evData)(unsafe.Pointer(&ev.Fd)) = ed
 
 	if err := syscall.EpollCtl(ep.efd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		if ep.evHandlerMap.LoadAndDelete(fd) != nil {
+			ep.handlerNum.Add(-1)
+		}
 		return errors.New("epoll_ctl add: " + err.Error())
 	}
 	return nil
 }
+func (ep *evPoll) modify(fd int, events uint32) error {
+	ed := ep.evHandlerMap.Load(fd)
+	if ed == nil {
+		return errors.New("epoll_ctl mod: fd not add")
+	}
+	ev := syscall.EpollEvent{Events: events}
+	*(**evData)(unsafe.Pointer(&ev.Fd)) = ed
+
+	if err := syscall.EpollCtl(ep.efd, syscall.EPOLL_CTL_MOD, fd, &ev); err != nil {
+		return errors.New("epoll_ctl mod: " + err.Error())
+	}
+	return nil
+}
 func (ep *evPoll) remove(fd int) error {
 	// The event argument is ignored and can be NULL (but see `man 2 epoll_ctl` BUGS)
 	// kernel versions > 2.6.9
-	ep.evHandlerMap.Delete(fd)
+	ed := ep.evHandlerMap.LoadAndDelete(fd)
+	if ed != nil {
+		ep.handlerNum.Add(-1)
+	}
 	if err := syscall.EpollCtl(ep.efd, syscall.EPOLL_CTL_DEL, fd, nil); err != nil {
+		if err == syscall.ENOENT && ed != nil { // parked, already out of epoll
+			return nil
+		}
 		return errors.New("epoll_ctl del: " + err.Error())
 	}
 	return nil
 }
-func (ep *evPoll) scheduleTimer(eh EvHandler, delay, interval int64) (err error) {
+
+// park takes fd out of epoll but keeps its handler in evHandlerMap,
+// so it is still counted by handlers() and closed by shutdown()
+func (ep *evPoll) park(fd int) error {
+	if ep.evHandlerMap.Load(fd) == nil {
+		return errors.New("epoll_ctl del: fd not add")
+	}
+	if err := syscall.EpollCtl(ep.efd, syscall.EPOLL_CTL_DEL, fd, nil); err != nil {
+		return errors.New("epoll_ctl del: " + err.Error())
+	}
+	return nil
+}
+func (ep *evPoll) scheduleTimer(eh EvHandler, delay, interval int64) (*Timer, error) {
 	if ep.timer == nil {
-		return errors.New("not create timer")
+		return nil, errors.New("not create timer")
+	}
+	t := &Timer{ep: ep}
+	if _, err := ep.timer.schedule(eh, delay, interval, t); err != nil {
+		return nil, err
 	}
-	err = ep.timer.schedule(eh, delay, interval)
 	ep.evPollWakeup.Notify()
-	return
+	return t, nil
 }
+
+// handlers returns the number of registered handlers, excluding evPollWakeup
+func (ep *evPoll) handlers() int {
+	return int(ep.handlerNum.Load()) - 1
+}
+
+// closeAcceptors closes all listeners in the evPoll, so no new connections are accepted
+func (ep *evPoll) closeAcceptors() {
+	ep.evHandlerMap.Range(func(fd int, ed *evData) bool {
+		if _, ok := ed.eh.(*Acceptor); ok {
+			ep.remove(fd) // MUST before OnClose()
+			ed.eh.OnClose(fd)
+		}
+		return true
+	})
+}
+
+// stop wakes up the evPoll through evPollWakeup.Close(), run() will call shutdown() and return
+func (ep *evPoll) stop() {
+	ep.stopping.Store(true)
+	ep.evPollWakeup.Close()
+}
+
+// post queues fn and wakes up the evPoll
+func (ep *evPoll) post(fn func()) error {
+	ep.postMtx.Lock()
+	if ep.postClosed {
+		ep.postMtx.Unlock()
+		return errors.New("evpoll stopped")
+	}
+	ep.postQ = append(ep.postQ, fn)
+	ep.postMtx.Unlock()
+	ep.evPollWakeup.Notify()
+	return nil
+}
+
+// runPosted runs the queued tasks, tasks posted while running are left to the next round
+func (ep *evPoll) runPosted() {
+	ep.postMtx.Lock()
+	q := ep.postQ
+	ep.postQ = nil
+	ep.postMtx.Unlock()
+	for i := range q {
+		q[i]()
+	}
+}
+
+// shutdown calls OnClose on all remaining handlers and closes the epoll fd
+func (ep *evPoll) shutdown() {
+	for {
+		ep.postMtx.Lock()
+		if len(ep.postQ) == 0 {
+			ep.postClosed = true
+			ep.postMtx.Unlock()
+			break
+		}
+		ep.postMtx.Unlock()
+		ep.runPosted()
+	}
+	ep.evHandlerMap.Range(func(fd int, ed *evData) bool {
+		ep.remove(fd) // MUST before OnClose()
+		ed.eh.OnClose(fd)
+		return true
+	})
+	syscall.Close(ep.efd)
+	ep.efd = -1
+}
+
 func (ep *evPoll) run(wg *sync.WaitGroup) error {
 	if wg != nil {
 		defer wg.Done()
@@ -100,7 +218,9 @@ func (ep *evPoll) run(wg *sync.WaitGroup) error {
 				ev := &events[i]
 				ed := *(**evData)(unsafe.Pointer(&ev.Fd))
 				// EPOLLHUP refer to man 2 epoll_ctl
-				if ev.Events&(syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+				// 两个方向都关闭后socket缓冲区中可能还有数据, 同时有EPOLLIN时先交给OnRead读完
+				if ev.Events&syscall.EPOLLERR != 0 ||
+					ev.Events&(syscall.EPOLLHUP|syscall.EPOLLIN) == syscall.EPOLLHUP {
 					ep.remove(ed.fd) // MUST before OnClose()
 					ed.eh.OnClose(ed.fd)
 					continue
@@ -120,10 +240,13 @@ func (ep *evPoll) run(wg *sync.WaitGroup) error {
 					}
 				}
 			} // end of `for i < nfds'
-		} else if nfds == 0 { // timeout
-			continue
-		} else if err != nil && err != syscall.EINTR { // nfds < 0
+		} else if nfds < 0 && err != nil && err != syscall.EINTR {
 			return errors.New("syscall epoll_wait: " + err.Error())
 		}
+		ep.runPosted()
+		if ep.stopping.Load() {
+			ep.shutdown()
+			return nil
+		}
 	}
 }
@@ -45,6 +45,8 @@ type EvHandler interface {
 	OnOpen(fd int, millisecond int64) bool
 
 	// EvPoll catch readable i/o event
+	// EPOLLHUP reported together with EPOLLIN is delivered here first, so the remaining data can be read
+	// until EOF; EPOLLHUP alone goes to OnClose().
 	// The parameter 'millisecond' represents the time of batch retrieval of epoll events, not the current
 	// precise time. Use it with caution (as it can reduce the frequency of obtaining the current
 	// time to some extent).
@@ -71,7 +73,8 @@ type EvHandler interface {
 	// The parameter 'millisecond' represents the time of batch retrieval of epoll events, not the current
 	// precise time. Use it with caution (as it can reduce the frequency of obtaining the current
 	// time to some extent).
-	// Note: Don't call Reactor.SchedueTimer() or Reactor.CancelTimer() in OnTimeout, it will deadlock
+	// Reactor.ScheduleTimer(), Timer.Cancel() and Timer.Reset() can be called in OnTimeout.
+	// If the EvHandler implements TimerHandler, OnTimer is called instead.
 	//
 	// Remove timer when return false
 	OnTimeout(millisecond int64) bool
@@ -5,6 +5,8 @@ import (
 	"net"
 	"strconv"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 // Read safely read I/O data from the file descriptor (ignoring EINTR).
@@ -34,51 +36,94 @@ func Write(fd int, buf []byte) (n int, err error) {
 	return
 }
 
+// Splice safely moves up to n bytes from rfd to wfd without copying through user space (ignoring EINTR).
+// One of the two fds must be a pipe. Nonblocking on the pipe side.
+//
+// On success, the number of bytes moved is returned (zero indicates rfd reached EOF)
+func Splice(rfd, wfd, n int) (int, error) {
+	for {
+		m, err := unix.Splice(rfd, nil, wfd, nil, n, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+		if err != nil && err == syscall.EINTR {
+			continue
+		}
+		return int(m), err
+	}
+}
+
+// Pipe creates a nonblocking pipe for Splice, and tries to resize it to size bytes.
+//
+// Return the read end, the write end and the actual pipe capacity
+func Pipe(size int) (r, w, capacity int, err error) {
+	var p [2]int
+	if err = unix.Pipe2(p[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		return -1, -1, 0, errors.New("pipe2: " + err.Error())
+	}
+	if size > 0 {
+		// 超过/proc/sys/fs/pipe-max-size会失败, 保留默认大小即可
+		unix.FcntlInt(uintptr(p[1]), unix.F_SETPIPE_SZ, size)
+	}
+	capacity, err = unix.FcntlInt(uintptr(p[1]), unix.F_GETPIPE_SZ, 0)
+	if err != nil {
+		syscall.Close(p[0])
+		syscall.Close(p[1])
+		return -1, -1, 0, errors.New("F_GETPIPE_SZ: " + err.Error())
+	}
+	return p[0], p[1], capacity, nil
+}
+
+// ReadableBytes returns the number of bytes in the socket receive buffer (SIOCINQ)
+func ReadableBytes(fd int) int {
+	n, err := unix.IoctlGetInt(fd, unix.SIOCINQ)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
 // Close the fd
 func Close(fd int) error {
 	return syscall.Close(fd)
 }
 
+// ShutdownWrite shuts down the writing side of the socket, the peer will read EOF (send FIN)
+func ShutdownWrite(fd int) error {
+	return syscall.Shutdown(fd, syscall.SHUT_WR)
+}
+
 // LocalAddr retrieves the local address of the specified socket file descriptor (fd).
 //
-// Return format 192.168.0.1:8080
+// Return format 192.168.0.1:8080 or [::1]:8080
 // Return "", if error
 func LocalAddr(fd int) string {
 	sa, _ := syscall.Getsockname(fd)
-	ip := net.IP{}
-	port := 0
-	switch sa := sa.(type) {
-	case *syscall.SockaddrInet4:
-		copy([]byte(ip), sa.Addr[0:])
-		port = sa.Port
-	case *syscall.SockaddrInet6:
-		copy([]byte(ip), sa.Addr[0:])
-		port = sa.Port
-	default:
-		return ""
-	}
-	return ip.String() + ":" + strconv.FormatInt(int64(port), 10)
+	return sa2Addr(sa)
 }
 
 // RemoteAddr retrieves the remote address of the specified socket file descriptor (fd).
 //
-// Return format 192.168.0.1:8080
+// Return format 192.168.0.1:8080 or [::1]:8080
 // Return "", if error
 func RemoteAddr(fd int) string {
 	sa, _ := syscall.Getpeername(fd)
-	ip := net.IP{}
-	port := 0
+	return sa2Addr(sa)
+}
+
+func sa2Addr(sa syscall.Sockaddr) string {
 	switch sa := sa.(type) {
 	case *syscall.SockaddrInet4:
-		copy([]byte(ip), sa.Addr[0:])
-		port = sa.Port
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
 	case *syscall.SockaddrInet6:
-		copy([]byte(ip), sa.Addr[0:])
-		port = sa.Port
-	default:
-		return ""
+		ip := net.IP(sa.Addr[:]).String()
+		if sa.ZoneId != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				ip += "%" + ifi.Name
+			} else {
+				ip += "%" + strconv.Itoa(int(sa.ZoneId))
+			}
+		}
+		return net.JoinHostPort(ip, strconv.Itoa(sa.Port))
 	}
-	return ip.String() + ":" + strconv.FormatInt(int64(port), 10)
+	return ""
 }
 
 // SetSendBuffSize set SO_SNDBUF
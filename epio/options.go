@@ -7,6 +7,7 @@ type Options struct {
 	// acceptor options
 	reuseAddr     bool // SO_REUSEADDR
 	reusePort     bool // SO_REUSEPORT
+	ipv6Only      bool // IPV6_V6ONLY
 	listenBacklog int  //
 
 	// connector options
@@ -24,6 +25,7 @@ type Options struct {
 	// timer
 	noTimer           bool
 	timerHeapInitSize int //
+	timerWheelTick    int64
 }
 
 // Option function
@@ -68,6 +70,15 @@ func ReusePort(v bool) Option {
 	}
 }
 
+// IPv6Only for IPV6_V6ONLY, only affect ipv6 listening address such as [::]:8080
+//
+// The default is false: dual-stack, ipv4 clients can connect to [::]:8080 as ::ffff:a.b.c.d
+func IPv6Only(v bool) Option {
+	return func(o *Options) {
+		o.ipv6Only = v
+	}
+}
+
 // ListenBacklog For syscall.listen(fd, backlog), also affect `for i < backlog/2 { syscall.accept() }`
 func ListenBacklog(v int) Option {
 	return func(o *Options) {
@@ -155,6 +166,17 @@ func TimerHeapInitSize(n int) Option {
 	}
 }
 
+// TimerWheel uses a hierarchical timing wheel instead of the heap as the timer backend,
+// tick is the precision in milliseconds. Schedule/Cancel/Reset cost O(1), which suits a large number
+// of timers such as an idle timeout for every connection. tick < 1 means using the heap (default).
+//
+// TimerWheel 使用分层时间轮代替堆实现定时器, tick是精度(毫秒), 适合给每个连接设置空闲超时这种大量定时器的场景
+func TimerWheel(tick int64) Option {
+	return func(o *Options) {
+		o.timerWheelTick = tick
+	}
+}
+
 // NoTimer can be used to specify that no timer object should be created internally within the Reactor.
 // In addition, the time values in OnOpen, OnRead, and OnWrite will also be set to 0.
 // This can slightly improve performance for applications that do not require a timer.
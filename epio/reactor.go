@@ -3,12 +3,14 @@ package epio
 // Autor cuisw. 2023.06
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Reactor provides an I/O event-driven event handling model, where multiple epoll processes
@@ -24,6 +26,9 @@ type Reactor struct {
 	evPollNum          int
 	evPolls            []evPoll
 	timerIdx           atomic.Int64
+	running            atomic.Bool
+	stopped            atomic.Bool
+	done               chan struct{} // Run返回时关闭
 }
 
 // NewReactor return an instance
@@ -36,10 +41,15 @@ func NewReactor(opts ...Option) (*Reactor, error) {
 		evPollLockOSThread: evOptions.evPollLockOSThread,
 		evPollNum:          evOptions.evPollNum,
 		evPolls:            make([]evPoll, evOptions.evPollNum),
+		done:               make(chan struct{}),
 	}
 	var timer timer
 	if !evOptions.noTimer {
-		timer = newTimer4Heap(evOptions.timerHeapInitSize)
+		if evOptions.timerWheelTick > 0 {
+			timer = newTimerWheel(evOptions.timerWheelTick)
+		} else {
+			timer = newTimer4Heap(evOptions.timerHeapInitSize)
+		}
 	}
 	for i := 0; i < r.evPollNum; i++ {
 		if err := r.evPolls[i].open(evOptions.evReadyNum, evOptions.evPollSharedBuffSize,
@@ -67,6 +77,18 @@ func (r *Reactor) AddEvHandler(eh EvHandler, fd int, events uint32) error {
 	return r.evPolls[i].add(fd, events, eh)
 }
 
+// Attach hands an already connected fd to eh the same way Acceptor and Connector do:
+// eh is bound to the Reactor and OnOpen is called, OnClose if it returns false.
+// Use it when the fd was read by another EvHandler first, e.g. a handshake on a shared port.
+//
+// Attach将已经建立的fd交给eh, 和Acceptor/Connector一样先绑定Reactor再调用OnOpen
+func (r *Reactor) Attach(eh EvHandler, fd int) {
+	eh.setReactor(r)
+	if !eh.OnOpen(fd, time.Now().UnixMilli()) {
+		eh.OnClose(fd)
+	}
+}
+
 // RemoveEvHandler removes the handler object from the Reactor.
 func (r *Reactor) RemoveEvHandler(eh EvHandler, fd int) error {
 	if eh == nil || fd < 0 {
@@ -78,12 +100,44 @@ func (r *Reactor) RemoveEvHandler(eh EvHandler, fd int) error {
 	return errors.New("ev handler not add")
 }
 
-// ScheduleTimer starts a timer that can be either one-time execution or repeated execution
+// ParkEvHandler stops polling fd without removing the handler: no event is reported for it any more,
+// not even EPOLLHUP, but Reactor.Stop still waits for it and calls OnClose. Use it for a fd that has
+// nothing to do until something else happens, e.g. a half-closed connection waiting for its peer.
+// AddEvHandler polls it again, RemoveEvHandler removes it as usual.
+//
+// ParkEvHandler将fd移出epoll但保留处理对象, Stop时仍然等待它并调用OnClose
+func (r *Reactor) ParkEvHandler(eh EvHandler, fd int) error {
+	if eh == nil || fd < 0 {
+		return errors.New("invalid EvHandler or fd")
+	}
+	if ep := eh.getEvPoll(); ep != nil {
+		return ep.park(fd)
+	}
+	return errors.New("ev handler not add")
+}
+
+// ModifyEvHandler changes the events the fd is interested in, e.g. arm EvOut when there is pending
+// output, or drop EvIn to stop reading from a fd. events == 0 means only EPOLLHUP/EPOLLERR are reported.
 //
-// # ScheduleTimer 启动一个定时器，可以是执行一次的，也可以是循环执行的
+// ModifyEvHandler修改fd关注的事件, 比如有待写数据时关注EvOut, 或者去掉EvIn暂停读取
+func (r *Reactor) ModifyEvHandler(eh EvHandler, fd int, events uint32) error {
+	if eh == nil || fd < 0 {
+		return errors.New("invalid EvHandler or fd")
+	}
+	if ep := eh.getEvPoll(); ep != nil {
+		return ep.modify(fd, events)
+	}
+	return errors.New("ev handler not add")
+}
+
+// ScheduleTimer starts a timer that can be either one-time execution or repeated execution,
+// the returned handle can Cancel() or Reset() it. An EvHandler can start multiple timers,
+// implement TimerHandler to tell them apart.
+//
+// # ScheduleTimer 启动一个定时器，可以是执行一次的，也可以是循环执行的，返回的句柄可以取消或重置定时器
 //
 // delay, interval are both relative time measurements with millisecond accuracy, for example, delay=5msec.
-func (r *Reactor) ScheduleTimer(eh EvHandler, delay, interval int64) error {
+func (r *Reactor) ScheduleTimer(eh EvHandler, delay, interval int64) (*Timer, error) {
 	i := 0
 	if r.evPollNum > 1 {
 		if ep := eh.getEvPoll(); ep != nil {
@@ -94,8 +148,17 @@ func (r *Reactor) ScheduleTimer(eh EvHandler, delay, interval int64) error {
 	return r.evPolls[i].scheduleTimer(eh, delay, interval)
 }
 
-// Run starts the multi-event evpolling to run.
+// Run starts the multi-event evpolling to run. It returns nil after Stop.
 func (r *Reactor) Run() error {
+	if !r.running.CompareAndSwap(false, true) {
+		if r.stopped.Load() {
+			<-r.done
+			return nil
+		}
+		return errors.New("reactor is already running")
+	}
+	defer close(r.done)
+
 	var wg sync.WaitGroup
 	var errS []string
 	var errSMtx sync.Mutex
@@ -108,10 +171,11 @@ func (r *Reactor) Run() error {
 				// preventing other goroutines from being scheduled onto this thread T
 				runtime.LockOSThread()
 			}
-			err := r.evPolls[j].run(&wg)
-			errSMtx.Lock()
-			errS = append(errS, fmt.Sprintf("epoll#%d err: %s", j, err.Error()))
-			errSMtx.Unlock()
+			if err := r.evPolls[j].run(&wg); err != nil {
+				errSMtx.Lock()
+				errS = append(errS, fmt.Sprintf("epoll#%d err: %s", j, err.Error()))
+				errSMtx.Unlock()
+			}
 		}(i)
 	}
 	wg.Wait()
@@ -121,3 +185,73 @@ func (r *Reactor) Run() error {
 	}
 	return errors.New(strings.Join(errS, "; "))
 }
+
+// Stop shuts down the Reactor gracefully. Acceptors are closed at once so that no new
+// connections come in, then in-flight handlers are given the chance to finish until ctx is done.
+// After that OnClose is called on all remaining handlers, the epoll fds are closed and Run returns nil.
+// Stop returns ctx.Err() if the handlers didn't drain in time.
+//
+// Stop 先关闭所有Acceptor, 然后等待已有的连接结束直到ctx超时, 最后对剩余的EvHandler调用OnClose,
+// 关闭epoll fd, Run返回nil
+func (r *Reactor) Stop(ctx context.Context) error {
+	if !r.stopped.CompareAndSwap(false, true) {
+		<-r.done
+		return nil
+	}
+	if r.running.CompareAndSwap(false, true) {
+		// Run没有启动过, 在当前goroutine中清理
+		for i := range r.evPolls {
+			r.evPolls[i].stopping.Store(true)
+			r.evPolls[i].shutdown()
+		}
+		close(r.done)
+		return nil
+	}
+	for i := range r.evPolls {
+		ep := &r.evPolls[i]
+		ep.post(ep.closeAcceptors)
+	}
+
+	var err error
+	tk := time.NewTicker(10 * time.Millisecond)
+	defer tk.Stop()
+	for drained := false; !drained; {
+		drained = true
+		for i := range r.evPolls {
+			if r.evPolls[i].handlers() > 0 {
+				drained = false
+				break
+			}
+		}
+		if drained {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			drained = true
+		case <-tk.C:
+		}
+	}
+
+	for i := range r.evPolls {
+		r.evPolls[i].stop()
+	}
+	<-r.done
+	return err
+}
+
+// Post queues fn to run on the evPoll goroutine that owns eh, so it is serialized with
+// OnRead/OnWrite/OnTimeout/OnClose of the handlers on that evPoll. fn MUST NOT block.
+// eh MUST have been added to the Reactor. Tasks posted to the same evPoll run in order.
+//
+// Post 将fn投递到eh所在的evPoll中执行, 与该evPoll上的I/O事件串行, 用于在其他goroutine中操作连接
+func (r *Reactor) Post(eh EvHandler, fn func()) error {
+	if eh == nil || fn == nil {
+		return errors.New("Post: invalid params")
+	}
+	if ep := eh.getEvPoll(); ep != nil {
+		return ep.post(fn)
+	}
+	return errors.New("ev handler not add")
+}
@@ -0,0 +1,240 @@
+package epio
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type echo struct {
+	Event
+	closed *atomic.Int32
+}
+
+func (e *echo) OnOpen(fd int, now int64) bool {
+	return e.GetReactor().AddEvHandler(e, fd, EvIn) == nil
+}
+func (e *echo) OnRead(fd int, evPollSharedBuff []byte, now int64) bool {
+	n, err := Read(fd, evPollSharedBuff)
+	if n <= 0 || err != nil {
+		return false
+	}
+	Write(fd, evPollSharedBuff[:n])
+	return true
+}
+func (e *echo) OnClose(fd int) {
+	Close(fd)
+	e.closed.Add(1)
+}
+
+func startEchoReactor(t *testing.T, addr string, closed *atomic.Int32) (*Reactor, *Acceptor, chan error) {
+	t.Helper()
+	r, err := NewReactor(EvPollNum(2))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	a, err := NewAcceptor(r, r, func() EvHandler { return &echo{closed: closed} }, addr, ReuseAddr(true))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ret := make(chan error, 1)
+	go func() { ret <- r.Run() }()
+	return r, a, ret
+}
+
+func TestReactorStop(t *testing.T) {
+	t.Run("超时后关闭剩余连接", func(t *testing.T) {
+		var closed atomic.Int32
+		r, a, ret := startEchoReactor(t, "127.0.0.1:3150", &closed)
+		conns := make([]net.Conn, 0, 4)
+		for i := 0; i < 4; i++ {
+			conn, err := net.Dial("tcp", "127.0.0.1:3150")
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer conn.Close()
+			conn.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			_, err = conn.Read(buf)
+			assert.Nil(t, err)
+			conns = append(conns, conn)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, r.Stop(ctx), context.DeadlineExceeded)
+		assert.Nil(t, <-ret)
+		assert.Equal(t, int32(4), closed.Load())
+		<-a.Close
+
+		for _, conn := range conns {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err := conn.Read(make([]byte, 1))
+			assert.NotNil(t, err) // EOF
+		}
+		_, err := net.Dial("tcp", "127.0.0.1:3150")
+		assert.NotNil(t, err)
+		assert.Nil(t, r.Stop(context.Background())) // 可以重复调用
+	})
+
+	t.Run("等待连接结束", func(t *testing.T) {
+		var closed atomic.Int32
+		r, _, ret := startEchoReactor(t, "127.0.0.1:3151", &closed)
+		conn, err := net.Dial("tcp", "127.0.0.1:3151")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		conn.Write([]byte("ping"))
+		conn.Read(make([]byte, 4))
+		time.AfterFunc(50*time.Millisecond, func() { conn.Close() })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		start := time.Now()
+		assert.Nil(t, r.Stop(ctx))
+		assert.Less(t, time.Since(start), time.Second)
+		assert.Nil(t, <-ret)
+		assert.Equal(t, int32(1), closed.Load())
+	})
+
+	t.Run("移出epoll的fd也会关闭", func(t *testing.T) {
+		var closed atomic.Int32
+		r, err := NewReactor(EvPollNum(1))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ret := make(chan error, 1)
+		go func() { ret <- r.Run() }()
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		e := &echo{closed: &closed}
+		e.setReactor(r)
+		assert.True(t, e.OnOpen(fds[0], 0))
+		running := make(chan struct{})
+		assert.Nil(t, r.Post(e, func() { close(running) }))
+		<-running // Run已经启动
+		assert.Nil(t, r.ParkEvHandler(e, fds[0]))
+		syscall.Close(fds[1]) // 不再有EPOLLHUP
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, r.Stop(ctx), context.DeadlineExceeded, "还在等待它")
+		assert.Nil(t, <-ret)
+		assert.Equal(t, int32(1), closed.Load())
+	})
+
+	t.Run("Run之前Stop", func(t *testing.T) {
+		r, err := NewReactor(EvPollNum(2))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.Nil(t, r.Stop(context.Background()))
+		assert.Nil(t, r.Run())
+		assert.NotNil(t, r.AddEvHandler(&echo{}, 0, EvIn))
+	})
+}
+
+type postEcho struct {
+	echo
+	opened chan *postEcho
+	fd     int
+}
+
+func (e *postEcho) OnOpen(fd int, now int64) bool {
+	e.fd = fd
+	if !e.echo.OnOpen(fd, now) {
+		return false
+	}
+	e.opened <- e
+	return true
+}
+
+func TestReactorPost(t *testing.T) {
+	var closed atomic.Int32
+	opened := make(chan *postEcho, 1)
+	r, err := NewReactor(EvPollNum(2))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = NewAcceptor(r, r, func() EvHandler {
+		e := &postEcho{opened: opened}
+		e.echo.closed = &closed
+		return e
+	}, "127.0.0.1:3152", ReuseAddr(true))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go r.Run()
+	defer r.Stop(context.Background())
+
+	assert.NotNil(t, r.Post(&echo{}, func() {})) // 没有注册的EvHandler
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3152")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	e := <-opened
+
+	// 同一个evPoll上的任务按投递的顺序执行
+	var seq []int
+	done := make(chan struct{})
+	for i := 0; i < 100; i++ {
+		j := i
+		assert.Nil(t, r.Post(e, func() { seq = append(seq, j) }))
+	}
+	assert.Nil(t, r.Post(e, func() {
+		r.RemoveEvHandler(e, e.fd)
+		e.OnClose(e.fd)
+		close(done)
+	}))
+	<-done
+	for i := range seq {
+		assert.Equal(t, i, seq[i])
+	}
+	assert.Equal(t, 100, len(seq))
+	assert.Equal(t, int32(1), closed.Load())
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err) // EOF
+}
+
+func TestReactorAttach(t *testing.T) {
+	var closed atomic.Int32
+	r, err := NewReactor(EvPollNum(2))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go r.Run()
+	defer r.Stop(context.Background())
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer syscall.Close(fds[1])
+	r.Attach(&echo{closed: &closed}, fds[0])
+
+	syscall.Write(fds[1], []byte("ping"))
+	buf := make([]byte, 4)
+	var n int
+	for start := time.Now(); n < 4 && time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		if m, err := syscall.Read(fds[1], buf[n:]); err == nil {
+			n += m
+		}
+	}
+	assert.Equal(t, "ping", string(buf[:n]))
+
+	syscall.Shutdown(fds[1], syscall.SHUT_WR)
+	for start := time.Now(); closed.Load() == 0 && time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+	}
+	assert.Equal(t, int32(1), closed.Load())
+}
@@ -1,7 +1,14 @@
 package epio
 
+import "errors"
+
 type timer interface {
-	schedule(eh EvHandler, delay, interval int64) error
+	// schedule 把handle和新的timerItem关联之后再放进定时器, 在evPoll中触发时handle已经设置好了
+	schedule(eh EvHandler, delay, interval int64, handle *Timer) (*timerItem, error)
+
+	cancel(ti *timerItem)
+
+	reset(ti *timerItem, delay int64) error
 
 	handleExpired(now int64) int64
 
@@ -12,5 +19,70 @@ type timerItem struct {
 	noCopy
 	expiredAt int64
 	interval  int64
+	index     int  // 在定时器结构中的位置, -1表示不在其中(已触发或已取消)
+	canceled  bool // Cancel()之后不再重复触发
 	eh        EvHandler
+	handle    *Timer
+
+	prev, next *timerItem // timerWheel中同一个槽的链表
+}
+
+// newTimerItem 创建timerItem并和handle互相关联, 必须在加入定时器之前调用
+func newTimerItem(eh EvHandler, expiredAt, interval int64, handle *Timer) *timerItem {
+	ti := &timerItem{
+		expiredAt: expiredAt,
+		interval:  interval,
+		index:     -1,
+		eh:        eh,
+		handle:    handle,
+	}
+	if handle != nil {
+		handle.ti = ti
+	}
+	return ti
+}
+
+// Timer is the handle of a timer started by Reactor.ScheduleTimer, it's safe to use in any goroutine,
+// including in OnTimeout.
+//
+// Timer 是Reactor.ScheduleTimer返回的定时器句柄, 可以在任意goroutine中使用(包括OnTimeout)
+type Timer struct {
+	ti *timerItem
+	ep *evPoll
+}
+
+// TimerHandler can be implemented by an EvHandler that starts multiple timers, OnTimer will be
+// called instead of OnTimeout with the handle of the expired timer.
+//
+// The handle passed to OnTimer is always the one returned by ScheduleTimer, but a timer with a
+// very small delay may expire before the caller has stored that handle.
+type TimerHandler interface {
+	// Remove timer when return false
+	OnTimer(t *Timer, millisecond int64) bool
+}
+
+// Cancel stops the timer. If the timer is expiring at the same time, OnTimeout may still be called once.
+func (t *Timer) Cancel() {
+	t.ep.timer.cancel(t.ti)
+}
+
+// Reset changes the timer to expire after delay milliseconds, the interval is unchanged.
+// It also restarts a timer that has expired or been canceled.
+func (t *Timer) Reset(delay int64) error {
+	if delay < 0 {
+		return errors.New("params are invalid")
+	}
+	if err := t.ep.timer.reset(t.ti, delay); err != nil {
+		return err
+	}
+	t.ep.evPollWakeup.Notify()
+	return nil
+}
+
+// onTimeout dispatch the expired timer to the EvHandler
+func (ti *timerItem) onTimeout(now int64) bool {
+	if th, ok := ti.eh.(TimerHandler); ok {
+		return th.OnTimer(ti.handle, now)
+	}
+	return ti.eh.OnTimeout(now)
 }
@@ -24,22 +24,17 @@ func newTimer4Heap(initCap int) *timer4Heap {
 	return th
 }
 
-func (th *timer4Heap) schedule(eh EvHandler, delay, interval int64) error {
+func (th *timer4Heap) schedule(eh EvHandler, delay, interval int64, handle *Timer) (*timerItem, error) {
 	if delay < 0 || interval < 0 {
-		return errors.New("params are invalid")
+		return nil, errors.New("params are invalid")
 	}
 
 	now := time.Now().UnixMilli()
-	ti := &timerItem{
-		expiredAt: now + delay,
-		interval:  interval,
-		eh:        eh,
-	}
+	ti := newTimerItem(eh, now+delay, interval, handle)
 	th.fheapMtx.Lock()
-	th.fheap = append(th.fheap, ti)
-	th.shiftUp(len(th.fheap) - 1)
+	th.push(ti)
 	th.fheapMtx.Unlock()
-	return nil
+	return ti, nil
 }
 func (th *timer4Heap) scheduleTest(eh EvHandler, delay, interval int64) error {
 	ti := &timerItem{
@@ -48,31 +43,70 @@ func (th *timer4Heap) scheduleTest(eh EvHandler, delay, interval int64) error {
 		eh:        eh,
 	}
 	th.fheapMtx.Lock()
-	th.fheap = append(th.fheap, ti)
-	th.shiftUp(len(th.fheap) - 1)
+	th.push(ti)
 	th.fheapMtx.Unlock()
 	return nil
 }
-func (th *timer4Heap) handleExpired(now int64) int64 {
+
+func (th *timer4Heap) cancel(ti *timerItem) {
 	th.fheapMtx.Lock()
 	defer th.fheapMtx.Unlock()
+	ti.canceled = true
+	if ti.index >= 0 {
+		th.removeAt(ti.index)
+	}
+}
 
-	delta := int64(-1)
-	var item *timerItem
+func (th *timer4Heap) reset(ti *timerItem, delay int64) error {
+	now := time.Now().UnixMilli()
+	th.fheapMtx.Lock()
+	defer th.fheapMtx.Unlock()
+	ti.canceled = false
+	ti.expiredAt = now + delay
+	if ti.index >= 0 {
+		th.fix(ti.index)
+	} else {
+		th.push(ti)
+	}
+	return nil
+}
+
+// handleExpired 在锁外调用OnTimeout, 这样在OnTimeout中也可以ScheduleTimer/Cancel/Reset
+//
+// 同一个Reactor中的多个evPoll共用一个定时器, 可能同时调用
+func (th *timer4Heap) handleExpired(now int64) int64 {
+	var expired []*timerItem
+	th.fheapMtx.Lock()
 	for {
-		item, delta = th.popOne(now, 2)
+		item, _ := th.popOne(now, 2)
 		if item == nil {
-			if delta == 0 { // empty
-				delta = -1
-			}
 			break
 		}
-		if item.eh.OnTimeout(now) && item.interval > 0 {
-			item.expiredAt = now + item.interval
-			th.fheap = append(th.fheap, item)
-			th.shiftUp(len(th.fheap) - 1)
+		expired = append(expired, item)
+	}
+	th.fheapMtx.Unlock()
+
+	for _, item := range expired {
+		if item.onTimeout(now) && item.interval > 0 {
+			th.fheapMtx.Lock()
+			// 在OnTimeout中Cancel了就不再触发, Reset了就已经在堆中了
+			if !item.canceled && item.index < 0 {
+				item.expiredAt = now + item.interval
+				th.push(item)
+			}
+			th.fheapMtx.Unlock()
 		}
 	}
+
+	th.fheapMtx.Lock()
+	defer th.fheapMtx.Unlock()
+	if len(th.fheap) == 0 {
+		return -1
+	}
+	delta := th.fheap[0].expiredAt - now
+	if delta < 0 {
+		delta = 0
+	}
 	return delta
 }
 
@@ -82,6 +116,12 @@ func (th *timer4Heap) size() int {
 	return len(th.fheap)
 }
 
+func (th *timer4Heap) push(ti *timerItem) {
+	ti.index = len(th.fheap)
+	th.fheap = append(th.fheap, ti)
+	th.shiftUp(ti.index)
+}
+
 func (th *timer4Heap) popOne(now, errorVal int64) (*timerItem, int64) {
 	if len(th.fheap) == 0 {
 		return nil, 0
@@ -92,20 +132,43 @@ func (th *timer4Heap) popOne(now, errorVal int64) (*timerItem, int64) {
 	if delta > errorVal {
 		return nil, delta
 	}
+	th.removeAt(0)
+	return min, 0
+}
+
+func (th *timer4Heap) removeAt(index int) {
+	ti := th.fheap[index]
 	last := len(th.fheap) - 1
-	th.fheap[0] = th.fheap[last]
+	if index != last {
+		th.fheap[index] = th.fheap[last]
+		th.fheap[index].index = index
+	}
+	th.fheap[last] = nil
 	th.fheap = th.fheap[:last]
+	if index != last {
+		th.fix(index)
+	}
+	ti.index = -1
+}
 
-	th.shiftDown(0)
+// fix 位置index上的元素expiredAt改变之后重新调整
+func (th *timer4Heap) fix(index int) {
+	ti := th.fheap[index]
+	th.shiftUp(index)
+	th.shiftDown(ti.index)
+}
 
-	return min, 0
+func (th *timer4Heap) swap(i, j int) {
+	th.fheap[i], th.fheap[j] = th.fheap[j], th.fheap[i]
+	th.fheap[i].index = i
+	th.fheap[j].index = j
 }
 
 func (th *timer4Heap) shiftUp(index int) {
 	parent := (index - 1) / 4
 
 	for index > 0 && th.fheap[index].expiredAt < th.fheap[parent].expiredAt {
-		th.fheap[index], th.fheap[parent] = th.fheap[parent], th.fheap[index]
+		th.swap(index, parent)
 		index = parent
 		parent = (index - 1) / 4
 	}
@@ -127,7 +190,7 @@ func (th *timer4Heap) shiftDown(index int) {
 			}
 
 			if smallest != index {
-				th.fheap[index], th.fheap[smallest] = th.fheap[smallest], th.fheap[index]
+				th.swap(index, smallest)
 				index = smallest
 			} else {
 				break
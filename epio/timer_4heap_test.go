@@ -3,7 +3,11 @@ package epio
 import (
 	"fmt"
 	"math/rand"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 type fheapTimer struct {
@@ -27,3 +31,101 @@ func TestTimer4Heap_Algo(t *testing.T) {
 	}
 	fmt.Println("len", t4h.size())
 }
+
+func TestTimer4Heap_CancelReset(t *testing.T) {
+	t4h := newTimer4Heap(16)
+	items := make([]*timerItem, 0, 100)
+	for i := 0; i < 100; i++ {
+		ti, err := t4h.schedule(&fheapTimer{}, int64(1000+rand.Intn(1000)), 0, nil)
+		assert.Nil(t, err)
+		items = append(items, ti)
+	}
+	for i := 0; i < 50; i++ {
+		t4h.cancel(items[i])
+		assert.Equal(t, -1, items[i].index)
+	}
+	assert.Equal(t, 50, t4h.size())
+	for i := 50; i < 100; i += 2 {
+		t4h.reset(items[i], 0)
+	}
+	t4h.reset(items[0], 0) // 已取消的定时器可以重新启动
+	assert.Equal(t, 51, t4h.size())
+
+	// 堆序必须保持
+	last := int64(0)
+	for t4h.size() > 0 {
+		ti, _ := t4h.popOne(0, 1<<62)
+		assert.GreaterOrEqual(t, ti.expiredAt, last)
+		last = ti.expiredAt
+	}
+}
+
+type multiTimer struct {
+	Event
+	mtx   sync.Mutex
+	fired map[*Timer]int
+}
+
+func (h *multiTimer) OnTimer(t *Timer, now int64) bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.fired[t]++
+	return true
+}
+
+func TestReactorTimerHandle(t *testing.T) {
+	t.Run("heap", func(t *testing.T) { testReactorTimerHandle(t) })
+	t.Run("wheel", func(t *testing.T) { testReactorTimerHandle(t, TimerWheel(1)) })
+}
+
+func testReactorTimerHandle(t *testing.T, opts ...Option) {
+	r, err := NewReactor(append(opts, EvPollNum(2))...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go r.Run()
+
+	h := &multiTimer{fired: make(map[*Timer]int)}
+	once, _ := r.ScheduleTimer(h, 20, 0)
+	repeat, _ := r.ScheduleTimer(h, 10, 10)
+	canceled, _ := r.ScheduleTimer(h, 20, 0)
+	delayed, _ := r.ScheduleTimer(h, 20, 0)
+	canceled.Cancel()
+	assert.Nil(t, delayed.Reset(500))
+
+	time.Sleep(200 * time.Millisecond)
+	h.mtx.Lock()
+	assert.Equal(t, 1, h.fired[once])
+	assert.Greater(t, h.fired[repeat], 3)
+	assert.Equal(t, 0, h.fired[canceled])
+	assert.Equal(t, 0, h.fired[delayed])
+	h.mtx.Unlock()
+
+	repeat.Cancel()
+	time.Sleep(50 * time.Millisecond) // 可能有一次正在触发
+	h.mtx.Lock()
+	n := h.fired[repeat]
+	h.mtx.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	h.mtx.Lock()
+	assert.Equal(t, n, h.fired[repeat])
+	h.mtx.Unlock()
+
+	time.Sleep(400 * time.Millisecond)
+	h.mtx.Lock()
+	assert.Equal(t, 1, h.fired[delayed])
+	h.mtx.Unlock()
+
+	// 立即到期的定时器触发时也已经有了句柄
+	for i := 0; i < 100; i++ {
+		now, _ := r.ScheduleTimer(h, 0, 0)
+		assert.Eventually(t, func() bool {
+			h.mtx.Lock()
+			defer h.mtx.Unlock()
+			return h.fired[now] == 1
+		}, time.Second, time.Millisecond)
+	}
+	h.mtx.Lock()
+	assert.Equal(t, 0, h.fired[nil])
+	h.mtx.Unlock()
+}
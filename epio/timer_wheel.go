@@ -0,0 +1,223 @@
+package epio
+
+import (
+	"errors"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+const (
+	wheelBits   = 6
+	wheelSlots  = 1 << wheelBits
+	wheelMask   = wheelSlots - 1
+	wheelLevels = 5 // 64^5个tick, tick=1ms时约34年
+)
+
+// timerWheel 分层时间轮, 每层64个槽, 第i层一个槽跨越64^i个tick。
+// 添加/取消/重置都是O(1), 到期之前逐层下沉(cascade)到第0层。
+//
+// Refer to linux kernel/timer.c (before 4.8)
+type timerWheel struct {
+	noCopy
+
+	tick   int64 // 毫秒
+	base   int64 // 下一个要处理的tick
+	count  int
+	bitmap uint64 // 第0层非空的槽
+	slots  [wheelLevels][wheelSlots]*timerItem
+	mtx    sync.Mutex
+}
+
+func newTimerWheel(tick int64) *timerWheel {
+	if tick < 1 {
+		panic("timerWheel tick invalid!")
+	}
+	return &timerWheel{
+		tick: tick,
+		base: time.Now().UnixMilli() / tick,
+	}
+}
+
+func (tw *timerWheel) schedule(eh EvHandler, delay, interval int64, handle *Timer) (*timerItem, error) {
+	if delay < 0 || interval < 0 {
+		return nil, errors.New("params are invalid")
+	}
+	now := time.Now().UnixMilli()
+	ti := newTimerItem(eh, now+delay, interval, handle)
+	tw.mtx.Lock()
+	tw.sync(now)
+	tw.add(ti)
+	tw.mtx.Unlock()
+	return ti, nil
+}
+
+func (tw *timerWheel) cancel(ti *timerItem) {
+	tw.mtx.Lock()
+	defer tw.mtx.Unlock()
+	ti.canceled = true
+	if ti.index >= 0 {
+		tw.remove(ti)
+	}
+}
+
+func (tw *timerWheel) reset(ti *timerItem, delay int64) error {
+	now := time.Now().UnixMilli()
+	tw.mtx.Lock()
+	defer tw.mtx.Unlock()
+	ti.canceled = false
+	if ti.index >= 0 {
+		tw.remove(ti)
+	}
+	tw.sync(now)
+	ti.expiredAt = now + delay
+	tw.add(ti)
+	return nil
+}
+
+// sync 时间轮为空时evPoll不会定时调用handleExpired, base停在最后一次处理的时间,
+// 添加之前先更新到现在, 否则会按过去的base放到更高的层, 之后还要逐个处理错过的tick
+func (tw *timerWheel) sync(now int64) {
+	if tw.count == 0 {
+		tw.base = now / tw.tick
+	}
+}
+
+// handleExpired 与timer4Heap相同, 在锁外调用OnTimeout
+func (tw *timerWheel) handleExpired(now int64) int64 {
+	var expired []*timerItem
+	nowTick := now / tw.tick
+	tw.mtx.Lock()
+	if tw.count == 0 {
+		tw.base = nowTick + 1
+	}
+	for tw.base <= nowTick {
+		idx := int(tw.base & wheelMask)
+		if idx == 0 {
+			for level := 1; level < wheelLevels && tw.cascade(level) == 0; level++ {
+			}
+		}
+		// 跳过第0层中空的槽, 最多跳到这一轮的末尾, 那里要cascade
+		if rest := tw.bitmap >> idx; rest&1 == 0 {
+			next := tw.base + int64(wheelSlots-idx)
+			if rest != 0 {
+				next = tw.base + int64(bits.TrailingZeros64(rest))
+			}
+			if next > nowTick+1 {
+				next = nowTick + 1
+			}
+			tw.base = next
+			continue
+		}
+		tw.base++
+		for ti := tw.slots[0][idx]; ti != nil; ti = tw.slots[0][idx] {
+			tw.remove(ti)
+			expired = append(expired, ti)
+		}
+	}
+	tw.mtx.Unlock()
+
+	for _, item := range expired {
+		if item.onTimeout(now) && item.interval > 0 {
+			tw.mtx.Lock()
+			// 在OnTimeout中Cancel了就不再触发, Reset了就已经在时间轮中了
+			if !item.canceled && item.index < 0 {
+				item.expiredAt = now + item.interval
+				tw.add(item)
+			}
+			tw.mtx.Unlock()
+		}
+	}
+
+	tw.mtx.Lock()
+	defer tw.mtx.Unlock()
+	return tw.nextDelta(now)
+}
+
+func (tw *timerWheel) size() int {
+	tw.mtx.Lock()
+	defer tw.mtx.Unlock()
+	return tw.count
+}
+
+// nextDelta 到下一个非空的第0层槽的毫秒数, 第0层为空时等到下一次cascade
+func (tw *timerWheel) nextDelta(now int64) int64 {
+	if tw.count == 0 {
+		return -1
+	}
+	next := (tw.base | wheelMask) + 1
+	if tw.bitmap != 0 {
+		off := int64(bits.TrailingZeros64(bits.RotateLeft64(tw.bitmap, -int(tw.base&wheelMask))))
+		if tw.base+off < next {
+			next = tw.base + off
+		}
+	}
+	delta := next*tw.tick - now
+	if delta < 0 {
+		delta = 0
+	}
+	return delta
+}
+
+// add 根据到期的tick距离base的远近放到对应层的槽中
+func (tw *timerWheel) add(ti *timerItem) {
+	expires := (ti.expiredAt + tw.tick - 1) / tw.tick // 不会提前触发
+	delta := expires - tw.base
+	if delta < 0 {
+		expires, delta = tw.base, 0
+	}
+	level := 0
+	for ; level < wheelLevels-1; level++ {
+		if delta < 1<<(wheelBits*(level+1)) {
+			break
+		}
+	}
+	if max := int64(1)<<(wheelBits*wheelLevels) - 1; delta > max {
+		expires = tw.base + max // 超出范围的放到最远处, 下沉时会再次放到最远处
+	}
+	idx := int(expires>>(wheelBits*level)) & wheelMask
+	ti.index = level*wheelSlots + idx
+	ti.prev = nil
+	ti.next = tw.slots[level][idx]
+	if ti.next != nil {
+		ti.next.prev = ti
+	}
+	tw.slots[level][idx] = ti
+	if level == 0 {
+		tw.bitmap |= 1 << idx
+	}
+	tw.count++
+}
+
+func (tw *timerWheel) remove(ti *timerItem) {
+	level, idx := ti.index/wheelSlots, ti.index%wheelSlots
+	if ti.prev != nil {
+		ti.prev.next = ti.next
+	} else {
+		tw.slots[level][idx] = ti.next
+	}
+	if ti.next != nil {
+		ti.next.prev = ti.prev
+	}
+	if level == 0 && tw.slots[0][idx] == nil {
+		tw.bitmap &^= 1 << idx
+	}
+	ti.prev, ti.next = nil, nil
+	ti.index = -1
+	tw.count--
+}
+
+// cascade 把第level层当前槽中的定时器重新放到下层, 返回槽的下标(为0时继续处理上一层)
+func (tw *timerWheel) cascade(level int) int {
+	idx := int(tw.base>>(wheelBits*level)) & wheelMask
+	ti := tw.slots[level][idx]
+	tw.slots[level][idx] = nil
+	for ti != nil {
+		next := ti.next
+		ti.index = -1
+		tw.count--
+		tw.add(ti)
+		ti = next
+	}
+	return idx
+}
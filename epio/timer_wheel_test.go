@@ -0,0 +1,163 @@
+package epio
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type wheelTimer struct {
+	Event
+	expiredAt int64
+	firedAt   int64
+	fired     int
+}
+
+func (t *wheelTimer) OnTimeout(now int64) bool {
+	t.firedAt = now
+	t.fired++
+	return false
+}
+
+func TestTimerWheel_Algo(t *testing.T) {
+	tw := newTimerWheel(1)
+	start := tw.base
+
+	hs := make([]*wheelTimer, 0, 2000)
+	for i := 0; i < 2000; i++ {
+		// 覆盖前3层, 第0层64ms, 第1层4s, 第2层4min
+		h := &wheelTimer{expiredAt: start + rand.Int63()%(300*1000)}
+		tw.add(&timerItem{expiredAt: h.expiredAt, eh: h, index: -1})
+		hs = append(hs, h)
+	}
+	assert.Equal(t, 2000, tw.size())
+
+	for now := start; tw.size() > 0; now += 7 {
+		delta := tw.handleExpired(now)
+		if tw.size() > 0 {
+			assert.GreaterOrEqual(t, delta, int64(0))
+		}
+	}
+	for _, h := range hs {
+		assert.Equal(t, 1, h.fired)
+		assert.GreaterOrEqual(t, h.firedAt, h.expiredAt) // 不会提前
+		assert.Less(t, h.firedAt, h.expiredAt+7)
+	}
+}
+
+func TestTimerWheel_CancelReset(t *testing.T) {
+	tw := newTimerWheel(1)
+	start := tw.base
+	items := make([]*timerItem, 0, 100)
+	hs := make([]*wheelTimer, 0, 100)
+	for i := 0; i < 100; i++ {
+		h := &wheelTimer{}
+		ti := &timerItem{expiredAt: start + int64(1000+rand.Intn(100000)), eh: h, index: -1}
+		tw.add(ti)
+		items = append(items, ti)
+		hs = append(hs, h)
+	}
+	for i := 0; i < 50; i++ {
+		tw.cancel(items[i])
+		assert.Equal(t, -1, items[i].index)
+	}
+	assert.Equal(t, 50, tw.size())
+	for i := 50; i < 100; i += 2 {
+		tw.reset(items[i], 0)
+	}
+	tw.reset(items[0], 0) // 已取消的定时器可以重新启动
+	assert.Equal(t, 51, tw.size())
+
+	for now := start; tw.size() > 0; now += 100 {
+		tw.handleExpired(now)
+	}
+	for i, h := range hs {
+		if i > 0 && i < 50 {
+			assert.Equal(t, 0, h.fired)
+		} else {
+			assert.Equal(t, 1, h.fired)
+		}
+	}
+}
+
+func TestTimerWheel_Overflow(t *testing.T) {
+	tw := newTimerWheel(1)
+	ti := &timerItem{expiredAt: (tw.base + 1<<40) * tw.tick, eh: &wheelTimer{}, index: -1}
+	tw.add(ti)
+	assert.Equal(t, wheelLevels-1, ti.index/wheelSlots)
+	tw.cancel(ti)
+	assert.Equal(t, 0, tw.size())
+}
+
+func TestTimerWheel_Idle(t *testing.T) {
+	tw := newTimerWheel(1)
+	tw.base -= 24 * 3600 * 1000 // 一天没有定时器, evPoll没有调用handleExpired
+	h := &wheelTimer{}
+	ti, _ := tw.schedule(h, 5000, 0, nil)
+	assert.Equal(t, 2, ti.index/wheelSlots, "按现在的时间放到第2层")
+
+	now := time.Now().UnixMilli()
+	start := time.Now()
+	tw.handleExpired(now)
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, 0, h.fired)
+	tw.handleExpired(ti.expiredAt - 1)
+	assert.Equal(t, 0, h.fired)
+	tw.handleExpired(ti.expiredAt)
+	assert.Equal(t, 1, h.fired)
+
+	// 只有很远的定时器时, 一次处理很长的时间也只跳过空的槽
+	far := &wheelTimer{}
+	ti, _ = tw.schedule(far, 3600*1000, 0, nil)
+	start = time.Now()
+	tw.handleExpired(ti.expiredAt - 1)
+	assert.Equal(t, 0, far.fired)
+	tw.handleExpired(ti.expiredAt)
+	assert.Equal(t, 1, far.fired)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+}
+
+// 每个连接一个空闲超时定时器, 每次收到数据时Reset
+func benchmarkTimerReset(b *testing.B, tm timer) {
+	items := make([]*timerItem, 10000)
+	for i := range items {
+		items[i], _ = tm.schedule(&wheelTimer{}, int64(30000+i), 0, nil)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			tm.reset(items[r.Intn(len(items))], 30000)
+		}
+	})
+}
+
+func benchmarkTimerScheduleCancel(b *testing.B, tm timer) {
+	for i := 0; i < 10000; i++ {
+		tm.schedule(&wheelTimer{}, int64(30000+i), 0, nil)
+	}
+	h := &wheelTimer{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ti, _ := tm.schedule(h, int64(i%60000), 0, nil)
+		tm.cancel(ti)
+	}
+}
+
+func BenchmarkTimer4Heap_Reset(b *testing.B) {
+	benchmarkTimerReset(b, newTimer4Heap(1024))
+}
+
+func BenchmarkTimerWheel_Reset(b *testing.B) {
+	benchmarkTimerReset(b, newTimerWheel(1))
+}
+
+func BenchmarkTimer4Heap_ScheduleCancel(b *testing.B) {
+	benchmarkTimerScheduleCancel(b, newTimer4Heap(1024))
+}
+
+func BenchmarkTimerWheel_ScheduleCancel(b *testing.B) {
+	benchmarkTimerScheduleCancel(b, newTimerWheel(1))
+}
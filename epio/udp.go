@@ -0,0 +1,100 @@
+package epio
+
+import (
+	"errors"
+	"syscall"
+)
+
+// UDPBind creates a nonblocking udp socket bound to addr, use RecvFrom/SendTo on it.
+//
+// The addr format 192.168.0.1:8080 or :8080 or [::1]:8080
+func UDPBind(addr string, opts ...Option) (int, error) {
+	evOptions := setOptions(opts...)
+	sa, err := addr2SA(addr)
+	if err != nil {
+		return -1, err
+	}
+	fd, err := syscall.Socket(sockFamily(sa), syscall.SOCK_DGRAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, errors.New("Socket in UDPBind: " + err.Error())
+	}
+	if _, ok := sa.(*syscall.SockaddrInet6); ok {
+		v := 0
+		if evOptions.ipv6Only {
+			v = 1
+		}
+		if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, v); err != nil {
+			syscall.Close(fd)
+			return -1, errors.New("Set IPV6_V6ONLY in UDPBind: " + err.Error())
+		}
+	}
+	if evOptions.reuseAddr {
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			syscall.Close(fd)
+			return -1, errors.New("Set SO_REUSEADDR in UDPBind: " + err.Error())
+		}
+	}
+	if evOptions.sockRcvBufSize > 0 {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, evOptions.sockRcvBufSize)
+		if err != nil {
+			syscall.Close(fd)
+			return -1, errors.New("Set SO_RCVBUF: " + err.Error())
+		}
+	}
+	if err = syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return -1, errors.New("syscall bind: " + err.Error())
+	}
+	return fd, nil
+}
+
+// UDPConnect creates a nonblocking udp socket connected to addr, so Read/Write can be used on it
+// and only datagrams from addr are received.
+//
+// The addr format 192.168.0.1:8080 or [::1]:8080
+func UDPConnect(addr string) (int, error) {
+	sa, err := addr2SA(addr)
+	if err != nil {
+		return -1, err
+	}
+	fd, err := syscall.Socket(sockFamily(sa), syscall.SOCK_DGRAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, errors.New("Socket in UDPConnect: " + err.Error())
+	}
+	if err = syscall.Connect(fd, sa); err != nil {
+		syscall.Close(fd)
+		return -1, errors.New("syscall connect: " + err.Error())
+	}
+	return fd, nil
+}
+
+// RecvFrom safely receive a datagram and its source address (ignoring EINTR).
+func RecvFrom(fd int, buf []byte) (n int, from syscall.Sockaddr, err error) {
+	for {
+		n, from, err = syscall.Recvfrom(fd, buf, 0)
+		if err != nil && err == syscall.EINTR {
+			continue
+		}
+		break
+	}
+	return
+}
+
+// SendTo safely send a datagram to the address (ignoring EINTR).
+func SendTo(fd int, buf []byte, to syscall.Sockaddr) (err error) {
+	for {
+		err = syscall.Sendto(fd, buf, 0, to)
+		if err != nil && err == syscall.EINTR {
+			continue
+		}
+		break
+	}
+	return
+}
+
+// SockaddrString formats the address returned by RecvFrom.
+//
+// Return format 192.168.0.1:8080 or [::1]:8080
+func SockaddrString(sa syscall.Sockaddr) string {
+	return sa2Addr(sa)
+}
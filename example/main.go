@@ -1,18 +1,82 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	gproxy "g-proxy"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
+	socks := flag.String("socks", "", "SOCKS5侦听地址, 例如:1080, 为空时不开启")
+	connect := flag.String("connect", "", "HTTP CONNECT侦听地址, 例如:3128, 为空时不开启")
+	connectAuth := flag.String("connect-auth", "", "HTTP CONNECT的用户名和密码, 格式user:pass")
+	tunnel := flag.String("tunnel", "", "反向隧道侦听地址, 例如:7000, 为空时不开启")
+	tunnelSecret := flag.String("tunnel-secret", "", "tunnel agent认证用的密钥")
+	mux := flag.String("mux", "", "接受其他gProxy多路复用连接的地址, 例如:7001, 为空时不开启")
+	muxKey := flag.String("mux-key", "", "gProxy之间长连接的预共享密钥, 两端相同, 为空时不加密")
+	dataFile := flag.String("data", "/app/proxyEntry.json", "保存注册的服务的文件, 为空时不保存")
+	sniAddr := flag.String("sni-addr", "", "共享TLS端口的侦听地址, 为空时使用默认的8443")
+	httpAddr := flag.String("http-addr", "", "HTTP端口的侦听地址, 为空时使用默认的8080")
+	flag.Parse()
 	go http.ListenAndServe(":8888", nil)
-	server := gproxy.NewProxyServer()
+	opts := []gproxy.Option{gproxy.DataFile(*dataFile)}
+	if *sniAddr != "" {
+		opts = append(opts, gproxy.SNIAddr(*sniAddr))
+	}
+	if *httpAddr != "" {
+		opts = append(opts, gproxy.HTTPAddr(*httpAddr))
+	}
+	server := gproxy.NewProxyServer(opts...)
+	if *socks != "" {
+		if err := server.ListenSOCKS5(*socks); err != nil {
+			log.Fatalf("could not listen socks5 on %s %v", *socks, err)
+		}
+	}
+	if *connect != "" {
+		user, pass, ok := strings.Cut(*connectAuth, ":")
+		if !ok || user == "" || pass == "" {
+			log.Fatalf("-connect needs -connect-auth user:pass")
+		}
+		if err := server.ListenCONNECT(*connect, map[string]string{user: pass}); err != nil {
+			log.Fatalf("could not listen http connect on %s %v", *connect, err)
+		}
+	}
+	if *tunnel != "" {
+		if err := server.ListenTunnel(*tunnel, *tunnelSecret); err != nil {
+			log.Fatalf("could not listen tunnel on %s %v", *tunnel, err)
+		}
+	}
+	server.SetMuxKey(*muxKey)
+	if *mux != "" {
+		if err := server.ListenMux(*mux, *muxKey); err != nil {
+			log.Fatalf("could not listen mux on %s %v", *mux, err)
+		}
+	}
 	fmt.Printf("Proxy Server Running \n")
-	if err := http.ListenAndServe(":18085", server); err != nil {
-		log.Fatalf("could not listen on port 18085 %v", err)
+	api := &http.Server{Addr: ":18085", Handler: server}
+	go func() {
+		if err := api.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("could not listen on port 18085 %v", err)
+		}
+	}()
+
+	// 退出时等待转发结束, 并把日志合并到快照
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	api.Shutdown(ctx)
+	if err := server.Stop(ctx); err != nil {
+		log.Printf("stop: %v", err)
 	}
 }
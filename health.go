@@ -0,0 +1,183 @@
+package gproxy
+
+import (
+	"bytes"
+	"fmt"
+	epio "g-proxy/epio"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// 健康检查的默认超时时间(秒)
+const defaultHealthTimeout = 2
+
+// HealthCheck 后端的主动健康检查配置, Path为空时只检查TCP连接
+type HealthCheck struct {
+	Interval int    `json:",omitempty"` // 检查间隔秒数, 0不检查
+	Timeout  int    `json:",omitempty"` // 超时秒数, 0使用默认值
+	Path     string `json:",omitempty"` // HTTP GET的路径, 返回2xx/3xx为健康
+}
+
+// healthChecker 按Interval定时检查balancer中的每个后端, 标记它们的上下线
+type healthChecker struct {
+	epio.Event
+	c          *epio.Connector
+	lb         *balancer
+	conf       HealthCheck
+	timeout    int64 // 毫秒
+	proxyProto string
+	timer      *epio.Timer
+
+	mtx     sync.Mutex
+	stopped bool // stop之后还没结束的检查不再修改后端状态
+}
+
+// startHealthCheck 立即开始第一次检查, 之后每隔Interval检查一次。
+// proxyProto不为空时HTTP检查的请求前面加上不带客户端地址的PROXY协议头
+func startHealthCheck(r *epio.Reactor, c *epio.Connector, lb *balancer, conf HealthCheck, proxyProto string) *healthChecker {
+	hc := &healthChecker{c: c, lb: lb, conf: conf, proxyProto: proxyProto}
+	hc.timeout = int64(conf.Timeout) * 1000
+	if hc.timeout <= 0 {
+		hc.timeout = defaultHealthTimeout * 1000
+	}
+	hc.timer, _ = r.ScheduleTimer(hc, 0, int64(conf.Interval)*1000)
+	return hc
+}
+
+// stop 停止检查, 所有后端恢复为上线, 不再检查时不能一直跳过它们
+func (hc *healthChecker) stop() {
+	if hc.timer != nil {
+		hc.timer.Cancel()
+	}
+	hc.mtx.Lock()
+	defer hc.mtx.Unlock()
+	hc.stopped = true
+	for i := range hc.lb.backends {
+		hc.lb.up[i].Store(true)
+	}
+}
+
+// OnTimeout 为每个后端发起一次检查
+func (hc *healthChecker) OnTimeout(now int64) bool {
+	for i := range hc.lb.backends {
+		pb := &healthProbe{hc: hc, i: i}
+		if err := hc.c.Connect(hc.lb.backends[i].String(), pb, hc.timeout); err != nil {
+			hc.setUp(i, false)
+		}
+	}
+	return true
+}
+
+func (hc *healthChecker) setUp(i int, up bool) {
+	hc.mtx.Lock()
+	defer hc.mtx.Unlock()
+	if hc.stopped {
+		return
+	}
+	if hc.lb.up[i].Swap(up) != up {
+		state := "down"
+		if up {
+			state = "up"
+		}
+		fmt.Printf("backend %s %s\n", hc.lb.backends[i].String(), state)
+	}
+}
+
+// healthProbe 对一个后端的一次检查
+type healthProbe struct {
+	epio.Event
+	hc    *healthChecker
+	i     int
+	buf   []byte
+	timer *epio.Timer
+}
+
+// OnOpen TCP检查时连接成功就是健康的, HTTP检查时发送请求等待响应的状态行
+func (pb *healthProbe) OnOpen(fd int, now int64) bool {
+	if pb.hc.conf.Path == "" {
+		epio.Close(fd)
+		pb.hc.setUp(pb.i, true)
+		return true
+	}
+	var req []byte
+	if pb.hc.proxyProto != "" {
+		req = proxyHeader(pb.hc.proxyProto, "", "")
+	}
+	req = append(req, "GET "+pb.hc.conf.Path+" HTTP/1.0\r\nHost: "+pb.hc.lb.backends[pb.i].String()+
+		"\r\nUser-Agent: gproxy-health\r\nConnection: close\r\n\r\n"...)
+	// 请求很小, 新连接的发送缓冲区放得下, 没有全部写出时当作失败, 不等待EPOLLOUT
+	if n, err := epio.Write(fd, req); err != nil || n < len(req) {
+		pb.hc.setUp(pb.i, false)
+		return false
+	}
+	pb.SetFd(fd)
+	// 注册之后随时可能关闭, 先设置好超时, OnClose才能取消它
+	pb.timer, _ = pb.GetReactor().ScheduleTimer(pb, pb.hc.timeout, 0)
+	if err := pb.GetReactor().AddEvHandler(pb, fd, epio.EvIn); err != nil {
+		pb.hc.setUp(pb.i, false)
+		return false
+	}
+	return true
+}
+
+// OnRead 读到状态行为止
+func (pb *healthProbe) OnRead(fd int, evPollSharedBuff []byte, now int64) bool {
+	for {
+		n, err := epio.Read(fd, evPollSharedBuff)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				break
+			}
+			pb.hc.setUp(pb.i, false)
+			return false
+		}
+		if n == 0 {
+			pb.hc.setUp(pb.i, false) // 没有完整的状态行
+			return false
+		}
+		pb.buf = append(pb.buf, evPollSharedBuff[:n]...)
+		if p := bytes.Index(pb.buf, []byte("\r\n")); p >= 0 {
+			pb.hc.setUp(pb.i, healthyStatus(pb.buf[:p]))
+			return false
+		}
+		if len(pb.buf) > 1024 {
+			pb.hc.setUp(pb.i, false)
+			return false
+		}
+	}
+	return true
+}
+
+// OnTimeout HTTP响应超时, 在evPoll中关闭, 避免和OnRead同时进行
+func (pb *healthProbe) OnTimeout(now int64) bool {
+	pb.GetReactor().Post(pb, func() {
+		if fd := pb.GetFd(); fd != -1 && pb.GetReactor().RemoveEvHandler(pb, fd) == nil {
+			pb.hc.setUp(pb.i, false)
+			pb.OnClose(fd)
+		}
+	})
+	return false
+}
+
+func (pb *healthProbe) OnClose(fd int) {
+	if pb.timer != nil {
+		pb.timer.Cancel()
+	}
+	epio.Close(fd)
+	pb.SetFd(-1)
+}
+
+func (pb *healthProbe) OnConnectFail(err error) {
+	pb.hc.setUp(pb.i, false)
+}
+
+// healthyStatus 状态行为"HTTP/1.x 2xx ..."或"HTTP/1.x 3xx ..."
+func healthyStatus(line []byte) bool {
+	fields := bytes.Fields(line)
+	if len(fields) < 2 || !bytes.HasPrefix(fields[0], []byte("HTTP/")) {
+		return false
+	}
+	code, err := strconv.Atoi(string(fields[1]))
+	return err == nil && code >= 200 && code < 400
+}
@@ -0,0 +1,112 @@
+package gproxy
+
+import (
+	"context"
+	epio "g-proxy/epio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// deadAddr 返回一个没有侦听的地址
+func deadAddr(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+	return addr
+}
+
+func TestHealthyStatus(t *testing.T) {
+	assert.True(t, healthyStatus([]byte("HTTP/1.1 200 OK")))
+	assert.True(t, healthyStatus([]byte("HTTP/1.0 302 Found")))
+	assert.False(t, healthyStatus([]byte("HTTP/1.1 503 Service Unavailable")))
+	assert.False(t, healthyStatus([]byte("SSH-2.0-OpenSSH")))
+	assert.False(t, healthyStatus([]byte("HTTP/1.1")))
+}
+
+func TestHealthCheck(t *testing.T) {
+	r, err := epio.NewReactor(epio.EvPollNum(2))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go r.Run()
+	defer r.Stop(context.Background())
+	c, err := epio.NewConnector(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer hs.Close()
+	httpAddr := hs.Listener.Addr().(*net.TCPAddr)
+
+	waitStatus := func(lb *balancer, want []bool) {
+		t.Helper()
+		var got []bool
+		for start := time.Now(); time.Since(start) < 3*time.Second; time.Sleep(20 * time.Millisecond) {
+			got = got[:0]
+			for _, s := range lb.status() {
+				got = append(got, s.Up)
+			}
+			if assert.ObjectsAreEqual(want, got) {
+				return
+			}
+		}
+		t.Errorf("health status %v, want %v", got, want)
+	}
+
+	t.Run("TCP", func(t *testing.T) {
+		lb := newBalancer("", []*net.TCPAddr{httpAddr, deadAddr(t)})
+		hc := startHealthCheck(r, c, lb, HealthCheck{Interval: 1}, "")
+		waitStatus(lb, []bool{true, false})
+		assert.Equal(t, 0, lb.pick(nil, -1))
+		assert.Equal(t, 0, lb.pick(nil, -1))
+		hc.stop()
+		assert.True(t, lb.status()[1].Up)
+	})
+
+	t.Run("HTTP", func(t *testing.T) {
+		lb := newBalancer("", []*net.TCPAddr{httpAddr, deadAddr(t)})
+		hc := startHealthCheck(r, c, lb, HealthCheck{Interval: 1, Path: "/ok"}, "")
+		waitStatus(lb, []bool{true, false})
+		hc.stop()
+
+		hc = startHealthCheck(r, c, lb, HealthCheck{Interval: 1, Path: "/bad"}, "")
+		waitStatus(lb, []bool{false, false})
+		assert.Equal(t, -1, lb.pick(nil, -1))
+		hc.stop()
+	})
+
+	t.Run("stop之后的检查结果被忽略", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer ln.Close()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			if conn, err := ln.Accept(); err == nil {
+				accepted <- conn // 不回复, 检查会超时
+			}
+		}()
+		lb := newBalancer("", []*net.TCPAddr{ln.Addr().(*net.TCPAddr)})
+		hc := startHealthCheck(r, c, lb, HealthCheck{Interval: 10, Timeout: 1, Path: "/ok"}, "")
+		conn := <-accepted
+		defer conn.Close()
+		hc.stop()
+		time.Sleep(1500 * time.Millisecond)
+		assert.True(t, lb.status()[0].Up)
+	})
+}
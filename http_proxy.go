@@ -0,0 +1,555 @@
+package gproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	epio "g-proxy/epio"
+	"g-proxy/utils"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// HTTP反向代理的共享端口, 按请求的Host和路径前缀把连接转发到注册的服务
+const httpPort = 8080
+
+// 请求头的最大字节数, 超过时返回431
+const maxHTTPHeader = 64 * 1024
+
+var (
+	errHeaderTooLarge = errors.New("request header too large")
+	errRouteChanged   = errors.New("request for another service")
+	errBadChunk       = errors.New("malformed chunked body")
+	errHTTPNoService  = errors.New("no service")
+	errBadFraming     = errors.New("ambiguous request framing")
+	errUpgradeRefused = errors.New("upgrade refused by backend")
+	errUpgradeData    = errors.New("too much data before upgrade response")
+)
+
+// httpRouter 按Host和路径前缀选择服务, 在evPoll和HTTP的goroutine中都会用到
+type httpRouter struct {
+	mtx      sync.RWMutex
+	routes   []*PortProxy
+	acceptor *epio.Acceptor // 第一个服务开始转发时才侦听共享端口, 最后一个服务删除时关闭
+}
+
+func newHTTPRouter() *httpRouter {
+	return &httpRouter{}
+}
+
+// add Hostname和PathPrefix都相同的服务已经在转发时返回false
+func (r *httpRouter) add(proxy *PortProxy) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.addLocked(proxy)
+}
+
+func (r *httpRouter) addLocked(proxy *PortProxy) bool {
+	for _, p := range r.routes {
+		if p != proxy && p.Hostname == proxy.Hostname && p.PathPrefix == proxy.PathPrefix {
+			return false
+		}
+	}
+	r.routes = append(r.routes, proxy)
+	return true
+}
+
+func (r *httpRouter) remove(proxy *PortProxy) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for i, p := range r.routes {
+		if p == proxy {
+			r.routes = append(r.routes[:i:i], r.routes[i+1:]...)
+			break
+		}
+	}
+	if len(r.routes) == 0 && r.acceptor != nil {
+		stopAcceptor(r.acceptor)
+		r.acceptor = nil
+	}
+}
+
+// lookup Hostname相同的服务优先于没有设置Hostname的服务, 其次选择最长的路径前缀
+func (r *httpRouter) lookup(host, path string) *PortProxy {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = normalizeHostname(host)
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	var best *PortProxy
+	for _, p := range r.routes {
+		if p.Hostname != "" && p.Hostname != host || !matchPrefix(path, p.PathPrefix) {
+			continue
+		}
+		if best == nil || betterRoute(p, best) {
+			best = p
+		}
+	}
+	return best
+}
+
+func betterRoute(p, best *PortProxy) bool {
+	if (p.Hostname != "") != (best.Hostname != "") {
+		return p.Hostname != ""
+	}
+	return len(p.PathPrefix) > len(best.PathPrefix)
+}
+
+// matchPrefix 按路径段匹配, /api匹配/api和/api/users, 不匹配/apix
+func matchPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// HTTP请求体的解析状态
+const (
+	stHeader    = iota // 读取请求头
+	stBody             // 按Content-Length转发请求体
+	stChunkSize        // chunked编码的长度行
+	stChunkData        // chunk的数据和结尾的CRLF
+	stTrailer          // 最后一个chunk之后的trailer
+	stUpgrade          // 已经转发Upgrade或CONNECT请求, 等待后端的响应行, 之后的数据先留下
+	stRaw              // 后端接受了Upgrade之后不再解析
+	stDiscard          // 之后的请求不能转发, 丢弃
+)
+
+// httpStream 解析客户端发往后端的请求, 在每个请求头中加入X-Forwarded-For。
+// 同一个连接上的请求都转发给第一个请求选中的服务, 后面的请求属于其他服务时停止转发,
+// 之前的响应结束后关闭连接, 客户端会重新建立连接
+type httpStream struct {
+	router *httpRouter
+	proxy  *PortProxy // 第一个请求选中的服务
+	peerIP string     // 直接连到代理的地址, 追加到X-Forwarded-For
+	client net.IP     // 经过其他代理时按utils.GetIP取出的客户端IP, 按来源选择后端时使用
+	state   int
+	remain  int64  // stBody/stChunkData剩余的字节数
+	line    []byte // 还没有读完的请求头或者chunk长度行, stUpgrade时是留下的客户端数据
+	connect bool   // 等待的是CONNECT的响应, 2xx表示接受
+	resp    []byte // stUpgrade时还没有读完的响应行
+}
+
+func newHTTPStream(router *httpRouter) *httpStream {
+	return &httpStream{router: router}
+}
+
+// newHTTPProxyC HTTP端口上的客户端连接, 读到第一个请求头之后才知道转发到哪个服务
+func newHTTPProxyC(c *epio.Connector, router *httpRouter) *ProxyC {
+	pc := newProxyPair(c)
+	pc.http = newHTTPStream(router)
+	return pc
+}
+
+// feed 解析data, 返回要发往后端的数据。出错时out中是出错之前可以转发的部分
+func (h *httpStream) feed(data []byte) (out []byte, err error) {
+	for len(data) > 0 {
+		switch h.state {
+		case stHeader:
+			h.line = append(h.line, data...)
+			h.line = bytes.TrimLeft(h.line, "\r\n") // 请求之间多余的空行
+			data = nil
+			end := headerEnd(h.line)
+			if end < 0 {
+				if len(h.line) > maxHTTPHeader {
+					return out, errHeaderTooLarge
+				}
+				return out, nil
+			}
+			header, rest := h.line[:end], h.line[end:]
+			h.line = nil
+			if out, err = h.onHeader(header, out); err != nil {
+				return out, err
+			}
+			data = rest
+		case stBody, stChunkData:
+			n := int64(len(data))
+			if n > h.remain {
+				n = h.remain
+			}
+			out = append(out, data[:n]...)
+			data = data[n:]
+			if h.remain -= n; h.remain == 0 {
+				if h.state == stBody {
+					h.state = stHeader
+				} else {
+					h.state = stChunkSize
+				}
+			}
+		case stChunkSize, stTrailer:
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				h.line = append(h.line, data...)
+				out = append(out, data...)
+				if len(h.line) > maxHTTPHeader {
+					return out, errBadChunk
+				}
+				return out, nil
+			}
+			line := append(h.line, data[:i]...)
+			h.line = nil
+			out = append(out, data[:i+1]...)
+			data = data[i+1:]
+			if err = h.onLine(bytes.TrimRight(line, "\r")); err != nil {
+				return out, err
+			}
+		case stUpgrade:
+			h.line = append(h.line, data...)
+			if len(h.line) > maxHTTPHeader {
+				return out, errUpgradeData
+			}
+			return out, nil
+		case stRaw:
+			return append(out, data...), nil
+		case stDiscard:
+			return out, nil
+		}
+	}
+	return out, nil
+}
+
+// onLine chunk长度行或者trailer中的一行
+func (h *httpStream) onLine(line []byte) error {
+	if h.state == stTrailer {
+		if len(line) == 0 {
+			h.state = stHeader
+		}
+		return nil
+	}
+	if i := bytes.IndexByte(line, ';'); i >= 0 { // chunk-ext
+		line = line[:i]
+	}
+	size, err := strconv.ParseInt(string(bytes.TrimSpace(line)), 16, 64)
+	if err != nil || size < 0 {
+		return errBadChunk
+	}
+	if size == 0 {
+		h.state = stTrailer
+	} else {
+		h.state, h.remain = stChunkData, size+2 // 数据后面的CRLF
+	}
+	return nil
+}
+
+// onHeader 选择服务, 按请求体的长度设置下一个状态, 把改写之后的请求头加到out中
+func (h *httpStream) onHeader(header, out []byte) ([]byte, error) {
+	if err := checkFraming(header); err != nil {
+		return out, err
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil {
+		return out, err
+	}
+	proxy := h.router.lookup(req.Host, req.URL.Path)
+	if h.proxy == nil {
+		if proxy == nil {
+			return out, fmt.Errorf("%w for %s", errHTTPNoService, req.Host+req.URL.Path)
+		}
+		h.proxy = proxy
+		req.RemoteAddr = h.peerIP + ":0"
+		if ip, err := utils.GetIP(req); err == nil {
+			h.client = net.ParseIP(ip)
+		}
+	} else if proxy != h.proxy {
+		h.state = stDiscard
+		return out, errRouteChanged
+	}
+	switch {
+	case req.Method == http.MethodConnect || req.Header.Get("Upgrade") != "":
+		// 后端不一定接受, 之后的数据可能仍然是请求, 看到响应之前不能当作原始的流转发
+		h.state, h.connect = stUpgrade, req.Method == http.MethodConnect
+	case len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked":
+		h.state = stChunkSize
+	case req.ContentLength > 0:
+		h.state, h.remain = stBody, req.ContentLength
+	default:
+		h.state = stHeader
+	}
+	return appendForwarded(out, header, h.peerIP), nil
+}
+
+// onResponse 后端的响应数据, 调用者持有锁。等待Upgrade的响应时读到完整的响应行之后done为true,
+// ok表示后端接受了, held是期间留下的客户端数据
+func (h *httpStream) onResponse(data []byte) (held []byte, done, ok bool) {
+	if h.state != stUpgrade {
+		return nil, false, false
+	}
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		h.resp = append(h.resp, data...)
+		return nil, len(h.resp) > maxHTTPHeader, false
+	}
+	line := bytes.TrimRight(append(h.resp, data[:i]...), "\r")
+	h.resp = nil
+	if !h.accepted(line) {
+		return nil, true, false
+	}
+	held, h.line = h.line, nil
+	h.state = stRaw
+	return held, true, true
+}
+
+// accepted Upgrade的响应是101, CONNECT的响应是2xx。
+// 之前流水线请求的响应还没结束时读到的不是101, 连接在响应之后关闭
+func (h *httpStream) accepted(line []byte) bool {
+	fields := bytes.Fields(line)
+	if len(fields) < 2 || !bytes.HasPrefix(fields[0], []byte("HTTP/")) {
+		return false
+	}
+	code, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return false
+	}
+	if h.connect {
+		return code >= 200 && code < 300
+	}
+	return code == http.StatusSwitchingProtocols
+}
+
+// checkFraming 请求头原样转发给后端, 后端和这里对请求体长度的理解必须一致, 否则后端会把请求体
+// 当成下一个请求(request smuggling)。有折行、名字和冒号之间有空白、同时有Content-Length和
+// Transfer-Encoding、重复的Content-Length或Transfer-Encoding、Transfer-Encoding不是chunked时拒绝
+func checkFraming(header []byte) error {
+	var te, cl int
+	lines := bytes.Split(bytes.TrimRight(header, "\r\n"), []byte("\n"))
+	for _, line := range lines[1:] {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			return errBadFraming
+		}
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || len(bytes.TrimRight(name, " \t")) != len(name) {
+			return errBadFraming
+		}
+		value = bytes.TrimSpace(value)
+		switch {
+		case strings.EqualFold(string(name), "Transfer-Encoding"):
+			if te++; !strings.EqualFold(string(value), "chunked") {
+				return errBadFraming
+			}
+		case strings.EqualFold(string(name), "Content-Length"):
+			if _, err := strconv.ParseUint(string(value), 10, 63); err != nil {
+				return errBadFraming
+			}
+			cl++
+		}
+	}
+	if te+cl > 1 { // 重复的或者两个同时出现
+		return errBadFraming
+	}
+	return nil
+}
+
+// headerEnd 返回请求头之后第一个字节的位置, 请求头还不完整时返回-1
+func headerEnd(b []byte) int {
+	if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+		return i + 4
+	}
+	if i := bytes.Index(b, []byte("\n\n")); i >= 0 {
+		return i + 2
+	}
+	return -1
+}
+
+// appendForwarded 原样复制请求头, 已有的X-Forwarded-For合并成一行并在最后追加ip
+func appendForwarded(out, header []byte, ip string) []byte {
+	var forwarded []string
+	lines := bytes.Split(bytes.TrimRight(header, "\r\n"), []byte("\n"))
+	for i, line := range lines {
+		line = bytes.TrimRight(line, "\r")
+		if i > 0 {
+			if name, value, ok := bytes.Cut(line, []byte(":")); ok &&
+				strings.EqualFold(string(bytes.TrimSpace(name)), "X-Forwarded-For") {
+				forwarded = append(forwarded, string(bytes.TrimSpace(value)))
+				continue
+			}
+		}
+		out = append(out, line...)
+		out = append(out, "\r\n"...)
+	}
+	forwarded = append(forwarded, ip)
+	out = append(out, "X-Forwarded-For: "+strings.Join(forwarded, ", ")+"\r\n\r\n"...)
+	return out
+}
+
+// relayHTTP 读取客户端的请求, 第一个请求头完整之后选择服务并连接后端
+func (p *ProxyC) relayHTTP(fd int, buf []byte, now int64) bool {
+	routed := !p.routing()
+	if routed {
+		p.touch(now)
+	} else if p.http.peerIP == "" {
+		p.http.peerIP = clientIP(epio.RemoteAddr(fd)).String()
+	}
+	for {
+		n, err := epio.Read(fd, buf)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				break
+			}
+			fmt.Println("read: ", err.Error())
+			return false
+		}
+		if n == 0 {
+			if !routed {
+				return p.rejectHTTP(fd, 0, "closed before request")
+			}
+			return p.onEOF()
+		}
+		p.mtx.Lock() // 后端的响应在另一个evPoll中修改stUpgrade
+		out, err := p.http.feed(buf[:n])
+		p.mtx.Unlock()
+		if !routed {
+			if p.http.proxy == nil {
+				if err == nil {
+					continue
+				}
+				status := http.StatusBadRequest
+				if err == errHeaderTooLarge {
+					status = http.StatusRequestHeaderFieldsTooLarge
+				} else if errors.Is(err, errHTTPNoService) {
+					status = http.StatusNotFound
+				}
+				return p.rejectHTTP(fd, status, err.Error())
+			}
+			p.client = p.http.client
+			if !p.routeTo(fd, p.http.proxy, now, out) {
+				return false
+			}
+			if err != nil {
+				return p.stopRequests(err)
+			}
+			return true
+		}
+		if len(out) > 0 {
+			paused, err := p.peer.send(out)
+			if err != nil {
+				fmt.Println("write: ", err.Error())
+				return false
+			}
+			if paused {
+				break
+			}
+		}
+		if err != nil && !p.stopRequests(err) {
+			return false
+		}
+	}
+	return true
+}
+
+// relayResponse 把后端的响应转发给客户端。等待Upgrade的响应时, 后端接受之后把留下的客户端数据发往后端,
+// 两个方向都不再解析; 不接受时不再转发之后的请求, 响应结束后关闭连接
+func (p *ProxyS) relayResponse(fd int, buf []byte) bool {
+	for {
+		n, err := epio.Read(fd, buf)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				break
+			}
+			fmt.Println("read: ", err.Error())
+			return false
+		}
+		if n == 0 {
+			return p.onEOF()
+		}
+		p.mtx.Lock()
+		held, done, ok := p.buddy.http.onResponse(buf[:n])
+		if ok && len(held) > 0 {
+			_, err = p.sendLocked(held)
+		}
+		p.mtx.Unlock()
+		if err != nil {
+			fmt.Println("write: ", err.Error())
+			return false
+		}
+		paused, err := p.peer.send(buf[:n])
+		if err != nil {
+			fmt.Println("write: ", err.Error())
+			return false
+		}
+		if done && !ok && !p.buddy.stopRequests(errUpgradeRefused) {
+			return false
+		}
+		if paused {
+			break
+		}
+	}
+	return true
+}
+
+// rejectHTTP 没有选出服务时直接回复错误并关闭连接, status为0时不回复
+func (p *ProxyC) rejectHTTP(fd int, status int, reason string) bool {
+	fmt.Println("ProxyC: http " + reason)
+	p.cancelHelloTimer()
+	if status != 0 {
+		text := strconv.Itoa(status) + " " + http.StatusText(status)
+		epio.Write(fd, []byte("HTTP/1.1 "+text+"\r\nContent-Type: text/plain\r\nContent-Length: "+
+			strconv.Itoa(len(text)+1)+"\r\nConnection: close\r\n\r\n"+text+"\n"))
+	}
+	p.sess.reason = closeByHTTP
+	return false
+}
+
+// stopRequests 不再转发之后的请求, 关闭后端的写方向。
+// 继续读取并丢弃客户端的数据, 后端的响应写完之后两个方向都结束, 代理对关闭
+func (p *ProxyC) stopRequests(err error) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.http.state != stDiscard {
+		fmt.Println("ProxyC: http " + err.Error())
+		p.http.state, p.http.line = stDiscard, nil
+	}
+	ps := &p.buddy.endpoint
+	if ps.eof {
+		return true
+	}
+	ps.eof = true
+	if ps.GetFd() != -1 && ps.pending() == 0 && ps.shutdownWrite() {
+		return false
+	}
+	if p.linger > 0 && p.lingerTimer == nil {
+		p.lingerTimer, _ = p.GetReactor().ScheduleTimer(p, p.linger, 0)
+	}
+	return true
+}
+
+// httpListen 把服务加入HTTP端口的路由, 第一个服务开始侦听HTTP端口
+func (p *ProxyServer) httpListen(proxy *PortProxy, done <-chan struct{}) string {
+	addr := p.httpAddr
+	p.http.mtx.Lock()
+	if p.http.acceptor == nil {
+		acceptor, err := epio.NewAcceptor(p.forAccept, p.forNewFd,
+			func() epio.EvHandler { return newHTTPProxyC(p.connector, p.http) },
+			addr,
+			epio.ListenBacklog(256),
+			epio.SockRcvBufSize(8*1024))
+		if err != nil {
+			p.http.mtx.Unlock()
+			log.Printf("侦听HTTP端口失败: %v\n", err)
+			return ""
+		}
+		p.http.acceptor = acceptor
+		log.Printf("正在侦听HTTP: %s\n", addr)
+	}
+	added := p.http.addLocked(proxy)
+	p.http.mtx.Unlock()
+	if !added {
+		log.Printf("%s%s 已经被其他服务使用\n", proxy.Hostname, proxy.PathPrefix)
+		return ""
+	}
+	hc := p.startHealthCheck(proxy)
+	go func() {
+		<-done
+		p.http.remove(proxy)
+		if hc != nil {
+			hc.stop()
+		}
+		fmt.Println("http route " + proxy.Hostname + proxy.PathPrefix + " removed")
+	}()
+	return addr
+}
@@ -0,0 +1,351 @@
+package gproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	epio "g-proxy/epio"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPStream(t *testing.T) {
+	router := newHTTPRouter()
+	a := &PortProxy{PathPrefix: "/a"}
+	b := &PortProxy{PathPrefix: "/b"}
+	router.add(a)
+	router.add(b)
+
+	t.Run("流水线请求和请求体", func(t *testing.T) {
+		h := newHTTPStream(router)
+		h.peerIP = "10.0.0.9"
+		in := "POST /a/x HTTP/1.1\r\nHost: h\r\nX-Forwarded-For: 3.3.3.3\r\nContent-Length: 5\r\n\r\nhello" +
+			"POST /a/y HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\n\r\n3;ext\r\nabc\r\n0\r\nT: v\r\n\r\n" +
+			"GET /a HTTP/1.1\r\nHost: h\r\nX-Forwarded-For: 1.1.1.1\r\nx-forwarded-for: 2.2.2.2\r\n\r\n"
+		want := "POST /a/x HTTP/1.1\r\nHost: h\r\nContent-Length: 5\r\nX-Forwarded-For: 3.3.3.3, 10.0.0.9\r\n\r\nhello" +
+			"POST /a/y HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\nX-Forwarded-For: 10.0.0.9\r\n\r\n3;ext\r\nabc\r\n0\r\nT: v\r\n\r\n" +
+			"GET /a HTTP/1.1\r\nHost: h\r\nX-Forwarded-For: 1.1.1.1, 2.2.2.2, 10.0.0.9\r\n\r\n"
+		// 逐字节输入, 请求头和chunk长度行都可能被拆开
+		var out []byte
+		for i := 0; i < len(in); i++ {
+			o, err := h.feed([]byte{in[i]})
+			assert.Nil(t, err)
+			out = append(out, o...)
+		}
+		assert.Equal(t, want, string(out))
+		assert.Equal(t, a, h.proxy)
+		assert.Equal(t, "3.3.3.3", h.client.String(), "经过其他代理时按第一个请求取最初的客户端")
+	})
+
+	t.Run("后面的请求属于其他服务", func(t *testing.T) {
+		h := newHTTPStream(router)
+		h.peerIP = "10.0.0.9"
+		out, err := h.feed([]byte("GET /a HTTP/1.1\r\nHost: h\r\n\r\nGET /b HTTP/1.1\r\nHost: h\r\n\r\n"))
+		assert.Equal(t, errRouteChanged, err)
+		assert.Equal(t, "GET /a HTTP/1.1\r\nHost: h\r\nX-Forwarded-For: 10.0.0.9\r\n\r\n", string(out))
+		out, err = h.feed([]byte("GET /a HTTP/1.1\r\n\r\n"))
+		assert.Nil(t, err)
+		assert.Empty(t, out)
+	})
+
+	t.Run("没有匹配的服务", func(t *testing.T) {
+		h := newHTTPStream(router)
+		_, err := h.feed([]byte("GET /c HTTP/1.1\r\nHost: h\r\n\r\n"))
+		assert.ErrorIs(t, err, errHTTPNoService)
+		assert.Nil(t, h.proxy)
+	})
+
+	t.Run("请求体长度有歧义", func(t *testing.T) {
+		for _, header := range []string{
+			"Content-Length: 5\r\nTransfer-Encoding: chunked\r\n",
+			"Transfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n",
+			"Transfer-Encoding: gzip, chunked\r\n",
+			"Transfer-Encoding : chunked\r\n",
+			"X: y\r\n Transfer-Encoding: chunked\r\n",
+			"Content-Length: 5\r\nContent-Length: 5\r\n",
+			"Content-Length: +5\r\n",
+		} {
+			h := newHTTPStream(router)
+			out, err := h.feed([]byte("POST /a HTTP/1.1\r\nHost: h\r\n" + header + "\r\n"))
+			assert.Equal(t, errBadFraming, err, header)
+			assert.Empty(t, out)
+		}
+	})
+
+	t.Run("Upgrade等待后端的响应", func(t *testing.T) {
+		upgrade := "GET /a HTTP/1.1\r\nHost: h\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+		smuggled := "GET /b HTTP/1.1\r\nHost: h\r\n\r\n"
+		for _, c := range []struct {
+			name string
+			resp string
+			ok   bool
+		}{
+			{"接受", "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n", true},
+			{"不接受", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", false},
+		} {
+			h := newHTTPStream(router)
+			h.peerIP = "10.0.0.9"
+			out, err := h.feed([]byte(upgrade + smuggled))
+			assert.Nil(t, err, c.name)
+			assert.NotContains(t, string(out), "/b", "看到响应之前不转发之后的数据")
+			// 响应行被拆开
+			_, done, _ := h.onResponse([]byte(c.resp[:5]))
+			assert.False(t, done, c.name)
+			held, done, ok := h.onResponse([]byte(c.resp[5:]))
+			assert.True(t, done, c.name)
+			assert.Equal(t, c.ok, ok, c.name)
+			if c.ok {
+				assert.Equal(t, smuggled, string(held), "接受之后原样转发")
+				out, err = h.feed([]byte("raw"))
+				assert.Nil(t, err)
+				assert.Equal(t, "raw", string(out))
+			} else {
+				assert.Empty(t, held)
+			}
+		}
+	})
+
+	t.Run("请求头太大", func(t *testing.T) {
+		h := newHTTPStream(router)
+		_, err := h.feed([]byte("GET /a HTTP/1.1\r\nX: " + strings.Repeat("x", maxHTTPHeader)))
+		assert.Equal(t, errHeaderTooLarge, err)
+	})
+}
+
+func TestHTTPRouterLookup(t *testing.T) {
+	router := newHTTPRouter()
+	any := &PortProxy{PathPrefix: "/"}
+	api := &PortProxy{PathPrefix: "/api"}
+	host := &PortProxy{Hostname: "svc.test"}
+	hostAPI := &PortProxy{Hostname: "svc.test", PathPrefix: "/api/"}
+	for _, p := range []*PortProxy{any, api, host, hostAPI} {
+		assert.True(t, router.add(p))
+	}
+	assert.False(t, router.add(&PortProxy{PathPrefix: "/api"}))
+
+	assert.Equal(t, any, router.lookup("other", "/"))
+	assert.Equal(t, api, router.lookup("other:8080", "/api/users"))
+	assert.Equal(t, any, router.lookup("other", "/apix"))
+	assert.Equal(t, host, router.lookup("SVC.test:8080", "/index.html"))
+	assert.Equal(t, hostAPI, router.lookup("svc.test", "/api"))
+
+	router.remove(any)
+	assert.Nil(t, router.lookup("other", "/"))
+}
+
+// namedHTTPServer 返回服务名和收到的X-Forwarded-For
+func namedHTTPServer(t *testing.T, name string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte(name + " " + r.Header.Get("X-Forwarded-For")))
+	})}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// upgradeServer 回复101之后回显
+func upgradeServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if _, err := http.ReadRequest(r); err != nil {
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+				io.Copy(conn, r)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestHTTPRelay(t *testing.T) {
+	forAccept, forNewFd, connector := startReactors(t)
+	router := newHTTPRouter()
+	_, err := epio.NewAcceptor(forAccept, forNewFd,
+		func() epio.EvHandler { return newHTTPProxyC(connector, router) }, "127.0.0.1:33517")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range []string{"a", "b"} {
+		server, _ := net.ResolveTCPAddr("tcp", namedHTTPServer(t, name))
+		proxy := &PortProxy{Server: server, PathPrefix: "/" + name}
+		proxy.resetBalancer()
+		router.add(proxy)
+	}
+	ws, _ := net.ResolveTCPAddr("tcp", upgradeServer(t))
+	wsProxy := &PortProxy{Server: ws, PathPrefix: "/ws"}
+	wsProxy.resetBalancer()
+	router.add(wsProxy)
+
+	get := func(client *http.Client, path string) (int, string) {
+		resp, err := client.Get("http://127.0.0.1:33517" + path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("按路径选择服务并保持连接", func(t *testing.T) {
+		client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{}}
+		for _, path := range []string{"/a", "/a/1", "/b", "/b/2", "/a"} {
+			code, body := get(client, path)
+			assert.Equal(t, http.StatusOK, code)
+			assert.Equal(t, path[1:2]+" 127.0.0.1", body)
+		}
+	})
+
+	t.Run("同一个连接上的流水线请求", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:33517", 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET /a HTTP/1.1\r\nHost: x\r\nX-Forwarded-For: 1.2.3.4\r\n\r\n" +
+			"POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		for _, want := range []string{"a 1.2.3.4, 127.0.0.1", "a 127.0.0.1"} {
+			resp, err := http.ReadResponse(r, nil)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, want, string(body))
+		}
+	})
+
+	t.Run("后端接受Upgrade之后原样转发", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:33517", 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: h\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nGET /a HTTP/1.1\r\n\r\n"))
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		line, _ := r.ReadString('\n')
+		assert.Equal(t, "GET /a HTTP/1.1\r\n", line, "升级之前发送的数据也转发给了后端")
+	})
+
+	t.Run("后端不接受Upgrade时不转发之后的请求", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:33517", 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("GET /a HTTP/1.1\r\nHost: h\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n" +
+			"GET /b HTTP/1.1\r\nHost: h\r\n\r\n"))
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "a 127.0.0.1", string(body))
+		rest, err := io.ReadAll(r)
+		assert.Nil(t, err, "响应之后关闭连接")
+		assert.Empty(t, string(rest), "没有转发到b")
+	})
+
+	t.Run("没有匹配的服务", func(t *testing.T) {
+		client := &http.Client{Timeout: 5 * time.Second}
+		code, _ := get(client, "/c")
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("请求体长度有歧义", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:33517", 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("POST /a HTTP/1.1\r\nHost: h\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestSharedListener(t *testing.T) {
+	p := NewProxyServer(DataFile(""), SNIAddr("127.0.0.1:33514"), HTTPAddr("127.0.0.1:33515"))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		p.Stop(ctx)
+	})
+	backend, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:1")
+	listening := func(addr string) bool {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	for _, c := range []struct {
+		name   string
+		listen func(proxy *PortProxy, done <-chan struct{}) string
+		addr   string
+	}{
+		{"sni", p.sniListen, "127.0.0.1:33514"},
+		{"http", p.httpListen, "127.0.0.1:33515"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			a, b := NewPortProxy(backend), NewPortProxy(backend)
+			a.Hostname, b.Hostname = "a.example.com", "b.example.com"
+			doneA, doneB := make(chan struct{}), make(chan struct{})
+			assert.Equal(t, c.addr, c.listen(a, doneA), "使用设置的地址")
+			assert.Equal(t, c.addr, c.listen(b, doneB))
+			assert.True(t, listening(c.addr))
+
+			close(doneA)
+			time.Sleep(100 * time.Millisecond)
+			assert.True(t, listening(c.addr), "还有服务时不关闭")
+
+			close(doneB)
+			assert.Eventually(t, func() bool { return !listening(c.addr) }, 2*time.Second, 20*time.Millisecond,
+				"最后一个服务删除之后关闭")
+
+			done := make(chan struct{})
+			defer close(done)
+			assert.Equal(t, c.addr, c.listen(a, done), "可以重新侦听")
+			assert.True(t, listening(c.addr))
+		})
+	}
+}
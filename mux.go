@@ -0,0 +1,751 @@
+package gproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	epio "g-proxy/epio"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 多路复用: 两个gProxy之间共用一条长连接转发多个客户端连接, 减少握手和防火墙上的连接状态。
+// 发起方为每个客户端连接打开一个流, 对端按流中的服务名像普通的客户端连接一样转发。
+// 流的两端各通过一对socketpair接到ProxyC/ProxyS上, 服务的转发方式、超时、PROXY协议等配置都不变
+//
+// 帧格式: type(1) | stream id(4) | length(4) | payload, 整数都是大端
+const (
+	muxOpen    = 1 // 打开流, payload是"服务名 客户端地址"; 对端接受时回复空payload的muxOpen
+	muxData    = 2
+	muxWindow  = 3 // payload是4字节的窗口增量, 接收方把数据写出去之后通知发送方
+	muxFin     = 4 // 这个方向的数据结束, 对应半关闭
+	muxReset   = 5 // 关闭流
+	muxPing    = 6 // 发起方定期发送, 对端回复muxPong
+	muxPong    = 7
+	muxService = 8 // 反向隧道的agent注册服务, payload是"服务名 地址"; 跳板机回复"OK 服务名"或"ERR 服务名 原因"
+)
+
+const (
+	muxHeaderLen  = 9
+	muxWindowSize = 256 * 1024 // 每个流每个方向的窗口, 对端最多缓存这么多没写出去的数据
+	maxMuxPayload = 64 * 1024
+	muxTick       = 1000 // 检查心跳和等待接受的流的间隔毫秒数
+	muxKeepalive  = 15 * time.Second
+	muxTimeout    = 45 * time.Second // 连接上这么久没有读到数据时关闭
+)
+
+var errMuxClosed = errors.New("mux link closed")
+
+// muxPool 发起方到每个对端地址的长连接
+type muxPool struct {
+	mtx      sync.Mutex
+	c        *epio.Connector
+	key      []byte // 和对端的预共享密钥, nil时不加密
+	sessions map[string]*muxSession
+}
+
+func newMuxPool(c *epio.Connector) *muxPool {
+	return &muxPool{c: c, sessions: make(map[string]*muxSession)}
+}
+
+// open 在到addr的长连接上打开一个流, 连接不存在时先建立连接。
+// 和Connector.Connect一样, 返回nil之后对端接受时调用eh.OnOpen, 否则调用eh.OnConnectFail
+func (p *muxPool) open(addr, name, remote string, eh epio.EvHandler, timeout int64) error {
+	if p == nil {
+		return errMuxClosed
+	}
+	p.mtx.Lock()
+	s := p.sessions[addr]
+	created := s == nil
+	if created {
+		s = newMuxSession(p.c.GetReactor(), addr, p.key, true)
+		s.pool = p
+		p.sessions[addr] = s
+	}
+	p.mtx.Unlock()
+	if err := s.openStream(name, remote, eh, timeout); err != nil {
+		return err
+	}
+	if created {
+		if err := p.c.Connect(addr, s, connectTimeout); err != nil {
+			s.OnConnectFail(err)
+		}
+	}
+	return nil
+}
+
+// setKey 之后新建立的长连接使用这个密钥
+func (p *muxPool) setKey(key []byte) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.key = key
+}
+
+func (p *muxPool) remove(s *muxSession) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.sessions[s.addr] == s {
+		delete(p.sessions, s.addr)
+	}
+}
+
+// muxSession 一条长连接, 发起方和对端共用。
+// 一般由发起方建立连接并打开流; 反向隧道中agent建立连接, 跳板机打开流, agent按服务名接受
+type muxSession struct {
+	epio.Event
+	r          *epio.Reactor                // 流的socketpair注册在这里
+	addr       string                       // 对端的地址
+	client     bool                         // 主动建立连接的一方, 发起握手和心跳
+	pool       *muxPool                     // 发起方所在的连接池, 对端为nil
+	resolve    func(name string) *PortProxy // 接受流的一方按服务名查找服务, 为nil时只打开流
+	c          *epio.Connector              // 接受流的一方连接服务的后端
+	key        []byte                       // 预共享密钥, nil时不加密
+	in         []byte                       // 没有读完的帧或者记录, 只在evPoll中使用
+	plain      []byte                       // 解密之后没有读完的帧
+	hs         *muxHandshake                // 握手完成之前不为nil
+	rx         *muxCipher
+	lastActive atomic.Int64
+	lastPing   int64
+	openedAt   int64
+	timer      *epio.Timer
+
+	onControl func(s *muxSession, payload []byte) // 反向隧道中处理muxService, 为nil时不接受muxService
+	onClose   func(s *muxSession, err error)      // 连接断开之后调用
+	err       error                               // 握手失败的原因, 只在evPoll中使用
+
+	mtx     sync.Mutex // 保护下面的字段和所有流的状态, 流的fd可能在其他evPoll中
+	streams map[uint32]*muxStream
+	nextID  uint32
+	out     []byte // 待写到连接上的数据, 加密时是记录
+	pend    []byte // 握手完成之前的帧
+	tx      *muxCipher
+	writing bool
+	open    bool // 连接已经建立并且完成了握手, 帧可以直接写出去
+	closed  bool
+}
+
+func newMuxSession(r *epio.Reactor, addr string, key []byte, client bool) *muxSession {
+	s := &muxSession{r: r, addr: addr, key: key, client: client, streams: make(map[uint32]*muxStream)}
+	s.SetFd(-1)
+	return s
+}
+
+// openStream 发起方为一个客户端连接打开流, 对端接受之前socketpair的另一端留给eh
+func (s *muxSession) openStream(name, remote string, eh epio.EvHandler, timeout int64) error {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		epio.Close(fds[0])
+		epio.Close(fds[1])
+		return errMuxClosed
+	}
+	s.nextID++
+	st := newMuxStream(s, s.nextID)
+	st.eh, st.ehFd = eh, fds[1]
+	st.deadline = time.Now().UnixMilli() + timeout
+	s.streams[st.id] = st
+	s.queueLocked(muxOpen, st.id, []byte(name+" "+remote))
+	s.mtx.Unlock()
+	s.r.Attach(st, fds[0])
+	return nil
+}
+
+// acceptLocked 对端收到muxOpen, 像新的客户端连接一样转发到服务, 返回锁外要执行的操作
+func (s *muxSession) acceptLocked(id uint32, payload []byte) func() {
+	name, remote, _ := strings.Cut(string(payload), " ")
+	proxy := s.resolve(name)
+	if proxy == nil || s.streams[id] != nil {
+		fmt.Println("mux: no service " + name)
+		s.queueLocked(muxReset, id, nil)
+		return nil
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		s.queueLocked(muxReset, id, nil)
+		return nil
+	}
+	st := newMuxStream(s, id)
+	s.streams[id] = st
+	s.queueLocked(muxOpen, id, nil)
+	local := epio.LocalAddr(s.GetFd())
+	return func() {
+		s.r.Attach(st, fds[0])
+		pc := NewProxyC(s.c, proxy)
+		pc.remote, pc.local = remote, local // 日志和PROXY协议中是发起方的客户端地址
+		s.r.Attach(pc, fds[1])
+	}
+}
+
+// queue 在其他goroutine中追加一个帧
+func (s *muxSession) queue(typ byte, id uint32, payload []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.queueLocked(typ, id, payload)
+}
+
+// queueLocked 追加一个帧, 握手完成之后尽量直接写出去
+func (s *muxSession) queueLocked(typ byte, id uint32, payload []byte) {
+	if s.closed {
+		return
+	}
+	var hdr [muxHeaderLen]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:5], id)
+	binary.BigEndian.PutUint32(hdr[5:9], uint32(len(payload)))
+	switch {
+	case !s.open:
+		s.pend = append(append(s.pend, hdr[:]...), payload...)
+		return
+	case s.tx != nil:
+		s.out = s.tx.seal(s.out, append(hdr[:], payload...))
+	default:
+		s.out = append(append(s.out, hdr[:]...), payload...)
+	}
+	if !s.writing {
+		s.flushLocked()
+	}
+}
+
+// readyLocked 连接建立并且完成握手, 写出之前的帧
+func (s *muxSession) readyLocked() {
+	s.open = true
+	if s.tx != nil {
+		s.out = s.tx.seal(s.out, s.pend)
+	} else {
+		s.out = append(s.out, s.pend...)
+	}
+	s.pend = nil
+	if len(s.out) > 0 && !s.writing {
+		s.flushLocked()
+	}
+}
+
+// flushLocked 写出去的错误由evPoll在fd上报告
+func (s *muxSession) flushLocked() {
+	fd := s.GetFd()
+	n, err := epio.Write(fd, s.out)
+	if err != nil && err != syscall.EAGAIN {
+		return
+	}
+	if n > 0 {
+		s.out = s.out[n:]
+	}
+	writing := len(s.out) > 0
+	if !writing {
+		s.out = nil
+	}
+	if writing != s.writing {
+		s.writing = writing
+		ev := epio.EvIn
+		if writing {
+			ev |= syscall.EPOLLOUT
+		}
+		s.GetReactor().ModifyEvHandler(s, fd, ev)
+	}
+}
+
+func (s *muxSession) OnOpen(fd int, now int64) bool {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		return false
+	}
+	if err := s.GetReactor().AddEvHandler(s, fd, epio.EvIn); err != nil {
+		s.mtx.Unlock()
+		return false
+	}
+	s.SetFd(fd)
+	if s.addr == "" {
+		s.addr = epio.RemoteAddr(fd)
+	}
+	if s.key == nil {
+		s.readyLocked()
+	} else {
+		hs, err := newMuxHandshake(s.key, s.client)
+		if err != nil {
+			s.mtx.Unlock()
+			return false
+		}
+		s.hs = hs
+		if hs.client {
+			s.out = hs.hello()
+			s.flushLocked()
+		}
+	}
+	s.mtx.Unlock()
+	s.lastActive.Store(now)
+	s.lastPing, s.openedAt = now, now
+	s.timer, _ = s.GetReactor().ScheduleTimer(s, muxTick, muxTick)
+	log.Printf("mux: link %s open\n", s.addr)
+	return true
+}
+
+func (s *muxSession) OnRead(fd int, evPollSharedBuff []byte, now int64) bool {
+	n, err := epio.Read(fd, evPollSharedBuff)
+	if err != nil {
+		return err == syscall.EAGAIN
+	}
+	if n == 0 {
+		return false
+	}
+	s.lastActive.Store(now)
+	s.in = append(s.in, evPollSharedBuff[:n]...)
+	if s.hs != nil && !s.handshake() {
+		return false
+	}
+	if s.hs != nil {
+		return true
+	}
+	buf := s.in
+	if s.rx != nil {
+		plain, used, err := s.rx.open(s.plain, s.in)
+		if err != nil {
+			fmt.Println("mux: " + s.addr + " " + err.Error())
+			return false
+		}
+		s.in = append(s.in[:0], s.in[used:]...)
+		s.plain, buf = plain, plain
+	}
+	for len(buf) >= muxHeaderLen {
+		size := binary.BigEndian.Uint32(buf[5:9])
+		if size > maxMuxPayload {
+			fmt.Println("mux: frame too large from " + s.addr)
+			return false
+		}
+		if len(buf) < muxHeaderLen+int(size) {
+			break
+		}
+		if !s.handle(buf[0], binary.BigEndian.Uint32(buf[1:5]), buf[muxHeaderLen:muxHeaderLen+size]) {
+			return false
+		}
+		buf = buf[muxHeaderLen+size:]
+	}
+	if s.rx != nil {
+		s.plain = append(s.plain[:0], buf...)
+	} else {
+		s.in = append(s.in[:0], buf...)
+	}
+	return true
+}
+
+// handshake 处理s.in中的握手消息, 认证失败时返回false关闭连接
+func (s *muxSession) handshake() bool {
+	reply, used, done, err := s.hs.feed(s.in)
+	if err != nil {
+		fmt.Println("mux: " + s.addr + " " + err.Error())
+		s.err = err
+		return false
+	}
+	s.in = append(s.in[:0], s.in[used:]...)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(reply) > 0 {
+		s.out = append(s.out, reply...)
+		if !s.writing {
+			s.flushLocked()
+		}
+	}
+	if done {
+		tx, rx, err := s.hs.keys()
+		if err != nil {
+			fmt.Println("mux: " + s.addr + " " + err.Error())
+			s.err = err
+			return false
+		}
+		s.hs, s.tx, s.rx = nil, tx, rx
+		s.readyLocked()
+	}
+	return true
+}
+
+// handle 处理一个帧, 返回false时关闭连接
+func (s *muxSession) handle(typ byte, id uint32, payload []byte) bool {
+	var after func()
+	s.mtx.Lock()
+	st := s.streams[id]
+	switch typ {
+	case muxOpen:
+		if s.resolve != nil {
+			after = s.acceptLocked(id, payload)
+		} else if st != nil && st.eh != nil { // 对端接受了流, 把另一端交给ProxyS
+			eh, fd := st.eh, st.ehFd
+			st.eh, st.ehFd = nil, -1
+			after = func() { s.r.Attach(eh, fd) }
+		}
+	case muxData:
+		if st != nil {
+			after = st.deliverLocked(payload)
+		}
+	case muxWindow:
+		if st != nil && len(payload) == 4 {
+			st.sendWin += int(binary.BigEndian.Uint32(payload))
+			if !st.reading && !st.eof && st.GetFd() != -1 {
+				st.reading = true
+				st.updateLocked()
+			}
+		}
+	case muxFin:
+		if st != nil {
+			st.finRecvd = true
+			st.flushLocked()
+		}
+	case muxReset:
+		if st != nil {
+			after = st.closeLocked(false, epio.ErrConnectFail)
+		}
+	case muxPing:
+		s.queueLocked(muxPong, 0, nil)
+	case muxPong:
+	case muxService:
+		if s.onControl == nil {
+			s.mtx.Unlock()
+			fmt.Println("mux: unexpected service frame from " + s.addr)
+			return false
+		}
+		after = func() { s.onControl(s, payload) }
+	default:
+		s.mtx.Unlock()
+		fmt.Println("mux: unknown frame from " + s.addr)
+		return false
+	}
+	s.mtx.Unlock()
+	if after != nil {
+		after()
+	}
+	return true
+}
+
+func (s *muxSession) OnWrite(fd int, now int64) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.flushLocked()
+	return true
+}
+
+// OnTimeout 发起方发送心跳, 关闭没有心跳的连接, 对端迟迟不接受的流按连接超时处理
+func (s *muxSession) OnTimeout(now int64) bool {
+	s.mtx.Lock()
+	handshaking := !s.open // hs只在evPoll中使用, 握手完成时在锁内设置open
+	s.mtx.Unlock()
+	if now-s.lastActive.Load() > muxTimeout.Milliseconds() ||
+		handshaking && now-s.openedAt > muxHandshakeTimeout.Milliseconds() {
+		fmt.Println("mux: link " + s.addr + " timeout")
+		s.close()
+		return false
+	}
+	var expired []func()
+	s.mtx.Lock()
+	if s.client && now-s.lastPing >= muxKeepalive.Milliseconds() {
+		s.lastPing = now
+		s.queueLocked(muxPing, 0, nil)
+	}
+	for _, st := range s.streams {
+		if st.eh != nil && st.deadline <= now {
+			if f := st.closeLocked(true, epio.ErrConnectTimeout); f != nil {
+				expired = append(expired, f)
+			}
+		}
+	}
+	s.mtx.Unlock()
+	for _, f := range expired {
+		f()
+	}
+	return true
+}
+
+// close 在其他goroutine中关闭已经建立的连接
+func (s *muxSession) close() {
+	s.GetReactor().Post(s, func() {
+		if fd := s.GetFd(); fd != -1 && s.GetReactor().RemoveEvHandler(s, fd) == nil {
+			s.OnClose(fd)
+		}
+	})
+}
+
+func (s *muxSession) OnClose(fd int) {
+	s.shutdown(fd, s.err)
+}
+
+// OnConnectFail 发起方连接对端失败, 等待中的流都失败
+func (s *muxSession) OnConnectFail(err error) {
+	fmt.Println("mux: " + s.addr + " " + err.Error())
+	s.shutdown(-1, err)
+}
+
+// shutdown 连接断开, 关闭所有的流, err是断开的原因
+func (s *muxSession) shutdown(fd int, err error) {
+	var failed []func()
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		return
+	}
+	for _, st := range s.streams {
+		if f := st.closeLocked(false, epio.ErrConnectFail); f != nil {
+			failed = append(failed, f)
+		}
+	}
+	s.closed, s.open = true, false
+	s.out, s.pend = nil, nil
+	s.mtx.Unlock()
+	if s.pool != nil {
+		s.pool.remove(s)
+	}
+	if s.timer != nil {
+		s.timer.Cancel()
+	}
+	if fd != -1 {
+		epio.Close(fd)
+		s.SetFd(-1)
+		log.Printf("mux: link %s closed\n", s.addr)
+	}
+	for _, f := range failed {
+		f()
+	}
+	if s.onClose != nil {
+		s.onClose(s, err)
+	}
+}
+
+// muxStream 长连接上的一个流, 本地的fd是接到ProxyC/ProxyS上的socketpair的一端。
+// 所有字段由muxSession.mtx保护
+type muxStream struct {
+	epio.Event
+	s        *muxSession
+	id       uint32
+	eh       epio.EvHandler // 发起方等待对端接受的ProxyS, 接受之后为nil
+	ehFd     int            // 接受之后交给eh的socketpair的另一端
+	deadline int64          // 对端接受的期限
+	out      []byte         // 对端发来还没写到fd的数据, 不超过窗口
+	sendWin  int            // 还可以发给对端的字节数
+	unacked  int            // 已经写到fd还没有通知对端的字节数
+	reading  bool
+	writing  bool
+	eof      bool // fd读到EOF, 已经发送muxFin
+	finRecvd bool // 收到muxFin, out写完之后关闭fd的写方向
+	wrShut   bool
+	closed   bool
+}
+
+func newMuxStream(s *muxSession, id uint32) *muxStream {
+	st := &muxStream{s: s, id: id, ehFd: -1, sendWin: muxWindowSize}
+	st.SetFd(-1)
+	return st
+}
+
+func (st *muxStream) OnOpen(fd int, now int64) bool {
+	st.s.mtx.Lock()
+	defer st.s.mtx.Unlock()
+	if st.closed {
+		return false
+	}
+	st.reading = true
+	if err := st.GetReactor().AddEvHandler(st, fd, epio.EvIn); err != nil {
+		return false
+	}
+	st.SetFd(fd)
+	st.flushLocked() // 注册之前收到的数据和muxFin
+	return true
+}
+
+// OnRead 读到的数据不超过对端的窗口, 窗口用完时暂停读取直到muxWindow
+func (st *muxStream) OnRead(fd int, evPollSharedBuff []byte, now int64) bool {
+	s := st.s
+	var after func()
+	s.mtx.Lock()
+	defer func() {
+		s.mtx.Unlock()
+		if after != nil {
+			after()
+		}
+	}()
+	if st.closed || !st.reading {
+		return true
+	}
+	if st.sendWin <= 0 {
+		st.reading = false
+		st.updateLocked()
+		return true
+	}
+	buf := evPollSharedBuff
+	if len(buf) > maxMuxPayload {
+		buf = buf[:maxMuxPayload]
+	}
+	if len(buf) > st.sendWin {
+		buf = buf[:st.sendWin]
+	}
+	n, err := epio.Read(fd, buf)
+	if err != nil {
+		if err != syscall.EAGAIN {
+			after = st.closeLocked(true, epio.ErrConnectFail)
+		}
+		return true
+	}
+	if n == 0 {
+		st.eof, st.reading = true, false
+		s.queueLocked(muxFin, st.id, nil)
+		st.updateLocked()
+		st.finishLocked()
+		return true
+	}
+	st.sendWin -= n
+	s.queueLocked(muxData, st.id, buf[:n])
+	return true
+}
+
+func (st *muxStream) OnWrite(fd int, now int64) bool {
+	st.s.mtx.Lock()
+	defer st.s.mtx.Unlock()
+	st.flushLocked()
+	return true
+}
+
+// OnClose ProxyC/ProxyS关闭了socketpair的另一端, 通知对端关闭流
+func (st *muxStream) OnClose(fd int) {
+	st.s.mtx.Lock()
+	if st.GetFd() == -1 { // OnOpen失败, fd还没有注册
+		epio.Close(fd)
+	}
+	after := st.closeLocked(true, epio.ErrConnectFail)
+	st.s.mtx.Unlock()
+	if after != nil {
+		after()
+	}
+}
+
+// deliverLocked 对端发来的数据, 超过窗口说明对端没有遵守流量控制, 关闭这个流。
+// 流还在等待对端接受时返回在锁外调用的函数, 同closeLocked
+func (st *muxStream) deliverLocked(data []byte) func() {
+	if st.closed || st.finRecvd {
+		return nil
+	}
+	if len(st.out)+len(data) > muxWindowSize {
+		fmt.Println("mux: stream window exceeded")
+		return st.closeLocked(true, epio.ErrConnectFail)
+	}
+	st.out = append(st.out, data...)
+	if !st.writing {
+		st.flushLocked()
+	}
+	return nil
+}
+
+// flushLocked 把对端的数据写到fd, 写出去一半窗口之后通知对端
+func (st *muxStream) flushLocked() {
+	fd := st.GetFd()
+	if st.closed || fd == -1 {
+		return
+	}
+	if len(st.out) > 0 {
+		n, err := epio.Write(fd, st.out)
+		if err != nil && err != syscall.EAGAIN {
+			st.closeLocked(true, nil) // 流已经接受, 不会有锁外的操作
+			return
+		}
+		if n > 0 {
+			st.out = st.out[n:]
+			st.unacked += n
+		}
+		if len(st.out) == 0 {
+			st.out = nil
+		}
+		if st.unacked >= muxWindowSize/2 {
+			var inc [4]byte
+			binary.BigEndian.PutUint32(inc[:], uint32(st.unacked))
+			st.unacked = 0
+			st.s.queueLocked(muxWindow, st.id, inc[:])
+		}
+	}
+	st.writing = len(st.out) > 0
+	if !st.writing && st.finRecvd && !st.wrShut {
+		st.wrShut = true
+		epio.ShutdownWrite(fd)
+	}
+	st.updateLocked()
+	st.finishLocked()
+}
+
+func (st *muxStream) updateLocked() {
+	fd := st.GetFd()
+	if st.closed || fd == -1 {
+		return
+	}
+	var ev uint32
+	if st.reading {
+		ev |= epio.EvIn
+	}
+	if st.writing {
+		ev |= syscall.EPOLLOUT
+	}
+	st.GetReactor().ModifyEvHandler(st, fd, ev)
+}
+
+// finishLocked 两个方向都结束之后关闭流, 对端也会在同样的条件下关闭
+func (st *muxStream) finishLocked() {
+	if st.eof && st.wrShut {
+		st.closeLocked(false, nil)
+	}
+}
+
+// closeLocked 关闭流, reset时通知对端。
+// 还在等待对端接受的流返回在锁外调用eh.OnConnectFail(err)的函数
+func (st *muxStream) closeLocked(reset bool, err error) func() {
+	if st.closed {
+		return nil
+	}
+	st.closed = true
+	delete(st.s.streams, st.id)
+	if reset {
+		st.s.queueLocked(muxReset, st.id, nil)
+	}
+	if fd := st.GetFd(); fd != -1 {
+		st.GetReactor().RemoveEvHandler(st, fd)
+		epio.Close(fd)
+		st.SetFd(-1)
+	}
+	st.out = nil
+	if st.eh == nil {
+		return nil
+	}
+	eh, fd := st.eh, st.ehFd
+	st.eh, st.ehFd = nil, -1
+	return func() {
+		epio.Close(fd)
+		eh.OnConnectFail(err)
+	}
+}
+
+// ListenMux 在addr上接受其他gProxy的多路复用连接, 流中的服务名是本机注册的服务,
+// 不需要先调用/forwarding。key不为空时对端必须使用相同的密钥(SetMuxKey), 连接上的数据都加密。
+// addr的格式同epio.NewAcceptor
+func (p *ProxyServer) ListenMux(addr, key string) error {
+	k := muxKey(key)
+	_, err := epio.NewAcceptor(p.forAccept, p.forNewFd,
+		func() epio.EvHandler {
+			s := newMuxSession(p.forNewFd, "", k, false)
+			s.resolve, s.c = p.lookupService, p.connector
+			return s
+		},
+		addr,
+		epio.ListenBacklog(256),
+		epio.SockRcvBufSize(8*1024))
+	if err != nil {
+		return err
+	}
+	log.Printf("正在侦听多路复用: %s\n", addr)
+	return nil
+}
+
+// SetMuxKey 连接其他gProxy的多路复用端口时使用的预共享密钥, 和对端ListenMux的key相同。
+// 只影响之后新建立的长连接
+func (p *ProxyServer) SetMuxKey(key string) {
+	p.muxes.setKey(muxKey(key))
+}
@@ -0,0 +1,216 @@
+package gproxy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// 两个gProxy之间长连接的认证和加密。双方配置相同的预共享密钥,
+// 用X25519交换临时密钥, 用预共享密钥的HMAC证明双方都知道密钥, 之后的帧用AES-256-GCM加密。
+//
+//	发起方 -> 对端  "GPMX" | version(1) | 发起方公钥(32)
+//	对端 -> 发起方  对端公钥(32) | HMAC(key, "server" | 发起方公钥 | 对端公钥)
+//	发起方 -> 对端  HMAC(key, "client" | 发起方公钥 | 对端公钥)
+//
+// 之后每个方向是一串记录: length(4) | 密文, 明文连起来是帧的字节流,
+// 每个方向的密钥不同, nonce是记录的序号
+const (
+	muxMagic            = "GPMX"
+	muxVersion          = 1
+	muxHelloLen         = len(muxMagic) + 1 + 32
+	muxMACLen           = sha256.Size
+	maxMuxRecord        = muxHeaderLen + maxMuxPayload // 一个记录中明文的最大长度
+	muxHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	errMuxAuth   = errors.New("mux authentication failed")
+	errMuxRecord = errors.New("mux record corrupted")
+)
+
+// muxKey 预共享密钥可以是任意长度的字符串, 为空时不加密
+func muxKey(psk string) []byte {
+	if psk == "" {
+		return nil
+	}
+	k := sha256.Sum256([]byte(psk))
+	return k[:]
+}
+
+// muxHandshake 握手的状态, 只在连接所在的evPoll中使用
+type muxHandshake struct {
+	key    []byte
+	client bool
+	priv   *ecdh.PrivateKey
+	pubC   []byte
+	pubS   []byte
+	step   int // 对端: 0等待hello, 1等待发起方的HMAC; 发起方: 0等待对端的公钥和HMAC
+}
+
+func newMuxHandshake(key []byte, client bool) (*muxHandshake, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	h := &muxHandshake{key: key, client: client, priv: priv}
+	if client {
+		h.pubC = priv.PublicKey().Bytes()
+	} else {
+		h.pubS = priv.PublicKey().Bytes()
+	}
+	return h, nil
+}
+
+// hello 发起方的第一条消息
+func (h *muxHandshake) hello() []byte {
+	return append(append([]byte(muxMagic), muxVersion), h.pubC...)
+}
+
+func (h *muxHandshake) mac(label string) []byte {
+	m := hmac.New(sha256.New, h.key)
+	m.Write([]byte(label))
+	m.Write(h.pubC)
+	m.Write(h.pubS)
+	return m.Sum(nil)
+}
+
+// feed 处理收到的握手消息, 返回要发给对端的数据和用掉的字节数, done表示握手完成
+func (h *muxHandshake) feed(in []byte) (reply []byte, n int, done bool, err error) {
+	for {
+		switch {
+		case !h.client && h.step == 0:
+			if len(in)-n < muxHelloLen {
+				return reply, n, false, nil
+			}
+			hello := in[n : n+muxHelloLen]
+			if !bytes.HasPrefix(hello, []byte(muxMagic)) || hello[len(muxMagic)] != muxVersion {
+				return nil, 0, false, errMuxAuth
+			}
+			h.pubC = append([]byte(nil), hello[len(muxMagic)+1:]...)
+			reply = append(append(reply, h.pubS...), h.mac("server")...)
+			n += muxHelloLen
+			h.step = 1
+		case !h.client:
+			if len(in)-n < muxMACLen {
+				return reply, n, false, nil
+			}
+			if !hmac.Equal(in[n:n+muxMACLen], h.mac("client")) {
+				return nil, 0, false, errMuxAuth
+			}
+			return reply, n + muxMACLen, true, nil
+		default:
+			if len(in) < 32+muxMACLen {
+				return nil, 0, false, nil
+			}
+			h.pubS = append([]byte(nil), in[:32]...)
+			if !hmac.Equal(in[32:32+muxMACLen], h.mac("server")) {
+				return nil, 0, false, errMuxAuth
+			}
+			return h.mac("client"), 32 + muxMACLen, true, nil
+		}
+	}
+}
+
+// keys 握手完成之后两个方向的密钥, tx用于发送, rx用于接收
+func (h *muxHandshake) keys() (tx, rx *muxCipher, err error) {
+	peer := h.pubS
+	if !h.client {
+		peer = h.pubC
+	}
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := h.priv.ECDH(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := hmac.New(sha256.New, h.key)
+	m.Write(secret)
+	prk := m.Sum(nil)
+	c2s, err := newMuxCipher(prk, "c2s", h.pubC, h.pubS)
+	if err != nil {
+		return nil, nil, err
+	}
+	s2c, err := newMuxCipher(prk, "s2c", h.pubC, h.pubS)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.client {
+		return c2s, s2c, nil
+	}
+	return s2c, c2s, nil
+}
+
+// muxCipher 一个方向的AEAD, 发送方向由muxSession.mtx保护, 接收方向只在evPoll中使用
+type muxCipher struct {
+	aead cipher.AEAD
+	seq  uint64
+}
+
+func newMuxCipher(prk []byte, label string, pubC, pubS []byte) (*muxCipher, error) {
+	m := hmac.New(sha256.New, prk)
+	m.Write([]byte(label))
+	m.Write(pubC)
+	m.Write(pubS)
+	block, err := aes.NewCipher(m.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &muxCipher{aead: aead}, nil
+}
+
+func (c *muxCipher) nonce() []byte {
+	var n [12]byte
+	binary.BigEndian.PutUint64(n[4:], c.seq)
+	c.seq++
+	return n[:]
+}
+
+// seal 把plain加密成记录追加到dst, 超过maxMuxRecord时分成多个记录
+func (c *muxCipher) seal(dst, plain []byte) []byte {
+	for len(plain) > 0 {
+		chunk := plain
+		if len(chunk) > maxMuxRecord {
+			chunk = chunk[:maxMuxRecord]
+		}
+		plain = plain[len(chunk):]
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(chunk)+c.aead.Overhead()))
+		dst = append(dst, hdr[:]...)
+		dst = c.aead.Seal(dst, c.nonce(), chunk, hdr[:])
+	}
+	return dst
+}
+
+// open 解密in中完整的记录追加到dst, 返回用掉的字节数, 被篡改或者长度不对时返回错误
+func (c *muxCipher) open(dst, in []byte) ([]byte, int, error) {
+	n := 0
+	for len(in)-n >= 4 {
+		size := int(binary.BigEndian.Uint32(in[n : n+4]))
+		if size < c.aead.Overhead() || size > maxMuxRecord+c.aead.Overhead() {
+			return dst, n, errMuxRecord
+		}
+		if len(in)-n-4 < size {
+			break
+		}
+		var err error
+		if dst, err = c.aead.Open(dst, c.nonce(), in[n+4:n+4+size], in[n:n+4]); err != nil {
+			return dst, n, errMuxRecord
+		}
+		n += 4 + size
+	}
+	return dst, n, nil
+}
@@ -0,0 +1,213 @@
+package gproxy
+
+import (
+	epio "g-proxy/epio"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startMuxPeers 对端gProxy按服务名转发到echo服务, 本机为names中的每个服务侦听一个随机端口,
+// 把连接转发到对端的服务。返回对端的地址和每个服务侦听的地址, 测试结束时都会关闭
+func startMuxPeers(t *testing.T, key, peerKey string, names ...string) (pool *muxPool, muxAddr string, addrs map[string]string) {
+	t.Helper()
+	forAccept, forNewFd, connector := startReactors(t)
+	remote := &ProxyServer{forAccept: forAccept, forNewFd: forNewFd, connector: connector,
+		registry: newRegistry()}
+	remote.addProxy("echo", NewPortProxy(tcpAddr(t, echoServer(t))), nil)
+	k := muxKey(peerKey)
+	muxAddr = startAcceptor(t, forAccept, forNewFd, "127.0.0.1:0", func() epio.EvHandler { // 同ListenMux
+		s := newMuxSession(forNewFd, "", k, false)
+		s.resolve, s.c = remote.lookupService, connector
+		return s
+	})
+
+	forAccept, forNewFd, connector = startReactors(t)
+	pool = newMuxPool(connector)
+	pool.setKey(muxKey(key))
+	addrs = make(map[string]string, len(names))
+	for _, name := range names {
+		proxy := &PortProxy{Server: tcpAddr(t, muxAddr), Mux: name, muxes: pool}
+		proxy.resetBalancer()
+		addrs[name] = startAcceptor(t, forAccept, forNewFd, "127.0.0.1:0",
+			func() epio.EvHandler { return NewProxyC(connector, proxy) })
+	}
+	return pool, muxAddr, addrs
+}
+
+func assertClosedByProxy(t *testing.T, addr string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMuxRelay(t *testing.T) {
+	for _, key := range []string{"", "s3cret"} {
+		name := map[string]string{"": "明文", "s3cret": "加密"}[key]
+		t.Run(name, func(t *testing.T) {
+			pool, muxAddr, addrs := startMuxPeers(t, key, key, "echo", "other")
+			echoAddr, otherAddr := addrs["echo"], addrs["other"]
+
+			t.Run("多个连接共用一条长连接", func(t *testing.T) {
+				var wg sync.WaitGroup
+				for i := 0; i < 4; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						conn, err := net.DialTimeout("tcp", echoAddr, 5*time.Second)
+						if err != nil {
+							t.Error(err.Error())
+							return
+						}
+						defer conn.Close()
+						assertEchoLargeConn(t, conn) // 超过窗口, 需要流量控制
+					}()
+				}
+				wg.Wait()
+				pool.mtx.Lock()
+				assert.Equal(t, 1, len(pool.sessions))
+				pool.mtx.Unlock()
+			})
+
+			t.Run("半关闭", func(t *testing.T) {
+				conn, err := net.DialTimeout("tcp", echoAddr, 5*time.Second)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				defer conn.Close()
+				conn.Write([]byte("ping"))
+				conn.(*net.TCPConn).CloseWrite()
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				got, err := io.ReadAll(conn)
+				assert.Nil(t, err)
+				assert.Equal(t, "ping", string(got))
+
+				// 两个方向都结束之后两端的流都关闭了
+				pool.mtx.Lock()
+				s := pool.sessions[muxAddr]
+				pool.mtx.Unlock()
+				streams := -1
+				for start := time.Now(); streams != 0 && time.Since(start) < 3*time.Second; time.Sleep(20 * time.Millisecond) {
+					s.mtx.Lock()
+					streams = len(s.streams)
+					s.mtx.Unlock()
+				}
+				assert.Equal(t, 0, streams)
+			})
+
+			t.Run("对端没有这个服务", func(t *testing.T) {
+				assertClosedByProxy(t, otherAddr)
+			})
+		})
+	}
+
+	t.Run("密钥不同", func(t *testing.T) {
+		pool, _, addrs := startMuxPeers(t, "s3cret", "other", "echo")
+		assertClosedByProxy(t, addrs["echo"])
+		pool.mtx.Lock()
+		assert.Equal(t, 0, len(pool.sessions))
+		pool.mtx.Unlock()
+	})
+
+	t.Run("对端不加密", func(t *testing.T) {
+		_, _, addrs := startMuxPeers(t, "s3cret", "", "echo")
+		assertClosedByProxy(t, addrs["echo"])
+	})
+}
+
+// failRecorder 记录OnConnectFail的错误
+type failRecorder struct {
+	epio.Event
+	err error
+}
+
+func (f *failRecorder) OnConnectFail(err error) {
+	f.err = err
+}
+
+func TestMuxStreamWindow(t *testing.T) {
+	s := newMuxSession(nil, "", nil, false)
+	st := newMuxStream(s, 1)
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer syscall.Close(fds[1])
+	eh := &failRecorder{}
+	st.eh, st.ehFd = eh, fds[0]
+	s.streams[st.id] = st
+
+	assert.True(t, s.handle(muxData, st.id, make([]byte, muxWindowSize+1)))
+	assert.Equal(t, epio.ErrConnectFail, eh.err, "还没有被接受的流超过窗口时通知ProxyS")
+	assert.Empty(t, s.streams)
+	_, err = syscall.Write(fds[1], []byte("x"))
+	assert.NotNil(t, err, "关闭了socketpair的另一端")
+}
+
+func TestMuxHandshake(t *testing.T) {
+	handshake := func(clientKey, serverKey string) (c, s *muxHandshake, err error) {
+		c, _ = newMuxHandshake(muxKey(clientKey), true)
+		s, _ = newMuxHandshake(muxKey(serverKey), false)
+		_, n, _, _ := s.feed(c.hello()[:10])
+		assert.Equal(t, 0, n, "不完整的hello")
+		reply, n, done, err := s.feed(c.hello())
+		if err != nil {
+			return
+		}
+		assert.Equal(t, muxHelloLen, n)
+		assert.False(t, done)
+		if reply, n, done, err = c.feed(reply); err != nil {
+			return
+		}
+		assert.True(t, done)
+		_, _, done, err = s.feed(reply)
+		assert.True(t, err != nil || done)
+		return
+	}
+
+	t.Run("加密和解密", func(t *testing.T) {
+		c, s, err := handshake("k", "k")
+		if !assert.Nil(t, err) {
+			return
+		}
+		ctx, crx, _ := c.keys()
+		stx, srx, _ := s.keys()
+		big := make([]byte, maxMuxRecord+100)
+		rec := ctx.seal(nil, []byte("hello"))
+		rec = ctx.seal(rec, big)
+		plain, n, err := srx.open(nil, rec[:len(rec)-1])
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(plain[:5]))
+		plain, m, err := srx.open(plain, rec[n:])
+		assert.Nil(t, err)
+		assert.Equal(t, len(rec), n+m)
+		assert.Equal(t, 5+len(big), len(plain))
+
+		rec = stx.seal(nil, []byte("pong"))
+		rec[len(rec)-1] ^= 1
+		_, _, err = crx.open(nil, rec)
+		assert.Equal(t, errMuxRecord, err, "被篡改")
+	})
+
+	t.Run("密钥不同", func(t *testing.T) {
+		_, _, err := handshake("k", "other")
+		assert.Equal(t, errMuxAuth, err)
+	})
+
+	t.Run("不是握手", func(t *testing.T) {
+		s, _ := newMuxHandshake(muxKey("k"), false)
+		_, _, _, err := s.feed(make([]byte, muxHelloLen))
+		assert.Equal(t, errMuxAuth, err)
+	})
+}
@@ -1,113 +1,396 @@
 package gproxy
 
 import (
+	"crypto/tls"
 	"fmt"
 	epio "g-proxy/epio"
-	"sync"
+	"net"
 	"syscall"
+	"time"
+)
+
+const (
+	connectTimeout      = 30000 // 第一次连接后端的超时毫秒数
+	retryConnectTimeout = 3000  // 换一个后端重试时的超时毫秒数
+	maxConnectRetries   = 3     // 连接后端失败后最多重试的次数
 )
 
 type ProxyC struct {
-	epio.Event
-	c         *epio.Connector
-	buddy     *ProxyS
-	closeOnce *sync.Once
+	endpoint
+	c          *epio.Connector
+	dial       func(addr string, eh epio.EvHandler, timeout int64) error // 连接后端, 默认是c.Connect
+	buddy      *ProxyS
+	client     net.IP // 客户端IP, 按来源哈希选择后端时使用, HTTP端口上可能来自X-Forwarded-For
+	retries    int
+	tlsConf    *tls.Config        // 不为nil时先和客户端完成TLS握手
+	hs         *tlsStream         // 正在和客户端握手, 只在evPoll中使用
+	hsSlots    *handshakeSlots    // 服务同时握手的连接数
+	proxyProto string             // 连接后端时先发送的PROXY协议版本
+	inbound    *proxyHeaderReader // 客户端连接上先读取PROXY协议头, 读完之前不为nil
+	remote     string             // 客户端地址, 接受PROXY协议时是协议头中的地址
+	local      string             // 客户端连接的目的地址
+	sni        *sniRoute          // 共享端口上按SNI选择服务, 选好之前不为nil
+	http       *httpStream        // HTTP端口上按Host和路径选择服务, 之后的每个请求都要解析
+	socks      *socksStream       // SOCKS5端口上按CONNECT的服务名选择服务
+	tunnel     *connectStream     // HTTP CONNECT端口上按请求的服务名选择服务
+
+	replyOK   []byte // 后端连接成功之后先回复客户端, SOCKS5和HTTP CONNECT使用
+	replyFail []byte // 所有后端都连接失败时回复客户端
+
+	helloTimer *epio.Timer // 等待PROXY协议头, ClientHello或者第一个请求头的超时
 }
 
-func NewProxyC(c *epio.Connector, buddyAddr string) *ProxyC {
-	pc := &ProxyC{c: c, closeOnce: &sync.Once{}}
-	ps := &ProxyS{addr: buddyAddr, ready: make(chan struct{}), closeOnce: &sync.Once{}}
+// NewProxyC 为新的客户端连接创建一对ProxyC/ProxyS, OnOpen时按proxy的配置选择并连接后端
+func NewProxyC(c *epio.Connector, proxy *PortProxy) *ProxyC {
+	pc := newProxyPair(c)
+	pc.configure(proxy)
+	if proxy.AcceptProxyProtocol {
+		pc.inbound = &proxyHeaderReader{}
+	}
+	return pc
+}
+
+func newProxyPair(c *epio.Connector) *ProxyC {
+	pc := &ProxyC{c: c, dial: c.Connect}
+	ps := &ProxyS{}
 	pc.buddy = ps
 	ps.buddy = pc
-	pc.SetFd(-1)
-	ps.SetFd(-1)
-	if err := c.Connect(buddyAddr, ps, 30000); err != nil {
-		panic(err.Error())
-	}
+	newEndpointPair(&pc.endpoint, pc, &ps.endpoint, ps)
 	return pc
 }
 
+// configure 按服务的配置设置超时和转发方式, 开始连接后端之前调用
+func (p *ProxyC) configure(proxy *PortProxy) {
+	ps := p.buddy
+	p.tlsConf, p.hsSlots = proxy.tlsConf, proxy.hsSlots
+	p.linger, ps.linger = defaultHalfCloseLinger, defaultHalfCloseLinger
+	if proxy.Linger > 0 {
+		p.linger, ps.linger = int64(proxy.Linger)*1000, int64(proxy.Linger)*1000
+	}
+	p.sess.lb = proxy.lb
+	p.sess.idle = int64(proxy.IdleTimeout) * 1000
+	p.sess.lifetime = int64(proxy.MaxLifetime) * 1000
+	p.proxyProto = proxy.ProxyProtocol
+	if proxy.Tunnel != "" {
+		hub, name := proxy.hub, proxy.Tunnel
+		p.dial = func(addr string, eh epio.EvHandler, timeout int64) error {
+			return hub.open(name, p.remote, eh, timeout)
+		}
+	}
+	if proxy.Mux != "" {
+		pool, name := proxy.muxes, proxy.Mux
+		p.dial = func(addr string, eh epio.EvHandler, timeout int64) error {
+			return pool.open(addr, name, p.remote, eh, timeout)
+		}
+	}
+	// TLS需要经过用户态加解密, HTTP端口上要解析请求和Upgrade的响应
+	if proxy.Relay == RelaySplice && p.tlsConf == nil && p.http == nil {
+		p.usePipe()
+		ps.usePipe()
+	}
+}
+
+// OnOpen 注册客户端连接, 然后按客户端地址选择一个后端开始连接。
+// 没有可用的后端时直接关闭客户端连接
+//
+// 终结TLS时先在evPoll中完成握手, 之后再连接后端
 func (p *ProxyC) OnOpen(fd int, now int64) bool {
-	if err := p.GetReactor().AddEvHandler(p, fd, epio.EvIn); err != nil {
+	p.sess.client = epio.RemoteAddr(fd)
+	if p.routing() {
+		return p.waitRoute(fd, now)
+	}
+	return p.begin(fd, now, nil)
+}
+
+// begin 开始握手或者连接后端, pre是之前已经从fd读出来的客户端数据
+func (p *ProxyC) begin(fd int, now int64, pre []byte) bool {
+	if p.tlsConf != nil {
+		return p.startHandshake(fd, now, pre)
+	}
+	if len(pre) > 0 {
+		p.buddy.send(pre)
+	}
+	return p.start(fd, now)
+}
+
+// startHandshake 把fd加入epoll等待客户端的握手数据
+func (p *ProxyC) startHandshake(fd int, now int64, pre []byte) bool {
+	s := newTLSStream(fd, p.tlsConf, pre)
+	s.notify = func() { p.GetReactor().Post(p, p.flushHandshake) }
+	p.hs = s
+	if !p.waitRoute(fd, now) {
+		p.hs = nil
 		return false
 	}
-	p.SetFd(fd)
-	return true
+	return p.runHandshake()
 }
 
-func (p *ProxyC) OnRead(fd int, evPollSharedBuff []byte, now int64) bool {
-	buf := evPollSharedBuff
-	if p.buddy.GetFd() == -1 {
+// runHandshake 读到完整的第一个TLS记录之后启动握手的goroutine,
+// 同一个服务同时握手的连接太多时关闭客户端连接
+func (p *ProxyC) runHandshake() bool {
+	s := p.hs
+	if s.started || !s.helloReady() {
 		return true
 	}
+	if !p.hsSlots.acquire() {
+		fmt.Println("ProxyC: too many tls handshakes")
+		p.sess.reason = closeByTLS
+		p.abortHandshake()
+		return false
+	}
+	s.started = true
+	go func() {
+		err := s.handshake()
+		p.hsSlots.release()
+		p.GetReactor().Post(p, func() { p.finishHandshake(s, err) })
+	}()
+	return true
+}
 
-	for {
-		n, err := epio.Read(fd, buf)
+// readHandshake 把客户端的数据交给握手的goroutine, 客户端关闭写方向或者缓存满了之后不再关注EvIn
+func (p *ProxyC) readHandshake(fd int, evPollSharedBuff []byte) bool {
+	for p.hs.readable() {
+		n, err := epio.Read(fd, evPollSharedBuff)
 		if err != nil {
-			if err == syscall.EAGAIN { // epoll ET mode
-				break
+			if err == syscall.EAGAIN {
+				return true
 			}
-			fmt.Println("read: ", err.Error())
+			fmt.Println("ProxyC: tls handshake " + err.Error())
+			p.sess.reason = closeByTLS
 			return false
 		}
-		if n > 0 { // n > 0
-			epio.Write(p.buddy.GetFd(), buf[0:n])
-		} else { // n == 0 connection closed,  will not < 0
+		p.hs.feed(evPollSharedBuff[:n], n == 0)
+		if !p.runHandshake() {
 			return false
 		}
 	}
+	p.flushHandshake()
 	return true
 }
 
-func (p *ProxyC) OnClose(fd int) {
-	p.GetReactor().RemoveEvHandler(p, fd)
-	epio.Close(fd)
-	p.buddy.GetReactor().RemoveEvHandler(p.buddy, p.buddy.GetFd())
-	epio.Close(p.buddy.GetFd())
+// flushHandshake 在evPoll中写出握手产生的密文并更新关注的事件, 写不完时关注EPOLLOUT
+func (p *ProxyC) flushHandshake() {
+	if p.hs == nil {
+		return
+	}
+	pending, err := p.hs.writeOut()
+	if err != nil {
+		fmt.Println("ProxyC: tls handshake " + err.Error())
+		p.sess.reason = closeByTLS
+		p.abortHandshake()
+		p.close(p.GetFd())
+		return
+	}
+	ev := uint32(0)
+	if pending {
+		ev |= syscall.EPOLLOUT
+	}
+	if p.hs.readable() {
+		ev |= epio.EvIn
+	}
+	p.GetReactor().ModifyEvHandler(p, p.GetFd(), ev)
 }
 
-type ProxyS struct {
-	epio.Event
-	buddy     *ProxyC
-	addr      string
-	ready     chan struct{}
-	closeOnce *sync.Once
+// finishHandshake 在evPoll中处理握手的结果, 成功之后按原来的方式注册客户端连接并连接后端,
+// 握手时没写完的密文在客户端的待写队列最前面
+func (p *ProxyC) finishHandshake(s *tlsStream, err error) {
+	if p.hs != s { // 已经超时或者关闭了
+		return
+	}
+	p.hs = nil
+	fd := p.GetFd()
+	if err != nil {
+		fmt.Println("ProxyC: tls handshake " + err.Error())
+		p.mtx.Lock()
+		p.sess.reason = closeByTLS
+		p.mtx.Unlock()
+		p.close(fd)
+		return
+	}
+	p.cancelHelloTimer()
+	if err := p.GetReactor().RemoveEvHandler(p, fd); err != nil {
+		p.close(fd)
+		return
+	}
+	p.SetFd(-1)
+	p.mtx.Lock()
+	p.tls = s
+	p.out = append(s.takeOut(), p.out...)
+	p.mtx.Unlock()
+	if !p.start(fd, time.Now().UnixMilli()) {
+		p.close(fd)
+		return
+	}
+	p.pumpTLS() // 握手时可能已经读到了后面的数据
 }
 
-func (p *ProxyS) OnOpen(fd int, now int64) bool {
-	if err := p.GetReactor().AddEvHandler(p, fd, epio.EvIn); err != nil {
+// abortHandshake 关闭还在握手的连接时让握手的goroutine结束
+func (p *ProxyC) abortHandshake() {
+	if p.hs != nil {
+		p.hs.abort()
+		p.hs = nil
+	}
+}
+
+func (p *ProxyC) start(fd int, now int64) bool {
+	if p.remote == "" {
+		p.remote, p.local = epio.RemoteAddr(fd), epio.LocalAddr(fd)
+	}
+	if p.client == nil {
+		p.client = clientIP(p.remote)
+	}
+	p.sess.client = p.remote
+	i := p.sess.lb.pick(p.client, -1)
+	if i < 0 {
+		fmt.Println("ProxyC: no backend available")
+		p.sess.reason = closeByNoServer
 		return false
 	}
-	p.SetFd(fd)
+	p.sess.backend = i
+	p.buddy.addr = p.sess.lb.backends[i].String()
+	if p.proxyProto != "" {
+		// 在客户端的数据之前, 换后端重试时也会留在ProxyS的队列中
+		hdr := proxyHeader(p.proxyProto, p.remote, p.local)
+		p.mtx.Lock()
+		p.buddy.out = append(hdr, p.buddy.out...)
+		p.mtx.Unlock()
+	}
+	if !p.open(fd) {
+		return false
+	}
+	p.startTimers(now)
+	if err := p.dial(p.buddy.addr, p.buddy, connectTimeout); err != nil {
+		fmt.Println("ProxyC: " + err.Error())
+		p.connectNext()
+	}
 	return true
 }
-func (p *ProxyS) OnRead(fd int, evPollSharedBuff []byte, now int64) bool {
-	buf := evPollSharedBuff
+
+// connectNext 连接后端失败后换一个后端重试, 重试次数用完或者没有可用的后端时关闭代理对
+func (p *ProxyC) connectNext() {
 	for {
-		n, err := epio.Read(fd, buf)
-		if err != nil {
-			if err == syscall.EAGAIN { // epoll ET mode
-				break
+		p.mtx.Lock()
+		if p.closed {
+			p.mtx.Unlock()
+			return
+		}
+		failed := p.sess.backend
+		if failed >= 0 {
+			p.sess.lb.release(failed)
+		}
+		i := -1
+		if p.retries < maxConnectRetries {
+			p.retries++
+			i = p.sess.lb.pick(p.client, failed)
+		}
+		p.sess.backend = i
+		if i < 0 {
+			p.sess.reason = closeByNoServer
+			if p.replyFail != nil {
+				epio.Write(p.GetFd(), p.replyFail)
 			}
-			fmt.Println("read: ", err.Error())
-			return false
+			p.mtx.Unlock()
+			p.close(p.GetFd())
+			return
 		}
-		if n > 0 { // n > 0
-			epio.Write(p.buddy.GetFd(), buf[0:n])
-		} else { // n == 0 connection closed,  will not < 0
-			return false
+		p.buddy.addr = p.sess.lb.backends[i].String()
+		p.mtx.Unlock()
+		err := p.dial(p.buddy.addr, p.buddy, retryConnectTimeout)
+		if err == nil {
+			return
 		}
+		fmt.Println("ProxyC: " + err.Error())
 	}
-	return true
+}
+
+// OnRead 后端还在连接中时读到的数据会缓存在ProxyS的待写队列中,
+// 超过高水位后暂停读取, 直到ProxyS.OnOpen
+func (p *ProxyC) OnRead(fd int, evPollSharedBuff []byte, now int64) bool {
+	if p.hs != nil {
+		return p.readHandshake(fd, evPollSharedBuff)
+	}
+	if p.inbound != nil {
+		return p.readProxyHeader(fd, evPollSharedBuff, now)
+	}
+	if p.sni != nil {
+		return p.readHello(fd, evPollSharedBuff, now)
+	}
+	if p.http != nil {
+		return p.relayHTTP(fd, evPollSharedBuff, now)
+	}
+	if p.socks != nil && p.socks.proxy == nil {
+		return p.readSocks(fd, evPollSharedBuff, now)
+	}
+	if p.tunnel != nil && p.tunnel.proxy == nil {
+		return p.readConnect(fd, evPollSharedBuff, now)
+	}
+	p.touch(now)
+	return p.relay(fd, evPollSharedBuff)
+}
+
+func (p *ProxyC) OnWrite(fd int, now int64) bool {
+	if p.hs != nil {
+		p.flushHandshake()
+		return true
+	}
+	return p.flush(fd)
+}
+
+// OnTimer 半关闭后linger超时, 空闲超时或超过最长存活时间, 或者等待ClientHello超时
+func (p *ProxyC) OnTimer(t *epio.Timer, now int64) bool {
+	if t == p.helloTimer {
+		p.helloTimeout()
+		return false
+	}
+	return p.onTimer(t, now)
+}
+
+func (p *ProxyC) OnClose(fd int) {
+	p.abortHandshake()
+	p.close(fd)
+}
+
+type ProxyS struct {
+	endpoint
+	buddy *ProxyC
+	addr  string
+}
+
+// OnOpen SOCKS5和HTTP CONNECT的客户端在后端连接成功之后才能收到成功的回复
+func (p *ProxyS) OnOpen(fd int, now int64) bool {
+	if p.buddy.replyOK != nil {
+		p.mtx.Lock()
+		if !p.closed {
+			p.peer.sendLocked(p.buddy.replyOK)
+		}
+		p.mtx.Unlock()
+	}
+	return p.open(fd)
+}
+
+func (p *ProxyS) OnRead(fd int, evPollSharedBuff []byte, now int64) bool {
+	p.touch(now)
+	if p.buddy.http != nil {
+		return p.relayResponse(fd, evPollSharedBuff)
+	}
+	return p.relay(fd, evPollSharedBuff)
+}
+
+func (p *ProxyS) OnWrite(fd int, now int64) bool {
+	return p.flush(fd)
+}
+
+// OnTimer 半关闭后linger超时
+func (p *ProxyS) OnTimer(t *epio.Timer, now int64) bool {
+	return p.onTimer(t, now)
 }
 
 func (p *ProxyS) OnClose(fd int) {
-	p.GetReactor().RemoveEvHandler(p, fd)
-	epio.Close(fd)
-	p.buddy.GetReactor().RemoveEvHandler(p.buddy, p.buddy.GetFd())
-	epio.Close(p.buddy.GetFd())
+	p.close(fd)
 }
+
+// OnConnectFail 换一个后端重试
 func (p *ProxyS) OnConnectFail(err error) {
-	fmt.Println("ProxyS: " + err.Error())
-	p.buddy.c.Connect(p.addr, p, 3000)
+	fmt.Println("ProxyS: " + p.addr + " " + err.Error())
+	p.buddy.connectNext()
 }
@@ -0,0 +1,436 @@
+package gproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	epio "g-proxy/epio"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startRelay 在addr上侦听, 把连接转发到backend, 返回侦听的地址
+func startRelay(t *testing.T, addr, backend string) string {
+	t.Helper()
+	return startRelayService(t, addr, backend, &PortProxy{})
+}
+
+// startRelayService 按proxy的配置转发, 返回侦听的地址
+func startRelayService(t *testing.T, addr, backend string, proxy *PortProxy) string {
+	t.Helper()
+	server, err := net.ResolveTCPAddr("tcp", backend)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	proxy.Server = server
+	proxy.resetBalancer()
+	forAccept, forNewFd, connector := startReactors(t)
+	return startAcceptor(t, forAccept, forNewFd, addr, func() epio.EvHandler { return NewProxyC(connector, proxy) })
+}
+
+// startAcceptor 在addr上侦听, 返回侦听的地址。addr为127.0.0.1:0时侦听一个空闲的端口,
+// 测试结束时在停止reactor之前关闭侦听
+func startAcceptor(t *testing.T, forAccept, forNewFd *epio.Reactor, addr string, newEvHandler func() epio.EvHandler) string {
+	t.Helper()
+	if addr == "127.0.0.1:0" { // epio.NewAcceptor不接受端口0
+		addr = deadAddr(t).String()
+	}
+	a, err := epio.NewAcceptor(forAccept, forNewFd, newEvHandler, addr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() {
+		if a.Stop() == nil {
+			<-a.Close
+		}
+	})
+	return addr
+}
+
+// startReactors 和ProxyServer一样创建两个reactor, 测试结束时停止
+func startReactors(t *testing.T) (forAccept, forNewFd *epio.Reactor, connector *epio.Connector) {
+	t.Helper()
+	forAccept, err := epio.NewReactor(epio.EvPollNum(1), epio.EvReadyNum(8))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	forNewFd, err = epio.NewReactor(epio.EvPollNum(2), epio.EvReadyNum(512))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	connector, err = epio.NewConnector(forNewFd)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go forAccept.Run()
+	go forNewFd.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		forAccept.Stop(ctx)
+		forNewFd.Stop(ctx)
+	})
+	return
+}
+
+// slowEchoServer 每次读取前停顿一下, 让代理的待写队列积压起来
+func slowEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 32*1024)
+				for {
+					time.Sleep(time.Millisecond)
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err = conn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRelayBackpressure(t *testing.T) {
+	backend := slowEchoServer(t)
+	addr := startRelay(t, "127.0.0.1:0", backend)
+	assertEchoLarge(t, addr)
+}
+
+func TestRelaySplice(t *testing.T) {
+	backend := slowEchoServer(t)
+	addr := startRelayService(t, "127.0.0.1:0", backend, &PortProxy{Relay: RelaySplice})
+	assertEchoLarge(t, addr)
+}
+
+// assertEchoLarge 通过代理向回显服务发送16M随机数据, 收到的数据必须完全一致
+func assertEchoLarge(t *testing.T, proxyAddr string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	assertEchoLargeConn(t, conn)
+}
+
+func assertEchoLargeConn(t *testing.T, conn net.Conn) {
+	t.Helper()
+	data := make([]byte, 16*1024*1024)
+	rand.Read(data)
+	go conn.Write(data)
+
+	got := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	_, err := io.ReadFull(conn, got)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, got), "relayed bytes corrupted")
+}
+
+// 客户端先发送数据, 后端连接建立之前的数据不能丢
+func TestRelayClientSpeaksFirst(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ln.Close()
+	addr := startRelay(t, "127.0.0.1:0", ln.Addr().String())
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	req := []byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	_, err = conn.Write(req)
+	assert.Nil(t, err)
+
+	// 客户端的数据已经到达代理之后后端才accept
+	time.Sleep(100 * time.Millisecond)
+	backend, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer backend.Close()
+	got := make([]byte, len(req))
+	backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(backend, got)
+	assert.Nil(t, err)
+	assert.Equal(t, string(req), string(got))
+}
+
+// replyAfterEOFServer 读到EOF之后才把收到的数据全部发回去再关闭, 类似`nc -N`的对端
+func replyAfterEOFServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, err := io.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				conn.Write(data)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	backend := replyAfterEOFServer(t)
+	relayAddr := startRelay(t, "127.0.0.1:0", backend)
+	spliceAddr := startRelayService(t, "127.0.0.1:0", backend, &PortProxy{Relay: RelaySplice})
+
+	for _, addr := range []string{relayAddr, spliceAddr} {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		data := make([]byte, 4*1024*1024)
+		rand.Read(data)
+		_, err = conn.Write(data)
+		assert.Nil(t, err)
+		conn.(*net.TCPConn).CloseWrite()
+
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		got, err := io.ReadAll(conn)
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(data, got), "reply after half-close truncated: %d/%d", len(got), len(data))
+		conn.Close()
+	}
+}
+
+// 客户端半关闭后后端一直不结束, linger超时后关闭代理对
+func TestRelayHalfCloseLinger(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			io.Copy(io.Discard, conn) // 读到EOF之后不回复也不关闭
+			time.Sleep(10 * time.Second)
+			conn.Close()
+		}
+	}()
+	addr := startRelayService(t, "127.0.0.1:0", ln.Addr().String(), &PortProxy{Linger: 1})
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).CloseWrite()
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(conn)
+	assert.Nil(t, err)
+	assert.Less(t, time.Since(start), 3*time.Second)
+}
+
+func TestRelayIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 unavailable: " + err.Error())
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	startRelay(t, "[::1]:33506", ln.Addr().String())
+	assertEchoLarge(t, "[::1]:33506")
+}
+
+// echoServer 在随机端口回显数据
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// pingUntilClosed 每隔interval发送一次数据, 返回连接被代理关闭前经过的时间
+func pingUntilClosed(t *testing.T, addr string, interval time.Duration) time.Duration {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	start := time.Now()
+	buf := make([]byte, 4)
+	for time.Since(start) < 10*time.Second {
+		if interval > 0 {
+			conn.Write([]byte("ping"))
+		}
+		conn.SetReadDeadline(time.Now().Add(interval + 5*time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			break
+		}
+		time.Sleep(interval)
+	}
+	return time.Since(start)
+}
+
+func TestRelayTimeouts(t *testing.T) {
+	backend := echoServer(t)
+
+	t.Run("空闲超时", func(t *testing.T) {
+		addr := startRelayService(t, "127.0.0.1:0", backend, &PortProxy{IdleTimeout: 1})
+		elapsed := pingUntilClosed(t, addr, 0)
+		assert.GreaterOrEqual(t, elapsed, 900*time.Millisecond)
+		assert.Less(t, elapsed, 3*time.Second)
+	})
+
+	t.Run("有数据时不会空闲超时", func(t *testing.T) {
+		addr := startRelayService(t, "127.0.0.1:0", backend, &PortProxy{IdleTimeout: 1, MaxLifetime: 3})
+		elapsed := pingUntilClosed(t, addr, 300*time.Millisecond)
+		assert.GreaterOrEqual(t, elapsed, 2900*time.Millisecond) // 超过最长存活时间才关闭
+		assert.Less(t, elapsed, 5*time.Second)
+	})
+}
+
+// idServer 接受连接后发送自己的编号并关闭
+func idServer(t *testing.T, id byte) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte{id})
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRelayBalance(t *testing.T) {
+	proxy := &PortProxy{}
+	for i := byte(0); i < 3; i++ {
+		addr, err := net.ResolveTCPAddr("tcp", idServer(t, i))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		proxy.Backends = append(proxy.Backends, addr)
+	}
+	addr := startRelayService(t, "127.0.0.1:0", proxy.Backends[0].String(), proxy)
+
+	count := make([]int, 3)
+	for i := 0; i < 9; i++ {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		data, err := io.ReadAll(conn)
+		conn.Close()
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(data)) {
+			count[data[0]]++
+		}
+	}
+	assert.Equal(t, []int{3, 3, 3}, count)
+}
+
+func TestRelayFailover(t *testing.T) {
+	t.Run("跳过连接失败的后端", func(t *testing.T) {
+		live, err := net.ResolveTCPAddr("tcp", idServer(t, 7))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		proxy := &PortProxy{Backends: []*net.TCPAddr{deadAddr(t), live}}
+		addr := startRelayService(t, "127.0.0.1:0", live.String(), proxy)
+		for i := 0; i < 4; i++ {
+			conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			data, err := io.ReadAll(conn)
+			conn.Close()
+			assert.Nil(t, err)
+			assert.Equal(t, []byte{7}, data)
+		}
+		assert.Equal(t, int32(0), proxy.lb.status()[0].Conns)
+	})
+
+	t.Run("没有可用的后端时关闭客户端", func(t *testing.T) {
+		dead := deadAddr(t)
+		proxy := &PortProxy{Backends: []*net.TCPAddr{dead, deadAddr(t)}}
+		addr := startRelayService(t, "127.0.0.1:0", dead.String(), proxy)
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		start := time.Now()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadAll(conn)
+		assert.Nil(t, err)
+		assert.Less(t, time.Since(start), 3*time.Second)
+		for _, s := range proxy.lb.status() {
+			assert.Equal(t, int32(0), s.Conns)
+		}
+	})
+}
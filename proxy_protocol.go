@@ -0,0 +1,213 @@
+package gproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	epio "g-proxy/epio"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// HAProxy PROXY协议头, 在后端连接上发送让后端看到客户端的地址,
+// 或者在客户端连接上接受, 得到负载均衡器后面的客户端地址
+const (
+	ProxyProtocolV1 = "v1" // 文本格式
+	ProxyProtocolV2 = "v2" // 二进制格式
+)
+
+// PROXY协议v2的签名
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader 按version生成PROXY协议头, src是客户端地址, dst是代理接受连接的地址。
+// 地址不是TCP的IP地址时(比如unix socket), v1发送UNKNOWN, v2发送LOCAL命令
+func proxyHeader(version, src, dst string) []byte {
+	srcIP, srcPort := splitAddr(src)
+	dstIP, dstPort := splitAddr(dst)
+	if srcIP != nil && dstIP != nil {
+		if s4, d4 := srcIP.To4(), dstIP.To4(); s4 != nil && d4 != nil {
+			srcIP, dstIP = s4, d4
+		} else {
+			srcIP, dstIP = srcIP.To16(), dstIP.To16()
+		}
+	}
+	if version == ProxyProtocolV2 {
+		return proxyHeaderV2(srcIP, dstIP, srcPort, dstPort)
+	}
+	if srcIP == nil || dstIP == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP4"
+	if len(srcIP) == net.IPv6len {
+		family = "TCP6"
+	}
+	return []byte("PROXY " + family + " " + srcIP.String() + " " + dstIP.String() + " " +
+		strconv.Itoa(srcPort) + " " + strconv.Itoa(dstPort) + "\r\n")
+}
+
+func proxyHeaderV2(srcIP, dstIP net.IP, srcPort, dstPort int) []byte {
+	h := append([]byte{}, proxyV2Sig...)
+	if srcIP == nil || dstIP == nil {
+		return append(h, 0x20, 0x00, 0x00, 0x00) // LOCAL, UNSPEC
+	}
+	family := byte(0x11) // TCP over IPv4
+	if len(srcIP) == net.IPv6len {
+		family = 0x21 // TCP over IPv6
+	}
+	h = append(h, 0x21, family) // PROXY
+	h = binary.BigEndian.AppendUint16(h, uint16(2*len(srcIP)+4))
+	h = append(h, srcIP...)
+	h = append(h, dstIP...)
+	h = binary.BigEndian.AppendUint16(h, uint16(srcPort))
+	return binary.BigEndian.AppendUint16(h, uint16(dstPort))
+}
+
+// splitAddr "ip:port"不是IP地址时返回nil
+func splitAddr(addr string) (net.IP, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, 0
+	}
+	return net.ParseIP(host), n
+}
+
+// 客户端连接上PROXY协议头的最大字节数, v1最长107字节, v2包括TLV
+const maxProxyHeader = 1024
+
+var (
+	errProxyHeaderIncomplete = errors.New("proxy header incomplete")
+	errBadProxyHeader        = errors.New("malformed proxy header")
+)
+
+// proxyHeaderReader 客户端连接上还没有读完的PROXY协议头
+type proxyHeaderReader struct {
+	buf []byte
+}
+
+// parseProxyHeader 解析v1或v2的协议头, 返回协议头的长度和其中的地址。
+// LOCAL命令, UNKNOWN或者不是TCP/UDP的地址时src和dst为空, 使用socket的地址
+func parseProxyHeader(b []byte) (n int, src, dst string, err error) {
+	if len(b) >= len(proxyV2Sig) && bytes.Equal(b[:len(proxyV2Sig)], proxyV2Sig) {
+		return parseProxyHeaderV2(b)
+	}
+	if !bytes.HasPrefix(b, []byte("PROXY ")) {
+		if len(b) < 6 && bytes.HasPrefix([]byte("PROXY "), b) ||
+			len(b) < len(proxyV2Sig) && bytes.HasPrefix(proxyV2Sig, b) {
+			return 0, "", "", errProxyHeaderIncomplete
+		}
+		return 0, "", "", errBadProxyHeader
+	}
+	end := bytes.Index(b, []byte("\r\n"))
+	if end < 0 {
+		if len(b) >= 107 {
+			return 0, "", "", errBadProxyHeader
+		}
+		return 0, "", "", errProxyHeaderIncomplete
+	}
+	fields := strings.Split(string(b[:end]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return end + 2, "", "", nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return 0, "", "", errBadProxyHeader
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	_, err1 := strconv.ParseUint(fields[4], 10, 16)
+	_, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return 0, "", "", errBadProxyHeader
+	}
+	return end + 2, net.JoinHostPort(srcIP.String(), fields[4]), net.JoinHostPort(dstIP.String(), fields[5]), nil
+}
+
+func parseProxyHeaderV2(b []byte) (n int, src, dst string, err error) {
+	if len(b) < 16 {
+		return 0, "", "", errProxyHeaderIncomplete
+	}
+	if b[12]>>4 != 2 {
+		return 0, "", "", errBadProxyHeader
+	}
+	n = 16 + int(binary.BigEndian.Uint16(b[14:16]))
+	if n > maxProxyHeader {
+		return 0, "", "", errBadProxyHeader
+	}
+	if len(b) < n {
+		return 0, "", "", errProxyHeaderIncomplete
+	}
+	if b[12]&0x0f == 0 { // LOCAL
+		return n, "", "", nil
+	}
+	addr := b[16:n]
+	var ipLen int
+	switch b[13] >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default: // AF_UNSPEC, AF_UNIX
+		return n, "", "", nil
+	}
+	if len(addr) < 2*ipLen+4 {
+		return 0, "", "", errBadProxyHeader
+	}
+	srcIP, dstIP := net.IP(addr[:ipLen]), net.IP(addr[ipLen:2*ipLen])
+	srcPort := binary.BigEndian.Uint16(addr[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(addr[2*ipLen+2:])
+	return n, net.JoinHostPort(srcIP.String(), strconv.Itoa(int(srcPort))),
+		net.JoinHostPort(dstIP.String(), strconv.Itoa(int(dstPort))), nil
+}
+
+// readProxyHeader 读取客户端连接上的PROXY协议头, 记录真实的客户端地址,
+// 协议头之后的数据和之后读到的数据一样转发给后端
+func (p *ProxyC) readProxyHeader(fd int, evPollSharedBuff []byte, now int64) bool {
+	for {
+		n, err := epio.Read(fd, evPollSharedBuff)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				return true
+			}
+			return p.dropProxyHeader(err.Error())
+		}
+		if n == 0 {
+			return p.dropProxyHeader("closed before proxy header")
+		}
+		p.inbound.buf = append(p.inbound.buf, evPollSharedBuff[:n]...)
+		hdrLen, src, dst, err := parseProxyHeader(p.inbound.buf)
+		if err == errProxyHeaderIncomplete {
+			if len(p.inbound.buf) > maxProxyHeader {
+				return p.dropProxyHeader("proxy header too large")
+			}
+			continue
+		}
+		if err != nil {
+			return p.dropProxyHeader(err.Error())
+		}
+		p.cancelHelloTimer()
+		if err := p.GetReactor().RemoveEvHandler(p, fd); err != nil {
+			return false
+		}
+		rest := p.inbound.buf[hdrLen:]
+		p.inbound = nil
+		p.SetFd(-1)
+		if src != "" {
+			p.remote, p.local = src, dst
+			p.sess.client = src
+		}
+		return p.begin(fd, now, rest)
+	}
+}
+
+// dropProxyHeader 没有合法的协议头, 返回false由evPoll关闭连接
+func (p *ProxyC) dropProxyHeader(reason string) bool {
+	fmt.Println("ProxyC: " + reason)
+	p.cancelHelloTimer()
+	p.sess.reason = closeByProxyHeader
+	return false
+}
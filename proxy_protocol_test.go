@@ -0,0 +1,131 @@
+package gproxy
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyHeader(t *testing.T) {
+	assert.Equal(t, "PROXY TCP4 10.0.0.1 10.0.0.2 5000 80\r\n",
+		string(proxyHeader(ProxyProtocolV1, "10.0.0.1:5000", "10.0.0.2:80")))
+	assert.Equal(t, "PROXY TCP6 2001:db8::1 ::1 5000 80\r\n",
+		string(proxyHeader(ProxyProtocolV1, "[2001:db8::1]:5000", "[::1]:80")))
+	assert.Equal(t, "PROXY TCP4 10.0.0.1 10.0.0.2 5000 80\r\n",
+		string(proxyHeader(ProxyProtocolV1, "[::ffff:10.0.0.1]:5000", "10.0.0.2:80")), "dual-stack")
+	assert.Equal(t, "PROXY UNKNOWN\r\n", string(proxyHeader(ProxyProtocolV1, "", "")))
+
+	v2 := proxyHeader(ProxyProtocolV2, "10.0.0.1:5000", "10.0.0.2:80")
+	assert.Equal(t, append(append([]byte{}, proxyV2Sig...),
+		0x21, 0x11, 0, 12, 10, 0, 0, 1, 10, 0, 0, 2, 0x13, 0x88, 0, 80), v2)
+	v2 = proxyHeader(ProxyProtocolV2, "[2001:db8::1]:5000", "[::1]:80")
+	assert.Equal(t, byte(0x21), v2[13])
+	assert.Equal(t, 16+36, len(v2))
+	assert.Equal(t, append(append([]byte{}, proxyV2Sig...), 0x20, 0, 0, 0), proxyHeader(ProxyProtocolV2, "", ""))
+}
+
+func TestRelayProxyProtocol(t *testing.T) {
+	for _, relay := range []string{RelayCopy, RelaySplice} {
+		t.Run(relay, func(t *testing.T) {
+			addr := startRelayService(t, "127.0.0.1:0", echoServer(t), &PortProxy{ProxyProtocol: ProxyProtocolV1, Relay: relay})
+			conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer conn.Close()
+			// 后端连接之前客户端就发送了数据, 协议头仍然在最前面
+			conn.Write([]byte("ping"))
+			want := "PROXY TCP4 " + conn.LocalAddr().(*net.TCPAddr).IP.String() + " 127.0.0.1 " +
+				strconv.Itoa(conn.LocalAddr().(*net.TCPAddr).Port) + " " + addr[len("127.0.0.1:"):] + "\r\nping"
+			got := make([]byte, len(want))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = io.ReadFull(conn, got)
+			assert.Nil(t, err)
+			assert.Equal(t, want, string(got))
+		})
+	}
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	t.Run("v1", func(t *testing.T) {
+		n, src, dst, err := parseProxyHeader([]byte("PROXY TCP4 10.0.0.1 10.0.0.2 5000 80\r\nping"))
+		assert.Nil(t, err)
+		assert.Equal(t, 38, n)
+		assert.Equal(t, "10.0.0.1:5000", src)
+		assert.Equal(t, "10.0.0.2:80", dst)
+		n, src, _, err = parseProxyHeader([]byte("PROXY TCP6 2001:db8::1 ::1 5000 80\r\n"))
+		assert.Nil(t, err)
+		assert.Equal(t, "[2001:db8::1]:5000", src)
+		n, src, _, err = parseProxyHeader([]byte("PROXY UNKNOWN ffff::1 ::1 5000 80\r\n"))
+		assert.Nil(t, err)
+		assert.Equal(t, 35, n)
+		assert.Equal(t, "", src)
+	})
+	t.Run("v2", func(t *testing.T) {
+		for _, hdr := range [][]byte{
+			proxyHeader(ProxyProtocolV2, "10.0.0.1:5000", "10.0.0.2:80"),
+			proxyHeader(ProxyProtocolV2, "[2001:db8::1]:5000", "[::1]:80"),
+		} {
+			n, src, dst, err := parseProxyHeader(append(hdr, "ping"...))
+			assert.Nil(t, err)
+			assert.Equal(t, len(hdr), n)
+			host, _, _ := net.SplitHostPort(src)
+			assert.Contains(t, []string{"10.0.0.1", "2001:db8::1"}, host)
+			assert.Contains(t, []string{"10.0.0.2:80", "[::1]:80"}, dst)
+		}
+		n, src, _, err := parseProxyHeader(proxyHeader(ProxyProtocolV2, "", ""))
+		assert.Nil(t, err)
+		assert.Equal(t, 16, n)
+		assert.Equal(t, "", src, "LOCAL使用socket的地址")
+	})
+	t.Run("不完整", func(t *testing.T) {
+		for _, b := range []string{"PRO", "PROXY TCP4 10.0.0.1", string(proxyV2Sig[:5]),
+			string(proxyHeader(ProxyProtocolV2, "10.0.0.1:5000", "10.0.0.2:80")[:20])} {
+			_, _, _, err := parseProxyHeader([]byte(b))
+			assert.Equal(t, errProxyHeaderIncomplete, err, b)
+		}
+	})
+	t.Run("非法", func(t *testing.T) {
+		long := append([]byte("PROXY TCP4 "), make([]byte, 120)...)
+		for _, b := range [][]byte{[]byte("GET / HTTP/1.1\r\n"), []byte("PROXY TCP4 x 10.0.0.2 5000 80\r\n"),
+			[]byte("PROXY TCP4 10.0.0.1 10.0.0.2 70000 80\r\n"), []byte("PROXY UDP4 1 2 3\r\n"), long,
+			append(append([]byte{}, proxyV2Sig...), 0x21, 0x11, 0xff, 0xff)} {
+			_, _, _, err := parseProxyHeader(b)
+			assert.Equal(t, errBadProxyHeader, err, string(b))
+		}
+	})
+}
+
+func TestAcceptProxyProtocol(t *testing.T) {
+	// 转发时再发送v1协议头, 回显的协议头中是负载均衡器告诉代理的客户端地址
+	addr := startRelayService(t, "127.0.0.1:0", echoServer(t), &PortProxy{AcceptProxyProtocol: true, ProxyProtocol: ProxyProtocolV1})
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 192.0.2.7 198.51.100.1 4000 443\r\nping"))
+	want := "PROXY TCP4 192.0.2.7 198.51.100.1 4000 443\r\nping"
+	got := make([]byte, len(want))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, got)
+	assert.Nil(t, err)
+	assert.Equal(t, want, string(got))
+
+	t.Run("没有协议头", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(make([]byte, 16))
+		assert.Equal(t, 0, n)
+		assert.NotNil(t, err)
+	})
+}
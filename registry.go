@@ -0,0 +1,322 @@
+package gproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// 注册表中服务的变化
+const (
+	EventAdd    = "add"    // 注册了新的服务
+	EventUpdate = "update" // 重新注册, 服务的配置改变
+	EventRemove = "remove" // 删除服务
+	EventStart  = "start"  // 开始转发
+	EventStop   = "stop"   // 停止转发
+)
+
+const (
+	maxRegistryHistory = 1024 // 保留最近的事件数, 更早的事件不能再Watch
+	registryWatchBuf   = 64
+)
+
+var (
+	ErrCompacted = errors.New("registry: revision compacted")
+	errNoService = errors.New("registry: service not found")
+	errRunning   = errors.New("registry: service is forwarding")
+	errStarting  = errors.New("registry: service is starting")
+	errNotSaved  = errors.New("registry: change not saved")
+)
+
+// RegistryEvent 一次变化, Revision从1开始每次变化加1
+type RegistryEvent struct {
+	Revision uint64
+	Type     string
+	Name     string
+	Proxy    *PortProxy // 变化之后服务配置的副本, remove时是删除之前的配置
+	Addr     string     // start时代理侦听客户端的地址
+}
+
+// registryEntry 服务和它的转发状态, done不为nil时正在转发, addr为空时还在开始转发
+type registryEntry struct {
+	proxy *PortProxy
+	done  chan struct{}
+	addr  string
+}
+
+// Registry 按服务名保存服务, 每次修改的版本号加1并记录事件。监控等通过Watch订阅变化, 不直接访问服务。
+// 所有修改都持有wmtx, 修改内存中的服务时再持有mtx; 服务配置的变化先用save保存到磁盘,
+// fsync时只持有wmtx, 不阻塞evPoll中的Get
+type Registry struct {
+	wmtx     sync.Mutex
+	save     func(typ, name string, proxy *PortProxy) error // 不为nil时在配置变化生效之前调用, 失败时不修改
+	mtx      sync.Mutex
+	services map[string]*registryEntry
+	rev      uint64
+	history  []RegistryEvent // 最近的事件, 按版本号递增
+	changed  chan struct{}   // 有新事件时关闭并换一个新的
+}
+
+func newRegistry() *Registry {
+	return &Registry{
+		services: make(map[string]*registryEntry),
+		changed:  make(chan struct{}),
+	}
+}
+
+// load 加载保存的服务, 不产生事件
+func (r *Registry) load(dic map[string]*PortProxy) {
+	r.wmtx.Lock()
+	defer r.wmtx.Unlock()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for name, proxy := range dic {
+		r.services[name] = &registryEntry{proxy: proxy}
+	}
+}
+
+// emitLocked 记录一个事件并唤醒Watch, 返回新的版本号
+func (r *Registry) emitLocked(typ, name string, e *registryEntry) uint64 {
+	r.rev++
+	cp := *e.proxy
+	r.history = append(r.history, RegistryEvent{Revision: r.rev, Type: typ, Name: name, Proxy: &cp, Addr: e.addr})
+	if len(r.history) > maxRegistryHistory {
+		r.history = append(r.history[:0:0], r.history[len(r.history)-maxRegistryHistory/2:]...)
+	}
+	close(r.changed)
+	r.changed = make(chan struct{})
+	return r.rev
+}
+
+// put 新增服务或者替换它的配置, 正在转发的服务不能修改。
+// check不为nil时先用已有的服务(没有时为nil)检查是否可以修改
+func (r *Registry) put(name string, proxy *PortProxy, check func(old *PortProxy) error) (uint64, error) {
+	r.wmtx.Lock()
+	defer r.wmtx.Unlock()
+	r.mtx.Lock()
+	e, ok := r.services[name]
+	var old *PortProxy
+	if ok {
+		old = e.proxy
+	}
+	var err error
+	if check != nil {
+		err = check(old)
+	}
+	if err == nil && ok && e.done != nil {
+		err = errRunning
+	}
+	rev := r.rev
+	r.mtx.Unlock()
+	if err != nil {
+		return rev, err
+	}
+	typ := EventAdd
+	if ok {
+		typ = EventUpdate
+	}
+	if err := r.saveLocked(typ, name, proxy); err != nil {
+		return rev, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if !ok {
+		e = &registryEntry{proxy: proxy}
+		r.services[name] = e
+	} else {
+		e.proxy = proxy // 之前的连接还使用旧的配置
+	}
+	return r.emitLocked(typ, name, e), nil
+}
+
+// Remove 删除没有在转发的服务
+func (r *Registry) Remove(name string) (uint64, error) {
+	r.wmtx.Lock()
+	defer r.wmtx.Unlock()
+	r.mtx.Lock()
+	e, ok := r.services[name]
+	rev := r.rev
+	r.mtx.Unlock()
+	if !ok {
+		return rev, errNoService
+	}
+	if e.done != nil {
+		return rev, errRunning
+	}
+	if err := r.saveLocked(EventRemove, name, nil); err != nil {
+		return rev, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	delete(r.services, name)
+	return r.emitLocked(EventRemove, name, e), nil
+}
+
+// saveLocked 持有wmtx时保存一次配置变化, 保存的是副本
+func (r *Registry) saveLocked(typ, name string, proxy *PortProxy) error {
+	if r.save == nil {
+		return nil
+	}
+	var cp *PortProxy
+	if proxy != nil {
+		c := *proxy
+		cp = &c
+	}
+	if err := r.save(typ, name, cp); err != nil {
+		return fmt.Errorf("%w: %s %s: %v", errNotSaved, typ, name, err)
+	}
+	return nil
+}
+
+// begin 准备开始转发, 返回服务配置的副本和停止转发时关闭的channel, 侦听时可以修改这个副本。
+// 已经在转发时返回errRunning和侦听的地址
+func (r *Registry) begin(name string) (proxy *PortProxy, done chan struct{}, addr string, err error) {
+	r.wmtx.Lock()
+	defer r.wmtx.Unlock()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	e, ok := r.services[name]
+	if !ok {
+		return nil, nil, "", errNoService
+	}
+	if e.done != nil {
+		if e.addr == "" {
+			return nil, nil, "", errStarting
+		}
+		return nil, nil, e.addr, errRunning
+	}
+	e.done = make(chan struct{})
+	cp := *e.proxy
+	return &cp, e.done, "", nil
+}
+
+// commit 开始侦听之后记录地址, addr为空表示侦听失败
+func (r *Registry) commit(name string, done chan struct{}, addr string) (uint64, error) {
+	r.wmtx.Lock()
+	defer r.wmtx.Unlock()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	e, ok := r.services[name]
+	if !ok || e.done != done {
+		return r.rev, errNoService
+	}
+	if addr == "" {
+		close(done)
+		e.done = nil
+		return r.rev, nil
+	}
+	e.addr = addr
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		cp := *e.proxy // Get等返回的副本可能还在使用, 不修改已有的配置
+		cp.lcp, _ = strconv.Atoi(port)
+		e.proxy = &cp
+	}
+	return r.emitLocked(EventStart, name, e), nil
+}
+
+// stop 停止转发, 没有在转发时返回false
+func (r *Registry) stop(name string) (uint64, bool) {
+	r.wmtx.Lock()
+	defer r.wmtx.Unlock()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	e, ok := r.services[name]
+	if !ok || e.done == nil || e.addr == "" {
+		return r.rev, false
+	}
+	close(e.done)
+	e.done, e.addr = nil, ""
+	return r.emitLocked(EventStop, name, e), true
+}
+
+// Get 返回服务配置的副本, 在evPoll中使用时不受之后重新注册的影响
+func (r *Registry) Get(name string) (*PortProxy, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	e, ok := r.services[name]
+	if !ok {
+		return nil, false
+	}
+	cp := *e.proxy
+	return &cp, true
+}
+
+// Revision 当前的版本号
+func (r *Registry) Revision() uint64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.rev
+}
+
+// Snapshot 所有服务配置的副本和对应的版本号, 之后可以从这个版本Watch
+func (r *Registry) Snapshot() (map[string]*PortProxy, uint64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	dic := make(map[string]*PortProxy, len(r.services))
+	for name, e := range r.services {
+		cp := *e.proxy
+		dic[name] = &cp
+	}
+	return dic, r.rev
+}
+
+// sinceLocked 版本号大于rev的事件, 其中一部分已经不在history中时返回false
+func (r *Registry) sinceLocked(rev uint64) ([]RegistryEvent, bool) {
+	if rev >= r.rev {
+		return nil, true
+	}
+	first := r.rev - uint64(len(r.history)) + 1
+	if rev+1 < first {
+		return nil, false
+	}
+	return append([]RegistryEvent(nil), r.history[rev+1-first:]...), true
+}
+
+// Watch 按顺序返回版本号大于fromRevision的事件, 直到ctx结束。
+// fromRevision之后的事件已经被丢弃时返回ErrCompacted; 读得太慢落后超过保留的事件数时关闭channel,
+// 调用方需要重新Snapshot再Watch
+func (r *Registry) Watch(ctx context.Context, fromRevision uint64) (<-chan RegistryEvent, error) {
+	r.mtx.Lock()
+	if _, ok := r.sinceLocked(fromRevision); !ok {
+		r.mtx.Unlock()
+		return nil, ErrCompacted
+	}
+	r.mtx.Unlock()
+
+	ch := make(chan RegistryEvent, registryWatchBuf)
+	go func() {
+		defer close(ch)
+		next := fromRevision
+		for {
+			r.mtx.Lock()
+			events, ok := r.sinceLocked(next)
+			changed := r.changed
+			r.mtx.Unlock()
+			if !ok {
+				return
+			}
+			for _, ev := range events {
+				select {
+				case ch <- ev:
+					next = ev.Revision
+				case <-ctx.Done():
+					return
+				}
+			}
+			if len(events) > 0 {
+				continue
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,208 @@
+package gproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func nextEvent(t *testing.T, events <-chan RegistryEvent) RegistryEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("watch closed")
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	return RegistryEvent{}
+}
+
+func TestRegistry(t *testing.T) {
+	backend := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("每次修改版本号加1", func(t *testing.T) {
+		r := newRegistry()
+		events, err := r.Watch(ctx, 0)
+		assert.Nil(t, err)
+
+		rev, err := r.put("a", NewPortProxy(backend), nil)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(1), rev)
+		rev, _ = r.put("a", NewPortProxy(backend), nil)
+		assert.Equal(t, uint64(2), rev)
+
+		proxy, done, _, err := r.begin("a")
+		assert.Nil(t, err)
+		proxy.lcp = 1
+		cur, _ := r.Get("a")
+		assert.Equal(t, 0, cur.lcp, "begin返回副本")
+		_, _, _, err = r.begin("a")
+		assert.Equal(t, errStarting, err, "还没有开始侦听")
+		r.commit("a", done, "127.0.0.1:33400")
+		_, _, addr, err := r.begin("a")
+		assert.Equal(t, errRunning, err)
+		assert.Equal(t, "127.0.0.1:33400", addr)
+		_, err = r.put("a", NewPortProxy(backend), nil)
+		assert.Equal(t, errRunning, err, "正在转发时不能修改")
+		_, err = r.Remove("a")
+		assert.Equal(t, errRunning, err)
+
+		_, ok := r.stop("a")
+		assert.True(t, ok)
+		_, ok = <-done
+		assert.False(t, ok, "停止转发时关闭done")
+		_, err = r.Remove("a")
+		assert.Nil(t, err)
+		_, ok = r.Get("a")
+		assert.False(t, ok)
+		assert.Equal(t, uint64(5), r.Revision())
+
+		want := []string{EventAdd, EventUpdate, EventStart, EventStop, EventRemove}
+		for i, typ := range want {
+			ev := nextEvent(t, events)
+			assert.Equal(t, uint64(i+1), ev.Revision)
+			assert.Equal(t, typ, ev.Type)
+			assert.Equal(t, "a", ev.Name)
+			if typ == EventStart {
+				assert.Equal(t, "127.0.0.1:33400", ev.Addr)
+				assert.Equal(t, 33400, ev.Proxy.lcp)
+			}
+		}
+	})
+
+	t.Run("侦听失败", func(t *testing.T) {
+		r := newRegistry()
+		r.put("a", NewPortProxy(backend), nil)
+		_, done, _, _ := r.begin("a")
+		rev, _ := r.commit("a", done, "")
+		assert.Equal(t, uint64(1), rev, "没有事件")
+		_, _, _, err := r.begin("a")
+		assert.Nil(t, err, "可以重新开始")
+	})
+
+	t.Run("保存失败时不修改", func(t *testing.T) {
+		r := newRegistry()
+		var saved []string
+		fail := false
+		r.save = func(typ, name string, proxy *PortProxy) error {
+			if fail {
+				return errors.New("disk full")
+			}
+			saved = append(saved, typ+" "+name)
+			return nil
+		}
+		r.put("a", NewPortProxy(backend), nil)
+		r.put("a", NewPortProxy(backend), nil)
+		fail = true
+		_, err := r.put("b", NewPortProxy(backend), nil)
+		assert.ErrorIs(t, err, errNotSaved)
+		_, err = r.Remove("a")
+		assert.ErrorIs(t, err, errNotSaved)
+		_, ok := r.Get("b")
+		assert.False(t, ok)
+		_, ok = r.Get("a")
+		assert.True(t, ok)
+		assert.Equal(t, uint64(2), r.Revision())
+		assert.Equal(t, []string{"add a", "update a"}, saved)
+	})
+
+	t.Run("从指定的版本开始", func(t *testing.T) {
+		r := newRegistry()
+		for _, name := range []string{"a", "b", "c"} {
+			r.put(name, NewPortProxy(backend), nil)
+		}
+		dic, rev := r.Snapshot()
+		assert.Len(t, dic, 3)
+		events, err := r.Watch(ctx, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, "b", nextEvent(t, events).Name)
+		assert.Equal(t, "c", nextEvent(t, events).Name)
+
+		events, _ = r.Watch(ctx, rev)
+		r.put("d", NewPortProxy(backend), nil)
+		ev := nextEvent(t, events)
+		assert.Equal(t, rev+1, ev.Revision)
+		assert.Equal(t, "d", ev.Name)
+	})
+
+	t.Run("事件已经被丢弃", func(t *testing.T) {
+		r := newRegistry()
+		for i := 0; i <= maxRegistryHistory; i++ {
+			r.put("a", NewPortProxy(backend), nil)
+		}
+		_, err := r.Watch(ctx, 0)
+		assert.Equal(t, ErrCompacted, err)
+		_, err = r.Watch(ctx, r.Revision()-1)
+		assert.Nil(t, err)
+	})
+
+	t.Run("ctx结束时关闭", func(t *testing.T) {
+		r := newRegistry()
+		ctx, cancel := context.WithCancel(ctx)
+		events, _ := r.Watch(ctx, 0)
+		cancel()
+		select {
+		case _, ok := <-events:
+			assert.False(t, ok)
+		case <-time.After(time.Second):
+			t.Fatal("watch not closed")
+		}
+	})
+}
+
+func TestAddProxy(t *testing.T) {
+	backend := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	p := &ProxyServer{registry: newRegistry(), tunnels: &tunnelHub{}, muxes: &muxPool{}}
+	entry := &PortProxy{
+		Server:              backend,
+		Backends:            []*net.TCPAddr{backend},
+		Balance:             BalanceLeastConn,
+		Relay:               RelaySplice,
+		Linger:              1,
+		IdleTimeout:         2,
+		MaxLifetime:         3,
+		Health:              &HealthCheck{Interval: 1},
+		TLS:                 &TLSConfig{},
+		ProxyProtocol:       ProxyProtocolV2,
+		AcceptProxyProtocol: true,
+		Hostname:            "a.example.com",
+		PathPrefix:          "/a",
+		Tunnel:              "t",
+		Mux:                 "m",
+		lcp:                 33333,
+		hsSlots:             newHandshakeSlots(1),
+	}
+	assert.Nil(t, p.addProxy("a", entry, nil))
+	got, ok := p.registry.Get("a")
+	if !assert.True(t, ok) {
+		return
+	}
+
+	t.Run("复制所有的配置", func(t *testing.T) {
+		v, want := reflect.ValueOf(got).Elem(), reflect.ValueOf(entry).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Type().Field(i); f.IsExported() {
+				assert.False(t, want.Field(i).IsZero(), "测试中没有设置"+f.Name)
+				assert.Equal(t, want.Field(i).Interface(), v.Field(i).Interface(), f.Name)
+			}
+		}
+	})
+	t.Run("运行时的字段重新设置", func(t *testing.T) {
+		assert.NotSame(t, entry, got)
+		assert.Zero(t, got.lcp)
+		assert.Nil(t, got.hsSlots)
+		assert.NotSame(t, entry.lb, got.lb)
+		assert.Same(t, p.tunnels, got.hub)
+		assert.Same(t, p.muxes, got.muxes)
+	})
+}
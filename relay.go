@@ -0,0 +1,581 @@
+package gproxy
+
+import (
+	"errors"
+	"fmt"
+	epio "g-proxy/epio"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	// 对端待写队列超过outHighWater时暂停读取源fd, 降到outLowWater以下再恢复
+	outHighWater = 1024 * 1024
+	outLowWater  = 256 * 1024
+
+	// splice模式下每个方向使用的管道大小
+	splicePipeSize = 256 * 1024
+
+	// 一个方向半关闭后, 等待另一个方向结束的默认时间(毫秒)
+	defaultHalfCloseLinger = 60 * 1000
+
+	// 主动读取TLS连接中缓存的数据时使用的缓冲区大小, 一个TLS记录最大16KB
+	tlsPumpBuffSize = 16 * 1024
+)
+
+// 服务的转发方式
+const (
+	RelayCopy   = "copy"   // 默认, 经过evPoll的共享缓冲区read/write
+	RelaySplice = "splice" // 通过管道splice(2), 数据不经过用户态
+)
+
+var errSpliceUnsupported = errors.New("splice unsupported")
+
+// 代理对关闭的原因
+const (
+	closeByPeer        = "closed"           // 两个方向都结束或者读写出错
+	closeByLinger      = "linger timeout"   // 半关闭之后另一个方向迟迟不结束
+	closeByIdle        = "idle timeout"     // 两个方向都没有数据
+	closeByLifetime    = "lifetime timeout" // 超过最长存活时间
+	closeByNoServer    = "no backend"       // 没有可用的后端或者重试次数用完
+	closeByTLS         = "tls handshake"    // 客户端TLS握手失败
+	closeBySNI         = "sni route"        // 共享端口上没有读到ClientHello或者没有匹配的服务
+	closeByHTTP        = "http route"       // HTTP端口上没有读到请求头或者没有匹配的服务
+	closeBySOCKS       = "socks handshake"  // SOCKS5握手失败或者没有对应的服务
+	closeByCONNECT     = "http connect"     // CONNECT请求认证失败或者没有对应的服务
+	closeByProxyHeader = "proxy protocol"   // 没有读到合法的PROXY协议头
+)
+
+// session 一对endpoint共用的超时设置和状态, 定时器注册在ProxyC上
+type session struct {
+	idle       int64        // 空闲超时毫秒数, 0不限制
+	lifetime   int64        // 最长存活毫秒数, 0不限制
+	lastActive atomic.Int64 // 最后一次读到数据的时间
+	idleTimer  *epio.Timer
+	lifeTimer  *epio.Timer
+	reason     string // 关闭的原因
+	client     string // 客户端地址, 关闭时记录在日志中
+	lb         *balancer
+	backend    int // 正在使用的后端, 代理对关闭时减少它的连接数, -1表示没有
+}
+
+// endpoint 是ProxyC/ProxyS共用的部分, 保存发往本fd但还没写出去的数据,
+// 并根据读写状态维护fd在epoll中关注的事件。
+// 一对endpoint共用同一把锁, 两个方向的读写可能在不同的evPoll中进行
+type endpoint struct {
+	epio.Event
+	h         epio.EvHandler // 外层的ProxyC/ProxyS, 注册到reactor中的是它
+	peer      *endpoint
+	mtx       *sync.Mutex
+	closeOnce *sync.Once
+	sess      *session
+
+	out []byte // 发往本fd的待写数据
+
+	// splice模式下发往本fd的数据先进入管道, pipeR == -1 表示使用out
+	pipeR, pipeW int
+	pipeCap      int
+	piped        int // 管道中还没写出去的字节数
+
+	reading bool // 是否关注EvIn, 对端队列积压或本fd读到EOF后为false
+	writing bool // 是否关注EPOLLOUT, 有待写数据时为true
+	polled  bool // fd是否在epoll中, 两个方向都结束的fd要移出epoll, 否则EPOLLHUP会关闭整个代理对; 移出后仍留在Reactor中, Stop时会关闭
+	eof     bool // 对端fd已读到EOF, 待写数据写完后关闭本fd的写方向
+	wrShut  bool // 已经shutdown(SHUT_WR)
+	closed  bool // 代理对已关闭, 之后connect成功的fd直接关闭
+
+	linger      int64       // 半关闭后等待另一个方向结束的毫秒数
+	lingerTimer *epio.Timer // 代理对关闭时取消, 两个endpoint中只有一个会设置
+
+	tls *tlsStream // 在本fd上终结TLS, 读到的数据先解密, 发往本fd的数据先加密
+}
+
+func newEndpointPair(a *endpoint, ah epio.EvHandler, b *endpoint, bh epio.EvHandler) {
+	mtx := &sync.Mutex{}
+	once := &sync.Once{}
+	sess := &session{backend: -1}
+	a.h, a.peer, a.mtx, a.closeOnce, a.sess = ah, b, mtx, once, sess
+	b.h, b.peer, b.mtx, b.closeOnce, b.sess = bh, a, mtx, once, sess
+	a.pipeR, a.pipeW = -1, -1
+	b.pipeR, b.pipeW = -1, -1
+	a.SetFd(-1)
+	b.SetFd(-1)
+}
+
+// usePipe 为发往本fd的数据创建splice管道, 失败时仍然使用拷贝的方式
+func (e *endpoint) usePipe() {
+	r, w, capacity, err := epio.Pipe(splicePipeSize)
+	if err != nil {
+		fmt.Println("splice fallback to copy: ", err.Error())
+		return
+	}
+	e.pipeR, e.pipeW, e.pipeCap = r, w, capacity
+}
+
+// dropPipe 关闭管道, 调用者持有锁
+func (e *endpoint) dropPipe() {
+	if e.pipeR != -1 {
+		epio.Close(e.pipeR)
+		epio.Close(e.pipeW)
+		e.pipeR, e.pipeW, e.piped = -1, -1, 0
+	}
+}
+
+// pending 待写数据的字节数, 调用者持有锁
+func (e *endpoint) pending() int {
+	return len(e.out) + e.piped
+}
+
+// belowLowWater 待写数据降到低水位以下, 可以恢复对端的读取。调用者持有锁
+func (e *endpoint) belowLowWater() bool {
+	if e.pipeR != -1 {
+		return e.piped <= e.pipeCap/2
+	}
+	return len(e.out) <= outLowWater
+}
+
+// open 将fd注册到reactor中, 开始读取。
+// 连接建立之前对端读到的数据已经在待写队列中了, 同时关注EPOLLOUT把它们写出去,
+// 因为等待连接而暂停读取的对端也在这里恢复
+func (e *endpoint) open(fd int) bool {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.closed { // OnClose不会再处理这个fd
+		epio.Close(fd)
+		return false
+	}
+	e.reading = true
+	e.writing = e.pending() > 0
+	if err := e.GetReactor().AddEvHandler(e.h, fd, e.events()); err != nil {
+		return false
+	}
+	e.SetFd(fd)
+	e.polled = true
+	if e.eof && !e.writing { // 连接建立之前对端已经关闭了写方向
+		e.shutdownWrite()
+	}
+	if e.belowLowWater() && !e.peer.reading && !e.eof && e.peer.GetFd() != -1 {
+		e.peer.resumeRead()
+	}
+	return true
+}
+
+// startTimers 开始计算空闲超时和最长存活时间, 在客户端连接注册之后调用
+func (e *endpoint) startTimers(now int64) {
+	e.sess.lastActive.Store(now)
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.closed {
+		return
+	}
+	if e.sess.idle > 0 {
+		e.sess.idleTimer, _ = e.GetReactor().ScheduleTimer(e.h, e.sess.idle, 0)
+	}
+	if e.sess.lifetime > 0 {
+		e.sess.lifeTimer, _ = e.GetReactor().ScheduleTimer(e.h, e.sess.lifetime, 0)
+	}
+}
+
+// touch 记录读到数据的时间, 空闲定时器到期时据此判断是否真的空闲
+func (e *endpoint) touch(now int64) {
+	if e.sess.idle > 0 {
+		e.sess.lastActive.Store(now)
+	}
+}
+
+// events 根据读写状态计算关注的事件, 调用者持有锁
+//
+// 不关注EvIn时同时去掉EPOLLRDHUP, 否则对端关闭写之后水平触发会一直唤醒evPoll
+func (e *endpoint) events() uint32 {
+	var ev uint32
+	if e.reading {
+		ev |= epio.EvIn
+	}
+	if e.writing {
+		ev |= syscall.EPOLLOUT
+	}
+	return ev
+}
+
+// updateEvents 调用者持有锁
+//
+// 写方向已关闭的fd不再关注任何事件时移出epoll, 对端也关闭之后才不会因为EPOLLHUP被关闭,
+// 暂停读取的数据和另一个方向的待写数据都还要保留
+func (e *endpoint) updateEvents() {
+	fd := e.GetFd()
+	if fd == -1 {
+		return
+	}
+	ev := e.events()
+	switch {
+	case ev == 0 && e.wrShut:
+		if e.polled {
+			e.GetReactor().ParkEvHandler(e.h, fd)
+			e.polled = false
+		}
+	case !e.polled:
+		if e.GetReactor().AddEvHandler(e.h, fd, ev) == nil {
+			e.polled = true
+		}
+	default:
+		e.GetReactor().ModifyEvHandler(e.h, fd, ev)
+	}
+}
+
+// resumeRead 恢复读取, 调用者持有锁。
+// TLS连接中可能还有已经从socket读出来但没有解密的数据, 不会再触发EvIn, 需要主动读一次
+func (e *endpoint) resumeRead() {
+	e.reading = true
+	e.updateEvents()
+	if e.tls != nil {
+		e.pumpTLS()
+	}
+}
+
+// pumpTLS 在evPoll中读取TLS连接里缓存的数据
+func (e *endpoint) pumpTLS() {
+	e.GetReactor().Post(e.h, func() {
+		e.mtx.Lock()
+		reading := e.reading && !e.closed
+		e.mtx.Unlock()
+		if reading && !e.relayTLS(make([]byte, tlsPumpBuffSize)) {
+			e.close(e.GetFd())
+		}
+	})
+}
+
+// pauseRead 暂停读取, 调用者持有锁
+func (e *endpoint) pauseRead() {
+	if e.reading {
+		e.reading = false
+		e.updateEvents()
+	}
+}
+
+// relay 从fd中读取数据发往对端, 对端积压过多时暂停读取
+func (e *endpoint) relay(fd int, buf []byte) bool {
+	if e.tls != nil {
+		return e.relayTLS(buf)
+	}
+	if e.peer.pipeR != -1 {
+		return e.relaySplice(fd, buf)
+	}
+	for {
+		n, err := epio.Read(fd, buf)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				break
+			}
+			fmt.Println("read: ", err.Error())
+			return false
+		}
+		if n == 0 { // connection closed,  will not < 0
+			return e.onEOF()
+		}
+		paused, err := e.peer.send(buf[:n])
+		if err != nil {
+			fmt.Println("write: ", err.Error())
+			return false
+		}
+		if paused {
+			break
+		}
+	}
+	return true
+}
+
+// relaySplice 通过对端的管道把fd中的数据搬到对端, 不支持splice时退回拷贝方式
+func (e *endpoint) relaySplice(fd int, buf []byte) bool {
+	for {
+		n, paused, err := e.peer.spliceFrom(fd)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				break
+			}
+			if err == errSpliceUnsupported {
+				return e.relay(fd, buf)
+			}
+			fmt.Println("splice: ", err.Error())
+			return false
+		}
+		if paused {
+			break
+		}
+		if n == 0 {
+			return e.onEOF()
+		}
+	}
+	return true
+}
+
+// relayTLS 解密fd中的数据发往对端, 握手之后的消息(比如KeyUpdate)产生的回复直接写回fd。
+// 取出密文和放入待写队列在同一次加锁中, 和send中的加密一样, 不会打乱两边TLS记录的顺序
+func (e *endpoint) relayTLS(buf []byte) bool {
+	defer func() {
+		e.mtx.Lock()
+		if out := e.tls.takeOut(); len(out) > 0 {
+			e.sendLocked(out)
+		}
+		e.mtx.Unlock()
+	}()
+	for {
+		n, err := e.tls.conn.Read(buf)
+		if n > 0 {
+			paused, err := e.peer.send(buf[:n])
+			if err != nil {
+				fmt.Println("write: ", err.Error())
+				return false
+			}
+			if paused {
+				break
+			}
+		}
+		if err != nil {
+			if err == errWouldBlock {
+				break
+			}
+			if err == io.EOF { // close_notify或者在记录的边界上关闭
+				return e.onEOF()
+			}
+			fmt.Println("tls read: ", err.Error())
+			return false
+		}
+	}
+	return true
+}
+
+// send 将data写入本fd, 写不完的部分放入待写队列并关注EPOLLOUT。
+// 本fd还在连接中时全部放入队列, 等open之后再写。
+// 队列超过高水位时暂停对端的读取, 返回true
+func (e *endpoint) send(data []byte) (paused bool, err error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.tls != nil {
+		if data, err = e.tls.seal(data); err != nil {
+			return false, err
+		}
+	}
+	return e.sendLocked(data)
+}
+
+// sendLocked 与send相同, 不再加密。调用者持有锁
+func (e *endpoint) sendLocked(data []byte) (paused bool, err error) {
+	if e.GetFd() != -1 && len(e.out) == 0 {
+		n, err := epio.Write(e.GetFd(), data)
+		if err != nil && err != syscall.EAGAIN {
+			return false, err
+		}
+		if n > 0 {
+			data = data[n:]
+		}
+		if len(data) == 0 {
+			return false, nil
+		}
+	}
+	e.out = append(e.out, data...)
+	if !e.writing && e.GetFd() != -1 {
+		e.writing = true
+		e.updateEvents()
+	}
+	if len(e.out) > outHighWater {
+		e.peer.pauseRead()
+	}
+	return !e.peer.reading, nil
+}
+
+// spliceFrom 把源fd中的数据splice到本端的管道, 再尽量从管道写到本fd。
+// 管道满了暂停对端的读取, 返回paused = true
+func (e *endpoint) spliceFrom(src int) (n int, paused bool, err error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.pipeR == -1 { // 已经退回拷贝方式
+		return 0, false, errSpliceUnsupported
+	}
+	if e.piped >= e.pipeCap {
+		e.peer.pauseRead()
+		return 0, true, nil
+	}
+	n, err = epio.Splice(src, e.pipeW, e.pipeCap-e.piped)
+	if err != nil {
+		if err == syscall.EINVAL && e.piped == 0 {
+			e.dropPipe()
+			return 0, false, errSpliceUnsupported
+		}
+		// 管道按页计数, 字节数没满也可能写不进去, 等管道写出一部分再读
+		if err == syscall.EAGAIN && e.piped > 0 && epio.ReadableBytes(src) > 0 {
+			e.peer.pauseRead()
+			return 0, true, nil
+		}
+		return 0, false, err
+	}
+	if n == 0 {
+		return 0, false, nil
+	}
+	e.piped += n
+	if fd := e.GetFd(); fd != -1 && len(e.out) == 0 { // 队列中的数据在管道之前
+		if err = e.drainPipe(fd); err != nil {
+			return n, false, err
+		}
+		if e.piped > 0 && !e.writing {
+			e.writing = true
+			e.updateEvents()
+		}
+	}
+	return n, false, nil
+}
+
+// drainPipe 把管道中的数据写到fd, 调用者持有锁
+func (e *endpoint) drainPipe(fd int) error {
+	for e.piped > 0 {
+		n, err := epio.Splice(e.pipeR, fd, e.piped)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				return nil
+			}
+			return err
+		}
+		e.piped -= n
+	}
+	return nil
+}
+
+// flush 在fd可写时写出待写数据, 降到低水位后恢复对端的读取。
+// splice模式下队列中只有连接后端之前放进去的数据(PROXY协议头, 已经读到的ClientHello等), 要先于管道写出
+func (e *endpoint) flush(fd int) bool {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	for len(e.out) > 0 {
+		n, err := epio.Write(fd, e.out)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				break
+			}
+			fmt.Println("write: ", err.Error())
+			return false
+		}
+		e.out = e.out[n:]
+	}
+	if len(e.out) == 0 {
+		if err := e.drainPipe(fd); err != nil {
+			fmt.Println("splice: ", err.Error())
+			return false
+		}
+	}
+	if e.pending() == 0 {
+		e.out = nil // 释放积压时扩容的内存
+		e.writing = false
+		if e.eof {
+			if e.shutdownWrite() {
+				return false
+			}
+		} else {
+			e.updateEvents()
+		}
+	}
+	if e.belowLowWater() && !e.peer.reading && !e.eof {
+		e.peer.resumeRead()
+	}
+	return true
+}
+
+// onEOF 源fd读到EOF, 对端的待写数据写完后关闭对端的写方向, 另一个方向继续转发。
+// 两个方向都结束时返回false关闭代理对, 第一个方向结束时开始计算linger超时
+func (e *endpoint) onEOF() bool {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	first := !e.eof
+	if e.peer.tls != nil && !e.peer.eof {
+		e.peer.sendLocked(e.peer.tls.closeNotify())
+	}
+	e.peer.eof = true
+	e.reading = false
+	e.updateEvents()
+	if e.peer.GetFd() != -1 && e.peer.pending() == 0 && e.peer.shutdownWrite() {
+		return false
+	}
+	if first && e.linger > 0 {
+		e.lingerTimer, _ = e.GetReactor().ScheduleTimer(e.h, e.linger, 0)
+	}
+	return true
+}
+
+// shutdownWrite 待写数据已经写完, 把对端的EOF转发给本fd。调用者持有锁
+//
+// 返回两个方向是否都已结束
+func (e *endpoint) shutdownWrite() bool {
+	if !e.wrShut {
+		epio.ShutdownWrite(e.GetFd())
+		e.wrShut = true
+		e.updateEvents()
+	}
+	return e.wrShut && e.peer.wrShut
+}
+
+// onTimer 处理linger/空闲/存活时间定时器, 返回false时移除定时器
+//
+// 空闲定时器到期时如果期间读到过数据, 就按最后一次读到数据的时间重新计算
+func (e *endpoint) onTimer(t *epio.Timer, now int64) bool {
+	e.mtx.Lock()
+	if e.closed {
+		e.mtx.Unlock()
+		return false
+	}
+	var reason string
+	switch t {
+	case e.lingerTimer:
+		reason = closeByLinger
+	case e.sess.lifeTimer:
+		reason = closeByLifetime
+	case e.sess.idleTimer:
+		if elapsed := now - e.sess.lastActive.Load(); elapsed < e.sess.idle {
+			e.mtx.Unlock()
+			t.Reset(e.sess.idle - elapsed)
+			return true
+		}
+		reason = closeByIdle
+	default:
+		e.mtx.Unlock()
+		return false
+	}
+	e.sess.reason = reason
+	e.mtx.Unlock()
+	e.close(e.GetFd())
+	return false
+}
+
+// close 关闭一对fd和splice管道, 只会执行一次
+func (e *endpoint) close(fd int) {
+	e.closeOnce.Do(func() {
+		e.mtx.Lock()
+		e.polled, e.peer.polled = false, false
+		e.closed, e.peer.closed = true, true
+		e.dropPipe()
+		e.peer.dropPipe()
+		timers := []*epio.Timer{e.lingerTimer, e.peer.lingerTimer, e.sess.idleTimer, e.sess.lifeTimer}
+		if e.sess.reason == "" {
+			e.sess.reason = closeByPeer
+		}
+		reason := e.sess.reason
+		if e.sess.backend >= 0 {
+			e.sess.lb.release(e.sess.backend)
+			e.sess.backend = -1
+		}
+		e.mtx.Unlock()
+		if reason != closeByPeer {
+			fmt.Println("close session " + e.sess.client + ": " + reason)
+		}
+		for _, t := range timers {
+			if t != nil {
+				t.Cancel()
+			}
+		}
+		e.GetReactor().RemoveEvHandler(e.h, fd)
+		epio.Close(fd)
+		if peerFd := e.peer.GetFd(); peerFd != -1 {
+			e.peer.GetReactor().RemoveEvHandler(e.peer.h, peerFd)
+			epio.Close(peerFd)
+		}
+	})
+}
@@ -1,7 +1,9 @@
 package gproxy
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	epio "g-proxy/epio"
 	"g-proxy/utils"
@@ -9,6 +11,9 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const jsonContentType = "application/json"
@@ -22,7 +27,7 @@ var logger = log.Default()
 
 type ProxyServer struct {
 	http.Handler
-	proxyDict    map[string]*PortProxy
+	registry     *Registry
 	clientIP     string
 	serverIP     string
 	proxyMinPort int
@@ -32,11 +37,47 @@ type ProxyServer struct {
 	forNewFd     *epio.Reactor
 	connector    *epio.Connector
 	port         chan int
+	sni          *sniRouter
+	http         *httpRouter
+	tunnels      *tunnelHub
+	muxes        *muxPool
+	dataFile     string // 保存服务的文件, 为空时不保存
+	sniAddr      string // 共享TLS端口的侦听地址
+	httpAddr     string // HTTP端口的侦听地址
+	store        *store
+	storeMtx     sync.Mutex         // 保护store, 注册表保存修改和定时合并在不同的goroutine中
+	cancel       context.CancelFunc // 停止定时合并
+	persisted    chan struct{}      // 最后的快照写完时关闭
+}
+
+// Option 创建ProxyServer时的选项
+type Option func(*ProxyServer)
+
+// DataFile 保存注册的服务的文件, 默认/app/proxyEntry.json, 为空时不保存。
+// 同一个目录下还有path.journal日志文件
+func DataFile(path string) Option {
+	return func(p *ProxyServer) {
+		p.dataFile = path
+	}
+}
+
+// SNIAddr 共享TLS端口的侦听地址, 默认localIP:8443, 格式同epio.NewAcceptor
+func SNIAddr(addr string) Option {
+	return func(p *ProxyServer) {
+		p.sniAddr = addr
+	}
+}
+
+// HTTPAddr HTTP端口的侦听地址, 默认localIP:8080, 格式同epio.NewAcceptor
+func HTTPAddr(addr string) Option {
+	return func(p *ProxyServer) {
+		p.httpAddr = addr
+	}
 }
 
 // 根据名称和mode返回对应的地址
 func (p *ProxyServer) match(name, mode string) (dst *net.TCPAddr) {
-	proxyPair, ok := p.proxyDict[name]
+	proxyPair, ok := p.registry.Get(name)
 	if !ok {
 		return
 	}
@@ -44,31 +85,31 @@ func (p *ProxyServer) match(name, mode string) (dst *net.TCPAddr) {
 	if mode == "direct" {
 		dst = proxyPair.Server
 	} else {
-		dst.IP = net.ParseIP(p.clientIP)
-		dst.Port = proxyPair.lcp
+		dst = &net.TCPAddr{IP: net.ParseIP(p.clientIP), Port: proxyPair.lcp}
 	}
 	return
 }
 
 func (p *ProxyServer) Register(w http.ResponseWriter, r *http.Request) {
 	logger.Println("Register")
-	name, addr, err := getRegisterParams(r)
+	name, entry, err := getRegisterParams(r)
 	if err != nil {
 		logger.Printf("%v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	// 如果已经有正在进行的连接，则拒绝注册请求
-	if proxy, ok := p.proxyDict[name]; ok {
-		if proxy.Running() {
+	if err := p.addProxy(name, entry, nil); err != nil {
+		logger.Printf("%v", err)
+		if errors.Is(err, errNotSaved) {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else {
 			w.WriteHeader(http.StatusBadRequest)
-			return
 		}
+		return
 	}
-
-	p.addProxy(name, addr)
 	w.WriteHeader(http.StatusAccepted)
-	fmt.Printf("Register [%s]: %s\n", name, addr.String())
+	fmt.Printf("Register [%s]: %v\n", name, entry.Backends)
 }
 
 func (p *ProxyServer) Query(w http.ResponseWriter, r *http.Request) {
@@ -78,6 +119,16 @@ func (p *ProxyServer) Query(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if mode == "health" {
+		proxy, ok := p.registry.Get(name)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", jsonContentType)
+		json.NewEncoder(w).Encode(proxy.lb.status())
+		return
+	}
 	result_addr := p.match(name, mode)
 	json.NewEncoder(w).Encode(result_addr)
 	w.Header().Set("Content-Type", jsonContentType)
@@ -94,24 +145,46 @@ func (p *ProxyServer) Forwarding(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	proxy, ok := p.proxyDict[name]
-	if !ok {
+	proxy, done, addr, err := p.registry.begin(name)
+	switch err {
+	case nil:
+	case errNoService:
 		w.WriteHeader(http.StatusNotFound)
 		return
-	}
-
-	if proxy.Server == nil {
-		w.WriteHeader(http.StatusBadRequest)
+	case errRunning:
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(addr))
+		return
+	default: // 另一个请求正在开始转发
+		w.WriteHeader(http.StatusConflict)
 		return
 	}
-
-	if proxy.Running() {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(localIP + ":" + strconv.Itoa(proxy.lcp)))
+	// 协议不支持或者服务缺少对应的配置时listen为nil
+	var listen func(proxy *PortProxy, done <-chan struct{}) string
+	switch protocol := r.Form.Get("protocol"); {
+	case proxy.Server == nil:
+	case protocol == "", protocol == ProtocolTCP:
+		listen = p.tcpListen
+	case protocol == ProtocolUDP:
+		if proxy.Tunnel == "" && proxy.Mux == "" { // 反向隧道和多路复用只能转发TCP
+			listen = p.udpListen
+		}
+	case protocol == ProtocolSNI:
+		if proxy.Hostname != "" {
+			listen = p.sniListen
+		}
+	case protocol == ProtocolHTTP:
+		if proxy.Hostname != "" || proxy.PathPrefix != "" {
+			listen = p.httpListen
+		}
+	}
+	if listen == nil {
+		p.registry.commit(name, done, "")
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	proxy.done = make(chan struct{})
-	proxyAddr := p.tcpListen(name)
+	proxyAddr := listen(proxy, done)
+	p.registry.commit(name, done, proxyAddr)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(proxyAddr))
 }
@@ -120,27 +193,123 @@ func (p *ProxyServer) StopForwarding(w http.ResponseWriter, r *http.Request) {
 	logger.Println("Stop")
 	r.ParseForm()
 	name := r.Form.Get("name")
-	proxy := p.proxyDict[name]
-	if proxy != nil && proxy.Running() {
-		close(proxy.done)
-		proxy.done = nil
-	}
+	p.registry.stop(name)
 	w.WriteHeader(http.StatusOK)
 }
 
-func getRegisterParams(r *http.Request) (name string, addr *net.TCPAddr, err error) {
+func getRegisterParams(r *http.Request) (name string, entry *PortProxy, err error) {
 	r.ParseForm()
 	name = r.Form.Get("name")
-	host := r.Form.Get("host")
-	port, err := strconv.Atoi(r.Form.Get("port"))
+	// 多个后端时host和port按顺序成对出现
+	hosts, ports := r.Form["host"], r.Form["port"]
+	if len(hosts) == 0 || len(hosts) != len(ports) {
+		err = fmt.Errorf("host and port mismatch: %v %v", hosts, ports)
+		return
+	}
+	backends := make([]*net.TCPAddr, len(hosts))
+	for i := range hosts {
+		port, err := strconv.Atoi(ports[i])
+		if err != nil {
+			return name, nil, err
+		}
+		backends[i] = &net.TCPAddr{
+			IP:   net.ParseIP(hosts[i]),
+			Port: port,
+		}
+	}
 
-	addr = &net.TCPAddr{
-		IP:   net.ParseIP(host),
-		Port: port,
+	entry = NewPortProxy(backends[0])
+	entry.Backends = backends
+	switch balance := r.Form.Get("balance"); balance {
+	case "", BalanceRoundRobin:
+	case BalanceLeastConn, BalanceSource:
+		entry.Balance = balance
+	default:
+		err = fmt.Errorf("unknown balance: %s", balance)
+		return
+	}
+	switch relay := r.Form.Get("relay"); relay {
+	case "", RelayCopy:
+	case RelaySplice:
+		entry.Relay = relay
+	default:
+		err = fmt.Errorf("unknown relay mode: %s", relay)
+		return
+	}
+	if entry.Linger, err = getSeconds(r, "linger"); err != nil {
+		return
+	}
+	if entry.IdleTimeout, err = getSeconds(r, "idle_timeout"); err != nil {
+		return
+	}
+	if entry.MaxLifetime, err = getSeconds(r, "max_lifetime"); err != nil {
+		return
+	}
+	health := HealthCheck{Path: r.Form.Get("health_path")}
+	if health.Interval, err = getSeconds(r, "health_interval"); err != nil {
+		return
+	}
+	if health.Timeout, err = getSeconds(r, "health_timeout"); err != nil {
+		return
+	}
+	if health.Path != "" && health.Path[0] != '/' {
+		err = fmt.Errorf("invalid health_path: %s", health.Path)
+		return
+	}
+	if health.Interval > 0 {
+		entry.Health = &health
+	}
+	if cert, key := r.Form.Get("tls_cert"), r.Form.Get("tls_key"); cert != "" || key != "" {
+		entry.TLS = &TLSConfig{CertFile: cert, KeyFile: key}
+		if _, err = entry.TLS.load(); err != nil {
+			return
+		}
+	}
+	switch pp := r.Form.Get("proxy_protocol"); pp {
+	case "":
+	case ProxyProtocolV1, ProxyProtocolV2:
+		entry.ProxyProtocol = pp
+	default:
+		err = fmt.Errorf("unknown proxy_protocol: %s", pp)
+		return
+	}
+	if v := r.Form.Get("accept_proxy_protocol"); v != "" {
+		if entry.AcceptProxyProtocol, err = strconv.ParseBool(v); err != nil {
+			err = fmt.Errorf("invalid accept_proxy_protocol: %s", v)
+			return
+		}
+	}
+	if entry.Mux = r.Form.Get("mux"); strings.ContainsAny(entry.Mux, " ") {
+		err = fmt.Errorf("invalid mux: %s", entry.Mux)
+		return
+	}
+	if host := r.Form.Get("hostname"); host != "" {
+		entry.Hostname = normalizeHostname(host)
+		if strings.ContainsAny(entry.Hostname, ":/ ") {
+			err = fmt.Errorf("invalid hostname: %s", host)
+			return
+		}
+	}
+	if entry.PathPrefix = r.Form.Get("path_prefix"); entry.PathPrefix != "" && entry.PathPrefix[0] != '/' {
+		err = fmt.Errorf("invalid path_prefix: %s", entry.PathPrefix)
+		return
 	}
 	return
 }
 
+// getSeconds 读取非负的秒数参数, 没有时返回0
+func getSeconds(r *http.Request, key string) (int, error) {
+	v := r.Form.Get(key)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", key, v)
+	}
+	return n, nil
+}
+
 func getQueryParams(r *http.Request) (name string, mode string, err error) {
 	r.ParseForm()
 	name = r.Form.Get("name")
@@ -148,8 +317,14 @@ func getQueryParams(r *http.Request) (name string, mode string, err error) {
 	return
 }
 
-func NewProxyServer() *ProxyServer {
+func NewProxyServer(opts ...Option) *ProxyServer {
 	p := new(ProxyServer)
+	p.dataFile = defaultDataFile
+	p.sniAddr = localIP + ":" + strconv.Itoa(sniPort)
+	p.httpAddr = localIP + ":" + strconv.Itoa(httpPort)
+	for _, opt := range opts {
+		opt(p)
+	}
 	forAccept, err := epio.NewReactor(
 		epio.EvDataArrSize(100),
 		epio.EvPollNum(1),
@@ -187,8 +362,14 @@ func NewProxyServer() *ProxyServer {
 		}
 	}()
 	p.gpoll = nil //utils.NewGoPool(64, 32, 1024)
-	p.proxyDict = make(map[string]*PortProxy)
-	File2Map(&p.proxyDict)
+	p.registry = newRegistry()
+	p.sni = newSNIRouter()
+	p.http = newHTTPRouter()
+	p.tunnels = newTunnelHub(p)
+	p.muxes = newMuxPool(connector)
+	if p.dataFile != "" {
+		p.openStore()
+	}
 
 	router := http.NewServeMux()
 	router.Handle("/register", http.HandlerFunc(p.Register))
@@ -208,3 +389,82 @@ func NewProxyServer() *ProxyServer {
 	}
 	return p
 }
+
+// Stop 停止接受新连接, 等待已有的转发结束直到ctx超时, 然后关闭所有连接
+func (p *ProxyServer) Stop(ctx context.Context) error {
+	if p.cancel != nil {
+		p.cancel()
+		select {
+		case <-p.persisted:
+		case <-ctx.Done():
+		}
+	}
+	err := p.forAccept.Stop(ctx)
+	if err2 := p.forNewFd.Stop(ctx); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Registry 注册的服务, 可以通过Watch订阅服务的变化
+func (p *ProxyServer) Registry() *Registry {
+	return p.registry
+}
+
+// openStore 加载保存的服务, 之后注册表的配置变化在生效之前追加到日志。
+// 文件读写失败时和以前一样只记录错误, 不保存注册的服务
+func (p *ProxyServer) openStore() {
+	store, dic, err := openStore(p.dataFile)
+	if err != nil {
+		log.Printf("加载服务失败, 不保存注册的服务: %v\n", err)
+		return
+	}
+	for _, proxy := range dic {
+		proxy.hub, proxy.muxes = p.tunnels, p.muxes
+	}
+	p.registry.load(dic)
+	p.store = store
+	p.registry.save = p.save
+	var ctx context.Context
+	ctx, p.cancel = context.WithCancel(context.Background())
+	p.persisted = make(chan struct{})
+	go p.persist(ctx)
+}
+
+// save 在日志中追加一次配置变化并fsync, 注册表在返回之后才修改, 回复客户端时已经保存
+func (p *ProxyServer) save(typ, name string, proxy *PortProxy) error {
+	p.storeMtx.Lock()
+	defer p.storeMtx.Unlock()
+	if p.store == nil { // 已经停止
+		return errors.New("store closed")
+	}
+	return p.store.append(typ, name, proxy)
+}
+
+// persist 定时把日志合并到快照, 结束时写最后的快照并关闭文件
+func (p *ProxyServer) persist(ctx context.Context) {
+	defer close(p.persisted)
+	tk := time.NewTicker(compactInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			p.storeMtx.Lock()
+			if p.store.records > 0 {
+				if err := p.store.compact(); err != nil {
+					log.Printf("保存服务失败: %v\n", err)
+				}
+			}
+			p.storeMtx.Unlock()
+		case <-ctx.Done():
+			p.storeMtx.Lock()
+			defer p.storeMtx.Unlock()
+			if err := p.store.compact(); err != nil {
+				log.Printf("保存服务失败: %v\n", err)
+			}
+			p.store.close()
+			p.store = nil
+			return
+		}
+	}
+}
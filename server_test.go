@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"testing"
@@ -56,34 +57,6 @@ func TestReuse(t *testing.T) {
 	})
 }
 
-func TestJson(t *testing.T) {
-	dic := map[string]*PortProxy{
-		"test": {
-			Server: &net.TCPAddr{
-				IP:   net.ParseIP("11.11.11.22"),
-				Port: 1002,
-			},
-		},
-	}
-	err := Map2File(dic)
-
-	dic["gitlab"] = &PortProxy{
-		Server: &net.TCPAddr{
-			IP:   net.ParseIP("11.11.222.22"),
-			Port: 1111,
-		},
-	}
-	Map2File(dic)
-	t.Log(err)
-	dic2 := make(map[string]*PortProxy)
-	err = File2Map(&dic2)
-	if err != nil {
-		t.Log(err)
-	}
-	t.Logf("%#v", dic2["test"].Server)
-
-}
-
 func TestProxy(t *testing.T) {
 	addr1 := net.TCPAddr{
 		IP:   net.ParseIP("127.0.0.1"),
@@ -91,7 +64,12 @@ func TestProxy(t *testing.T) {
 	}
 
 	name := "test"
-	proxyServer := NewProxyServer()
+	proxyServer := NewProxyServer(DataFile(filepath.Join(t.TempDir(), "proxyEntry.json")))
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		proxyServer.Stop(ctx)
+	}()
 	EchoServer(addr1.String())
 	t.Run("注册1个地址,并查询它", func(t *testing.T) {
 
@@ -99,7 +77,8 @@ func TestProxy(t *testing.T) {
 		response_1 := httptest.NewRecorder()
 		proxyServer.ServeHTTP(response_1, request_1)
 		assertStatus(t, response_1, http.StatusAccepted)
-		assertProxyPair(t, proxyServer.proxyDict[name].Server, &addr1)
+		proxy, _ := proxyServer.registry.Get(name)
+		assertProxyPair(t, proxy.Server, &addr1)
 
 		query_request := newQueryRequest(name, "direct")
 		query_response := httptest.NewRecorder()
@@ -128,13 +107,19 @@ func TestRemote(t *testing.T) {
 	}
 
 	name := "test"
-	proxyServer := NewProxyServer()
+	proxyServer := NewProxyServer(DataFile(filepath.Join(t.TempDir(), "proxyEntry.json")))
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		proxyServer.Stop(ctx)
+	}()
 
 	request_1 := newRegisterRequest(name, addr1)
 	response_1 := httptest.NewRecorder()
 	proxyServer.ServeHTTP(response_1, request_1)
 	assertStatus(t, response_1, http.StatusAccepted)
-	assertProxyPair(t, proxyServer.proxyDict[name].Server, &addr1)
+	proxy, _ := proxyServer.registry.Get(name)
+	assertProxyPair(t, proxy.Server, &addr1)
 
 	query_request := newQueryRequest(name, "direct")
 	query_response := httptest.NewRecorder()
@@ -0,0 +1,327 @@
+package gproxy
+
+import (
+	"errors"
+	"fmt"
+	epio "g-proxy/epio"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// 共享TLS端口, 按ClientHello中的SNI把连接转发到注册了对应hostname的服务,
+// 不在代理上终结TLS
+const sniPort = 8443
+
+// 在共享端口上最多缓存的ClientHello字节数
+const maxClientHello = 32 * 1024
+
+var (
+	errHelloIncomplete = errors.New("client hello incomplete")
+	errNotHandshake    = errors.New("not a tls handshake")
+	errBadHello        = errors.New("malformed client hello")
+)
+
+// sniRouter hostname到服务的映射, 在evPoll和HTTP的goroutine中都会用到
+type sniRouter struct {
+	mtx      sync.RWMutex
+	routes   map[string]*PortProxy
+	acceptor *epio.Acceptor // 第一个服务开始转发时才侦听共享端口, 最后一个服务删除时关闭
+}
+
+func newSNIRouter() *sniRouter {
+	return &sniRouter{routes: make(map[string]*PortProxy)}
+}
+
+// add hostname已经被其他服务使用时返回false
+func (r *sniRouter) add(host string, proxy *PortProxy) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.addLocked(host, proxy)
+}
+
+func (r *sniRouter) addLocked(host string, proxy *PortProxy) bool {
+	if old, ok := r.routes[host]; ok && old != proxy {
+		return false
+	}
+	r.routes[host] = proxy
+	return true
+}
+
+func (r *sniRouter) remove(host string, proxy *PortProxy) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.routes[host] == proxy {
+		delete(r.routes, host)
+	}
+	if len(r.routes) == 0 && r.acceptor != nil {
+		stopAcceptor(r.acceptor)
+		r.acceptor = nil
+	}
+}
+
+// stopAcceptor 关闭共享端口并等待fd关闭, 之后马上可以重新侦听同一个地址
+func stopAcceptor(a *epio.Acceptor) {
+	if a.Stop() == nil {
+		<-a.Close
+	}
+}
+
+func (r *sniRouter) lookup(host string) *PortProxy {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.routes[host]
+}
+
+// normalizeHostname SNI不区分大小写, 也不带末尾的点
+func normalizeHostname(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// sniRoute 共享端口上一个连接选择服务之前的状态
+type sniRoute struct {
+	router *sniRouter
+	hello  []byte // 已经读到的ClientHello, 选好服务后原样发往后端
+}
+
+// newSNIProxyC 共享端口上的客户端连接, 读到ClientHello之后才知道转发到哪个服务
+func newSNIProxyC(c *epio.Connector, router *sniRouter) *ProxyC {
+	pc := newProxyPair(c)
+	pc.sni = &sniRoute{router: router}
+	return pc
+}
+
+// waitRoute 只注册读事件, 在tlsHandshakeTimeout内没有读到完整的PROXY协议头, ClientHello或者第一个请求头时关闭
+func (p *ProxyC) waitRoute(fd int, now int64) bool {
+	p.SetFd(fd)
+	if err := p.GetReactor().AddEvHandler(p, fd, epio.EvIn); err != nil {
+		return false
+	}
+	p.helloTimer, _ = p.GetReactor().ScheduleTimer(p, tlsHandshakeTimeout.Milliseconds(), 0)
+	return true
+}
+
+// readHello 读取ClientHello, 取出SNI后移出epoll, 按匹配的服务的配置重新开始
+func (p *ProxyC) readHello(fd int, evPollSharedBuff []byte, now int64) bool {
+	for {
+		n, err := epio.Read(fd, evPollSharedBuff)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				return true
+			}
+			return p.dropHello(err.Error())
+		}
+		if n == 0 {
+			return p.dropHello("closed before client hello")
+		}
+		p.sni.hello = append(p.sni.hello, evPollSharedBuff[:n]...)
+		host, err := parseSNI(p.sni.hello)
+		if err == errHelloIncomplete {
+			if len(p.sni.hello) > maxClientHello {
+				return p.dropHello("client hello too large")
+			}
+			continue
+		}
+		if err != nil {
+			return p.dropHello(err.Error())
+		}
+		proxy := p.sni.router.lookup(host)
+		if proxy == nil {
+			return p.dropHello("no service for " + strconv.Quote(host))
+		}
+		return p.routeTo(fd, proxy, now, p.sni.hello)
+	}
+}
+
+// routeTo 已经读到的数据先放进ProxyS的待写队列, 连接后端之后和后面的数据一起发出去
+func (p *ProxyC) routeTo(fd int, proxy *PortProxy, now int64, first []byte) bool {
+	p.cancelHelloTimer()
+	if err := p.GetReactor().RemoveEvHandler(p, fd); err != nil {
+		return false
+	}
+	p.sni = nil
+	p.SetFd(-1)
+	p.configure(proxy)
+	p.tlsConf = nil // 共享端口只转发原始的流
+	p.buddy.send(first)
+	return p.start(fd, now)
+}
+
+// dropHello 选择服务失败, 返回false由evPoll关闭连接
+func (p *ProxyC) dropHello(reason string) bool {
+	fmt.Println("ProxyC: sni " + reason)
+	p.cancelHelloTimer()
+	p.sess.reason = closeBySNI
+	return false
+}
+
+// routing 还在等待PROXY协议头, ClientHello, 第一个请求头, SOCKS5或者HTTP的CONNECT请求
+func (p *ProxyC) routing() bool {
+	return p.hs != nil || p.inbound != nil || p.sni != nil || p.http != nil && p.http.proxy == nil ||
+		p.socks != nil && p.socks.proxy == nil || p.tunnel != nil && p.tunnel.proxy == nil
+}
+
+func (p *ProxyC) cancelHelloTimer() {
+	if p.helloTimer != nil {
+		p.helloTimer.Cancel()
+	}
+}
+
+// helloTimeout 在evPoll中关闭, 避免和readHello同时进行
+func (p *ProxyC) helloTimeout() {
+	p.GetReactor().Post(p, func() {
+		if !p.routing() {
+			return
+		}
+		fmt.Println("ProxyC: timeout before routing")
+		switch {
+		case p.hs != nil:
+			p.sess.reason = closeByTLS
+			p.abortHandshake()
+		case p.inbound != nil:
+			p.sess.reason = closeByProxyHeader
+		case p.sni != nil:
+			p.sess.reason = closeBySNI
+		case p.http != nil:
+			p.sess.reason = closeByHTTP
+		case p.socks != nil:
+			p.sess.reason = closeBySOCKS
+		default:
+			p.sess.reason = closeByCONNECT
+		}
+		p.close(p.GetFd())
+	})
+}
+
+// parseSNI 从一个或多个TLS记录中拼出ClientHello, 返回其中的server_name。
+// 数据还不完整时返回errHelloIncomplete
+func parseSNI(data []byte) (string, error) {
+	var msg []byte
+	for {
+		if len(data) > 0 && data[0] != 0x16 { // handshake
+			return "", errNotHandshake
+		}
+		if len(data) < 5 {
+			return "", errHelloIncomplete
+		}
+		n := int(data[3])<<8 | int(data[4])
+		if len(data) < 5+n {
+			return "", errHelloIncomplete
+		}
+		msg = append(msg, data[5:5+n]...)
+		data = data[5+n:]
+		if len(msg) < 4 {
+			continue
+		}
+		if msg[0] != 0x01 { // client_hello
+			return "", errNotHandshake
+		}
+		size := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+		if size > maxClientHello {
+			return "", errBadHello
+		}
+		if len(msg) >= 4+size {
+			return helloServerName(msg[4 : 4+size])
+		}
+	}
+}
+
+// helloServerName 跳过ClientHello的固定部分, 在扩展中查找server_name(RFC 6066)
+func helloServerName(b []byte) (string, error) {
+	if len(b) < 34 { // client_version, random
+		return "", errBadHello
+	}
+	b = b[34:]
+	var ok bool
+	for _, lenBytes := range []int{1, 2, 1} { // session_id, cipher_suites, compression_methods
+		if _, b, ok = readVector(b, lenBytes); !ok {
+			return "", errBadHello
+		}
+	}
+	exts, _, ok := readVector(b, 2)
+	if !ok {
+		return "", errBadHello
+	}
+	for len(exts) > 0 {
+		if len(exts) < 2 {
+			return "", errBadHello
+		}
+		typ := int(exts[0])<<8 | int(exts[1])
+		var body []byte
+		if body, exts, ok = readVector(exts[2:], 2); !ok {
+			return "", errBadHello
+		}
+		if typ != 0 { // server_name
+			continue
+		}
+		list, _, ok := readVector(body, 2)
+		for ok && len(list) > 0 {
+			var name []byte
+			nameType := list[0]
+			if name, list, ok = readVector(list[1:], 2); ok && nameType == 0 { // host_name
+				return normalizeHostname(string(name)), nil
+			}
+		}
+		return "", errBadHello
+	}
+	return "", errors.New("client hello without sni")
+}
+
+// readVector 读取长度前缀为lenBytes个字节的变长字段
+func readVector(b []byte, lenBytes int) (body, rest []byte, ok bool) {
+	if len(b) < lenBytes {
+		return nil, nil, false
+	}
+	n := 0
+	for _, c := range b[:lenBytes] {
+		n = n<<8 | int(c)
+	}
+	b = b[lenBytes:]
+	if len(b) < n {
+		return nil, nil, false
+	}
+	return b[:n], b[n:], true
+}
+
+// sniListen 把服务的hostname加入共享端口的路由, 第一个服务开始侦听共享端口
+func (p *ProxyServer) sniListen(proxy *PortProxy, done <-chan struct{}) string {
+	if proxy.Hostname == "" {
+		return ""
+	}
+	addr := p.sniAddr
+	host := proxy.Hostname
+	p.sni.mtx.Lock()
+	if p.sni.acceptor == nil {
+		acceptor, err := epio.NewAcceptor(p.forAccept, p.forNewFd,
+			func() epio.EvHandler { return newSNIProxyC(p.connector, p.sni) },
+			addr,
+			epio.ListenBacklog(256),
+			epio.SockRcvBufSize(8*1024))
+		if err != nil {
+			p.sni.mtx.Unlock()
+			log.Printf("侦听共享端口失败: %v\n", err)
+			return ""
+		}
+		p.sni.acceptor = acceptor
+		log.Printf("正在侦听SNI: %s\n", addr)
+	}
+	// 和remove关闭端口在同一次加锁中, 不会加入到已经关闭的端口上
+	added := p.sni.addLocked(host, proxy)
+	p.sni.mtx.Unlock()
+	if !added {
+		log.Printf("hostname %s 已经被其他服务使用\n", host)
+		return ""
+	}
+	hc := p.startHealthCheck(proxy)
+	go func() {
+		<-done
+		p.sni.remove(host, proxy)
+		if hc != nil {
+			hc.stop()
+		}
+		fmt.Println("sni route " + host + " removed")
+	}()
+	return addr
+}
@@ -0,0 +1,158 @@
+package gproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	epio "g-proxy/epio"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// clientHello 返回crypto/tls客户端发出的ClientHello记录
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	c, s := net.Pipe()
+	defer s.Close()
+	go tls.Client(c, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	defer c.Close()
+
+	var hello []byte
+	buf := make([]byte, 4096)
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, err := s.Read(buf)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		hello = append(hello, buf[:n]...)
+		if len(hello) >= 5 && len(hello) >= 5+(int(hello[3])<<8|int(hello[4])) {
+			return hello
+		}
+	}
+}
+
+func TestParseSNI(t *testing.T) {
+	hello := clientHello(t, "Svc.Example.com")
+
+	t.Run("完整的ClientHello", func(t *testing.T) {
+		host, err := parseSNI(hello)
+		assert.Nil(t, err)
+		assert.Equal(t, "svc.example.com", host)
+	})
+
+	t.Run("数据不完整", func(t *testing.T) {
+		for i := 0; i < len(hello); i++ {
+			_, err := parseSNI(hello[:i])
+			assert.Equal(t, errHelloIncomplete, err, "prefix %d", i)
+		}
+	})
+
+	t.Run("分成两个记录", func(t *testing.T) {
+		body := hello[5:]
+		half := len(body) / 2
+		split := append([]byte{0x16, hello[1], hello[2], byte(half >> 8), byte(half)}, body[:half]...)
+		rest := len(body) - half
+		split = append(split, 0x16, hello[1], hello[2], byte(rest>>8), byte(rest))
+		split = append(split, body[half:]...)
+		host, err := parseSNI(split)
+		assert.Nil(t, err)
+		assert.Equal(t, "svc.example.com", host)
+	})
+
+	t.Run("不是TLS", func(t *testing.T) {
+		_, err := parseSNI([]byte("GET / HTTP/1.1\r\n"))
+		assert.Equal(t, errNotHandshake, err)
+	})
+
+	t.Run("没有SNI", func(t *testing.T) {
+		_, err := parseSNI(clientHello(t, ""))
+		assert.NotNil(t, err)
+		assert.NotEqual(t, errHelloIncomplete, err)
+	})
+}
+
+// namedTLSServer 握手之后先发送name, 然后回显
+func namedTLSServer(t *testing.T, name string) string {
+	t.Helper()
+	conf, err := selfSignedCert(t).load()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(name))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestSNIRoute(t *testing.T) {
+	forAccept, forNewFd, connector := startReactors(t)
+	router := newSNIRouter()
+	_, err := epio.NewAcceptor(forAccept, forNewFd,
+		func() epio.EvHandler { return newSNIProxyC(connector, router) }, "127.0.0.1:33516")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range []string{"a", "b"} {
+		server, _ := net.ResolveTCPAddr("tcp", namedTLSServer(t, name))
+		proxy := &PortProxy{Server: server}
+		proxy.resetBalancer()
+		assert.True(t, router.add(name+".test", proxy))
+	}
+	assert.False(t, router.add("a.test", &PortProxy{}), "hostname已经被使用")
+
+	dial := func(serverName string) (*tls.Conn, error) {
+		return tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", "127.0.0.1:33516",
+			&tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	}
+
+	t.Run("按SNI选择服务", func(t *testing.T) {
+		for _, name := range []string{"a", "b", "a"} {
+			conn, err := dial(name + ".test")
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got := make([]byte, 1)
+			_, err = io.ReadFull(conn, got)
+			assert.Nil(t, err)
+			assert.Equal(t, name, string(got))
+
+			conn.Write([]byte("ping"))
+			got = make([]byte, 4)
+			_, err = io.ReadFull(conn, got)
+			assert.Nil(t, err)
+			assert.Equal(t, "ping", string(got))
+			conn.Close()
+		}
+	})
+
+	t.Run("没有匹配的服务", func(t *testing.T) {
+		_, err := dial("c.test")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("服务停止转发后移除", func(t *testing.T) {
+		router.remove("b.test", router.lookup("b.test"))
+		_, err := dial("b.test")
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,172 @@
+package gproxy
+
+import (
+	"errors"
+	"fmt"
+	epio "g-proxy/epio"
+	"log"
+	"syscall"
+)
+
+// SOCKS5(RFC 1928)只支持不认证的CONNECT, 目标地址必须是注册的服务名, 例如gitlab:443,
+// 端口被忽略, 按服务的配置选择后端。不接受IP地址, 代理不能被用来访问任意地址
+const (
+	socksVersion     = 0x05
+	socksNoAuth      = 0x00
+	socksNoMethod    = 0xff
+	socksCmdConnect  = 0x01
+	socksAtypDomain  = 0x03
+	socksMaxRequest  = 4 + 1 + 255 + 2
+	socksSucceeded   = 0x00
+	socksNotAllowed  = 0x02
+	socksUnreachable = 0x04
+	socksRefused     = 0x05
+	socksBadCommand  = 0x07
+)
+
+// SOCKS5握手的阶段
+const (
+	socksGreeting = iota // 等待客户端支持的认证方法
+	socksRequest         // 等待CONNECT请求
+)
+
+var errSocksVersion = errors.New("not socks5")
+
+// socksStream SOCKS5握手的状态, 选出服务之后proxy不为nil
+type socksStream struct {
+	resolve func(name string) *PortProxy
+	state   int
+	buf     []byte
+	name    string
+	proxy   *PortProxy
+}
+
+// newSOCKSProxyC SOCKS5端口上的客户端连接, 完成握手之后才知道转发到哪个服务
+func newSOCKSProxyC(c *epio.Connector, resolve func(name string) *PortProxy) *ProxyC {
+	pc := newProxyPair(c)
+	pc.socks = &socksStream{resolve: resolve}
+	return pc
+}
+
+// socksReply CONNECT请求的回复, BND.ADDR总是0.0.0.0:0
+func socksReply(rep byte) []byte {
+	return []byte{socksVersion, rep, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
+}
+
+// feed 解析握手数据, 返回要回复客户端的数据。
+// 选出服务之后rest是客户端在CONNECT之后紧接着发来的数据, 出错时回复之后关闭连接
+func (s *socksStream) feed(data []byte) (reply, rest []byte, err error) {
+	s.buf = append(s.buf, data...)
+	for {
+		switch s.state {
+		case socksGreeting:
+			if len(s.buf) < 2 {
+				return reply, nil, nil
+			}
+			if s.buf[0] != socksVersion {
+				return reply, nil, errSocksVersion
+			}
+			n := 2 + int(s.buf[1])
+			if len(s.buf) < n {
+				return reply, nil, nil
+			}
+			methods := s.buf[2:n]
+			s.buf = s.buf[n:]
+			for _, m := range methods {
+				if m == socksNoAuth {
+					s.state = socksRequest
+					reply = append(reply, socksVersion, socksNoAuth)
+					break
+				}
+			}
+			if s.state != socksRequest {
+				return append(reply, socksVersion, socksNoMethod), nil, errors.New("no acceptable auth method")
+			}
+		case socksRequest:
+			if len(s.buf) < 5 {
+				return reply, nil, nil
+			}
+			if s.buf[0] != socksVersion {
+				return reply, nil, errSocksVersion
+			}
+			if s.buf[1] != socksCmdConnect {
+				return append(reply, socksReply(socksBadCommand)...), nil, errors.New("unsupported command")
+			}
+			if s.buf[3] != socksAtypDomain {
+				return append(reply, socksReply(socksNotAllowed)...), nil, errors.New("target is not a service name")
+			}
+			n := 5 + int(s.buf[4]) + 2
+			if len(s.buf) < n {
+				return reply, nil, nil
+			}
+			s.name = string(s.buf[5 : n-2])
+			rest, s.buf = s.buf[n:], nil
+			if s.proxy = s.resolve(s.name); s.proxy == nil {
+				return append(reply, socksReply(socksUnreachable)...), nil, errors.New("no service " + s.name)
+			}
+			return reply, rest, nil
+		}
+	}
+}
+
+// readSocks 完成SOCKS5握手, 按目标服务名连接后端, 连接成功之后在ProxyS.OnOpen中回复客户端
+func (p *ProxyC) readSocks(fd int, evPollSharedBuff []byte, now int64) bool {
+	for {
+		n, err := epio.Read(fd, evPollSharedBuff)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				return true
+			}
+			return p.dropSocks(err.Error())
+		}
+		if n == 0 {
+			return p.dropSocks("closed before connect")
+		}
+		reply, rest, err := p.socks.feed(evPollSharedBuff[:n])
+		if len(reply) > 0 {
+			epio.Write(fd, reply) // 握手阶段客户端在等待回复, 不会写满
+		}
+		if err != nil {
+			return p.dropSocks(err.Error())
+		}
+		if p.socks.proxy != nil {
+			p.replyOK, p.replyFail = socksReply(socksSucceeded), socksReply(socksRefused)
+			return p.routeTo(fd, p.socks.proxy, now, rest)
+		}
+		if len(p.socks.buf) > socksMaxRequest {
+			return p.dropSocks("request too large")
+		}
+	}
+}
+
+// dropSocks 握手失败, 返回false由evPoll关闭连接
+func (p *ProxyC) dropSocks(reason string) bool {
+	fmt.Println("ProxyC: socks " + reason)
+	p.cancelHelloTimer()
+	p.sess.reason = closeBySOCKS
+	return false
+}
+
+// lookupService 返回服务配置的副本, 在evPoll中使用时不受之后重新注册的影响
+func (p *ProxyServer) lookupService(name string) *PortProxy {
+	proxy, ok := p.registry.Get(name)
+	if !ok || proxy.Server == nil {
+		return nil
+	}
+	return proxy
+}
+
+// ListenSOCKS5 在addr上开启SOCKS5服务, 客户端CONNECT注册的服务名就可以访问它,
+// 不需要先调用/forwarding。addr的格式同epio.NewAcceptor
+func (p *ProxyServer) ListenSOCKS5(addr string) error {
+	_, err := epio.NewAcceptor(p.forAccept, p.forNewFd,
+		func() epio.EvHandler { return newSOCKSProxyC(p.connector, p.lookupService) },
+		addr,
+		epio.ListenBacklog(256),
+		epio.SockRcvBufSize(8*1024))
+	if err != nil {
+		return err
+	}
+	log.Printf("正在侦听SOCKS5: %s\n", addr)
+	return nil
+}
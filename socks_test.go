@@ -0,0 +1,144 @@
+package gproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	epio "g-proxy/epio"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// socksConnect CONNECT请求, 目标是域名
+func socksConnect(name string, port int) []byte {
+	req := []byte{socksVersion, socksCmdConnect, 0x00, socksAtypDomain, byte(len(name))}
+	req = append(req, name...)
+	return append(req, byte(port>>8), byte(port))
+}
+
+func TestSocksStream(t *testing.T) {
+	svc := &PortProxy{}
+	resolve := func(name string) *PortProxy {
+		if name == "gitlab" {
+			return svc
+		}
+		return nil
+	}
+
+	t.Run("逐字节握手", func(t *testing.T) {
+		s := &socksStream{resolve: resolve}
+		in := append([]byte{socksVersion, 2, 0x02, socksNoAuth}, socksConnect("gitlab", 443)...)
+		in = append(in, "early"...)
+		var reply, rest []byte
+		for i := range in {
+			r, rs, err := s.feed(in[i : i+1])
+			assert.Nil(t, err)
+			reply = append(reply, r...)
+			if s.proxy != nil {
+				rest = append(rs, in[i+1:]...)
+				break
+			}
+		}
+		assert.Equal(t, []byte{socksVersion, socksNoAuth}, reply)
+		assert.Equal(t, svc, s.proxy)
+		assert.Equal(t, "gitlab", s.name)
+		assert.Equal(t, "early", string(rest))
+	})
+
+	t.Run("不支持的认证方法", func(t *testing.T) {
+		s := &socksStream{resolve: resolve}
+		reply, _, err := s.feed([]byte{socksVersion, 1, 0x02})
+		assert.NotNil(t, err)
+		assert.Equal(t, []byte{socksVersion, socksNoMethod}, reply)
+	})
+
+	t.Run("目标是IP地址", func(t *testing.T) {
+		s := &socksStream{resolve: resolve}
+		reply, _, err := s.feed([]byte{socksVersion, 1, socksNoAuth,
+			socksVersion, socksCmdConnect, 0x00, 0x01, 127, 0, 0, 1, 0, 80})
+		assert.NotNil(t, err)
+		assert.Equal(t, socksNotAllowed, int(reply[3]))
+	})
+
+	t.Run("没有注册的服务", func(t *testing.T) {
+		s := &socksStream{resolve: resolve}
+		reply, _, err := s.feed(append([]byte{socksVersion, 1, socksNoAuth}, socksConnect("other", 80)...))
+		assert.NotNil(t, err)
+		assert.Equal(t, socksUnreachable, int(reply[3]))
+		assert.Nil(t, s.proxy)
+	})
+}
+
+func TestSOCKS5Relay(t *testing.T) {
+	forAccept, forNewFd, connector := startReactors(t)
+	services := map[string]*PortProxy{
+		"echo": {Server: tcpAddr(t, echoServer(t))},
+		"dead": {Server: deadAddr(t)},
+	}
+	for _, proxy := range services {
+		proxy.resetBalancer()
+	}
+	_, err := epio.NewAcceptor(forAccept, forNewFd,
+		func() epio.EvHandler {
+			return newSOCKSProxyC(connector, func(name string) *PortProxy { return services[name] })
+		}, "127.0.0.1:33518")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// dial 完成握手, 返回CONNECT的回复码
+	dial := func(name string) (net.Conn, byte) {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:33518", 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		conn.Write([]byte{socksVersion, 1, socksNoAuth})
+		method := make([]byte, 2)
+		_, err = io.ReadFull(conn, method)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte{socksVersion, socksNoAuth}, method)
+		conn.Write(socksConnect(name, 443))
+		reply := make([]byte, 10)
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err.Error())
+		}
+		return conn, reply[1]
+	}
+
+	t.Run("按服务名转发", func(t *testing.T) {
+		conn, rep := dial("echo")
+		defer conn.Close()
+		assert.Equal(t, byte(socksSucceeded), rep)
+		conn.Write([]byte("ping"))
+		got := make([]byte, 4)
+		_, err := io.ReadFull(conn, got)
+		assert.Nil(t, err)
+		assert.Equal(t, "ping", string(got))
+	})
+
+	t.Run("没有注册的服务", func(t *testing.T) {
+		conn, rep := dial("other")
+		defer conn.Close()
+		assert.Equal(t, byte(socksUnreachable), rep)
+		_, err := conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("后端连接失败", func(t *testing.T) {
+		conn, rep := dial("dead")
+		defer conn.Close()
+		assert.Equal(t, byte(socksRefused), rep)
+	})
+}
+
+func tcpAddr(t *testing.T, addr string) *net.TCPAddr {
+	t.Helper()
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return a
+}
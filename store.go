@@ -0,0 +1,257 @@
+package gproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// 服务表保存在两个文件中: 快照path是某个序号时所有服务的配置, 日志path.journal
+// 每行是快照之后的一次修改。修改时只在日志末尾追加一行并fsync, 日志的记录数超过
+// maxJournalRecords或者定时把日志合并到新的快照。快照先写到临时文件, fsync之后再rename,
+// 任何时候崩溃都至少保留上一个完整的快照, 日志最后一行没有写完时丢弃这一行
+const (
+	defaultDataFile   = "/app/proxyEntry.json"
+	storeVersion      = 2   // 版本1是没有版本号, 直接以服务名为key的map
+	maxJournalRecords = 256 // 日志的记录数达到它时合并到快照
+	compactInterval   = 10 * time.Minute
+)
+
+// storeSnapshot 快照文件的格式
+type storeSnapshot struct {
+	Version  int
+	Revision uint64 // 已经合并到快照的最后一条日志的序号
+	Services map[string]*PortProxy
+}
+
+// journalRecord 日志中的一行, Type是EventAdd/EventUpdate/EventRemove
+type journalRecord struct {
+	Revision uint64
+	Type     string
+	Name     string
+	Proxy    *PortProxy `json:",omitempty"`
+}
+
+// store 打开之后由ProxyServer.storeMtx保护
+type store struct {
+	path    string
+	journal *os.File
+	seq     uint64                // 最后一条记录的序号
+	records int                   // 日志中的记录数
+	size    int64                 // 日志的长度, 写失败时截断到这里
+	dic     map[string]*PortProxy // 快照加上日志之后的服务表
+}
+
+// openStore 加载快照并重放日志, 返回加载的服务。旧格式的文件和没有合并的日志立即写成新的快照
+func openStore(path string) (*store, map[string]*PortProxy, error) {
+	snap, err := readSnapshot(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &store{path: path, seq: snap.Revision, dic: snap.Services}
+	if err := s.replay(); err != nil {
+		return nil, nil, err
+	}
+	s.journal, err = os.OpenFile(s.journalPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	if snap.Version < storeVersion {
+		fmt.Printf("迁移%s到版本%d\n", path, storeVersion)
+	}
+	if snap.Version < storeVersion || s.records > 0 {
+		if err := s.compact(); err != nil {
+			s.close()
+			return nil, nil, err
+		}
+	}
+	dic := make(map[string]*PortProxy, len(s.dic))
+	for name, proxy := range s.dic {
+		cp := *proxy
+		cp.resetBalancer()
+		dic[name] = &cp
+	}
+	return s, dic, nil
+}
+
+func (s *store) journalPath() string {
+	return s.path + ".journal"
+}
+
+// readSnapshot 读取快照, 文件不存在时返回空的服务表。旧格式的文件返回Version 1
+func readSnapshot(path string) (*storeSnapshot, error) {
+	snap := &storeSnapshot{Version: storeVersion, Services: make(map[string]*PortProxy)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return snap, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 { // 旧版本写到一半时崩溃留下的空文件
+		fmt.Println(path + " is empty")
+		return snap, nil
+	}
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	_, hasVersion := probe["Version"]
+	_, hasServices := probe["Services"]
+	if hasVersion && hasServices {
+		err = json.Unmarshal(data, snap)
+	} else {
+		snap.Version = 1
+		err = json.Unmarshal(data, &snap.Services)
+	}
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	if snap.Version > storeVersion {
+		return nil, errors.New(path + ": unsupported version " + strconv.Itoa(snap.Version))
+	}
+	if snap.Services == nil {
+		snap.Services = make(map[string]*PortProxy)
+	}
+	for name, proxy := range snap.Services {
+		if proxy == nil {
+			return nil, errors.New(path + ": empty service " + name)
+		}
+	}
+	return snap, nil
+}
+
+// replay 按顺序应用日志中序号大于快照的记录。最后一行没有换行符说明没有写完, 把它截掉;
+// 其他解析不了的行返回错误
+func (s *store) replay() error {
+	f, err := os.Open(s.journalPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				fmt.Println(s.journalPath() + ": drop incomplete record")
+				return os.Truncate(s.journalPath(), s.size)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var rec journalRecord
+		if err := json.Unmarshal(line, &rec); err != nil || (rec.Proxy == nil && rec.Type != EventRemove) {
+			return errors.New(s.journalPath() + ": bad record at offset " + strconv.FormatInt(s.size, 10))
+		}
+		s.size += int64(len(line))
+		s.records++
+		if rec.Revision > s.seq { // 之前的记录已经合并到快照
+			s.apply(&rec)
+		}
+	}
+}
+
+func (s *store) apply(rec *journalRecord) {
+	if rec.Type == EventRemove {
+		delete(s.dic, rec.Name)
+	} else {
+		s.dic[rec.Name] = rec.Proxy
+	}
+	s.seq = rec.Revision
+}
+
+// append 在日志末尾追加一次修改并fsync, 记录数达到maxJournalRecords时合并到快照。
+// 合并失败不影响这次修改, 记录已经在日志中, 下一次append或者定时合并时再试
+func (s *store) append(typ, name string, proxy *PortProxy) error {
+	rec := journalRecord{Revision: s.seq + 1, Type: typ, Name: name}
+	if typ != EventRemove {
+		rec.Proxy = proxy
+	}
+	data, err := json.Marshal(&rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err = s.journal.Write(data); err == nil {
+		err = s.journal.Sync()
+	}
+	if err != nil {
+		s.journal.Truncate(s.size) // 不在日志中留下写了一半的记录
+		return err
+	}
+	s.size += int64(len(data))
+	s.records++
+	s.apply(&rec)
+	if s.records >= maxJournalRecords {
+		if err := s.compact(); err != nil {
+			fmt.Printf("合并%s失败: %v\n", s.path, err)
+		}
+	}
+	return nil
+}
+
+// compact 把当前的服务表写成快照, 然后清空日志。清空之前崩溃时,
+// 日志中的记录序号不大于快照的序号, 重放时会跳过
+func (s *store) compact() error {
+	data, err := json.Marshal(&storeSnapshot{Version: storeVersion, Revision: s.seq, Services: s.dic})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	fmt.Printf("正在写入: %s\n", s.path)
+	if err := s.journal.Truncate(0); err != nil {
+		return err
+	}
+	s.size, s.records = 0, 0
+	return s.journal.Sync()
+}
+
+func (s *store) close() error {
+	return s.journal.Close()
+}
+
+// writeFileAtomic 先写到同一个目录的临时文件并fsync, 再rename成path, 最后fsync目录使rename持久化
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if err = f.Chmod(0644); err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
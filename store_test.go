@@ -0,0 +1,186 @@
+package gproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readStoreFile(t *testing.T, path string) *storeSnapshot {
+	t.Helper()
+	snap, err := readSnapshot(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return snap
+}
+
+func TestStore(t *testing.T) {
+	backend := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1002}
+	stop := func(p *ProxyServer) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		p.Stop(ctx)
+	}
+
+	t.Run("写入之后读回", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "proxyEntry.json")
+		s, _, err := openStore(path)
+		assert.Nil(t, err)
+		test := &net.TCPAddr{IP: net.ParseIP("11.11.11.22"), Port: 1002}
+		gitlab := &net.TCPAddr{IP: net.ParseIP("11.11.222.22"), Port: 1111}
+		assert.Nil(t, s.append(EventAdd, "test", NewPortProxy(test)))
+		assert.Nil(t, s.compact())
+		assert.Nil(t, s.append(EventAdd, "gitlab", NewPortProxy(gitlab)))
+		s.close()
+
+		s, dic, err := openStore(path)
+		assert.Nil(t, err)
+		defer s.close()
+		assert.Len(t, dic, 2)
+		assert.Equal(t, test.String(), dic["test"].Server.String())
+		assert.Equal(t, gitlab.String(), dic["gitlab"].Server.String())
+	})
+
+	t.Run("迁移旧格式", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "proxyEntry.json")
+		legacy := `{"test":{"Server":{"IP":"11.11.11.22","Port":1002,"Zone":""}}}` + "\n"
+		os.WriteFile(path, []byte(legacy), 0644)
+		s, dic, err := openStore(path)
+		assert.Nil(t, err)
+		defer s.close()
+		assert.Equal(t, "11.11.11.22:1002", dic["test"].Server.String())
+		assert.Len(t, dic["test"].Backends, 1, "只有Server的旧配置也当作一个后端")
+		snap := readStoreFile(t, path)
+		assert.Equal(t, storeVersion, snap.Version)
+		assert.Contains(t, snap.Services, "test")
+	})
+
+	t.Run("重放日志", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "proxyEntry.json")
+		s, dic, err := openStore(path)
+		assert.Nil(t, err)
+		assert.Empty(t, dic)
+		other := &net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 80}
+		assert.Nil(t, s.append(EventAdd, "a", NewPortProxy(backend)))
+		assert.Nil(t, s.append(EventAdd, "b", NewPortProxy(backend)))
+		assert.Nil(t, s.append(EventUpdate, "a", NewPortProxy(other)))
+		assert.Nil(t, s.append(EventRemove, "b", nil))
+		s.close() // 崩溃, 没有合并到快照
+		assert.Empty(t, readStoreFile(t, path).Services)
+
+		s, dic, err = openStore(path)
+		assert.Nil(t, err)
+		defer s.close()
+		assert.Len(t, dic, 1)
+		assert.Equal(t, other.String(), dic["a"].Server.String())
+		assert.Equal(t, uint64(4), readStoreFile(t, path).Revision, "打开时合并了日志")
+		info, _ := os.Stat(s.journalPath())
+		assert.Equal(t, int64(0), info.Size())
+	})
+
+	t.Run("丢弃没有写完的记录", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "proxyEntry.json")
+		s, _, _ := openStore(path)
+		s.append(EventAdd, "a", NewPortProxy(backend))
+		s.journal.Write([]byte(`{"Revision":2,"Type":"add","Na`))
+		s.close()
+
+		s, dic, err := openStore(path)
+		assert.Nil(t, err)
+		defer s.close()
+		assert.Len(t, dic, 1)
+		assert.Contains(t, dic, "a")
+	})
+
+	t.Run("损坏的文件返回错误", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "proxyEntry.json")
+		os.WriteFile(path, []byte(`{"test":{"Server":`), 0644)
+		_, _, err := openStore(path)
+		assert.NotNil(t, err)
+
+		path = filepath.Join(dir, "journal.json")
+		os.WriteFile(path+".journal", []byte("not json\n"+`{"Revision":1,"Type":"remove","Name":"a"}`+"\n"), 0644)
+		_, _, err = openStore(path)
+		assert.NotNil(t, err)
+
+		os.WriteFile(path, []byte(`{"Version":3,"Revision":0,"Services":{}}`), 0644)
+		_, err = readSnapshot(path)
+		assert.NotNil(t, err, "不认识的版本")
+	})
+
+	t.Run("记录数达到上限时合并", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "proxyEntry.json")
+		s, _, _ := openStore(path)
+		defer s.close()
+		for i := 0; i < maxJournalRecords; i++ {
+			assert.Nil(t, s.append(EventUpdate, "a", NewPortProxy(backend)))
+		}
+		assert.Equal(t, 0, s.records)
+		snap := readStoreFile(t, path)
+		assert.Equal(t, uint64(maxJournalRecords), snap.Revision)
+		data, _ := json.Marshal(snap.Services["a"].Server)
+		assert.Equal(t, `{"IP":"127.0.0.1","Port":1002,"Zone":""}`, string(data))
+		matches, _ := filepath.Glob(path + ".tmp*")
+		assert.Empty(t, matches, "没有留下临时文件")
+	})
+
+	t.Run("合并失败时修改仍然成功", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "proxyEntry.json")
+		s, _, _ := openStore(path)
+		// 快照的位置被一个目录占住, rename会失败
+		os.Remove(path)
+		os.MkdirAll(filepath.Join(path, "busy"), 0755)
+		for i := 0; i < maxJournalRecords; i++ {
+			assert.Nil(t, s.append(EventUpdate, "a", NewPortProxy(backend)))
+		}
+		assert.Equal(t, maxJournalRecords, s.records, "记录还在日志中")
+		assert.Nil(t, s.append(EventRemove, "a", nil))
+		assert.Nil(t, s.append(EventAdd, "b", NewPortProxy(backend)))
+		s.close()
+
+		os.RemoveAll(path)
+		s, dic, err := openStore(path)
+		assert.Nil(t, err)
+		defer s.close()
+		assert.Len(t, dic, 1)
+		assert.Contains(t, dic, "b")
+	})
+
+	t.Run("重启之后保留注册的服务", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "proxyEntry.json")
+		p := NewProxyServer(DataFile(path))
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, newRegisterRequest("echo", *backend))
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		journal, _ := os.ReadFile(path + ".journal")
+		assert.Contains(t, string(journal), `"Name":"echo"`, "回复之前已经写到日志")
+		stop(p)
+
+		p = NewProxyServer(DataFile(path))
+		defer stop(p)
+		proxy, ok := p.Registry().Get("echo")
+		assert.True(t, ok)
+		assert.Equal(t, backend.String(), proxy.Server.String())
+	})
+
+	t.Run("不能读写时不保存", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "no-such-dir", "proxyEntry.json")
+		p := NewProxyServer(DataFile(path))
+		defer stop(p)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, newRegisterRequest("echo", *backend))
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		_, ok := p.Registry().Get("echo")
+		assert.True(t, ok)
+	})
+}
@@ -1,74 +1,120 @@
 package gproxy
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
 	epio "g-proxy/epio"
 	"log"
 	"net"
-	"os"
 	"strconv"
 	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
-const dataFile = "/app/proxyEntry.json"
-
 type PortProxy struct {
-	Server *net.TCPAddr
-	lcp    int // listen client port, proxy server在这个端口侦听client的连接
-	done   chan struct{}
+	Server              *net.TCPAddr   // 第一个后端, 直连时返回它
+	Backends            []*net.TCPAddr `json:",omitempty"` // 所有的后端, 按Balance为每个连接选择一个
+	Balance             string         `json:",omitempty"` // 选择后端的方式, 默认BalanceRoundRobin
+	Relay               string         `json:",omitempty"` // 转发方式 RelayCopy/RelaySplice, 默认RelayCopy
+	Linger              int            `json:",omitempty"` // 半关闭后等待另一个方向结束的秒数, 0使用默认值
+	IdleTimeout         int            `json:",omitempty"` // 两个方向都没有数据的秒数超过它时关闭连接, 0不限制
+	MaxLifetime         int            `json:",omitempty"` // 连接最长存活的秒数, 0不限制
+	Health              *HealthCheck   `json:",omitempty"` // 后端的主动健康检查, nil不检查
+	TLS                 *TLSConfig     `json:",omitempty"` // 在代理端口上终结TLS, nil不加密
+	ProxyProtocol       string         `json:",omitempty"` // 在后端连接上先发送PROXY协议头 ProxyProtocolV1/V2, 空不发送
+	AcceptProxyProtocol bool           `json:",omitempty"` // 客户端连接上先读取PROXY协议头v1/v2, 代理在负载均衡器后面时使用
+	Hostname            string         `json:",omitempty"` // 在共享的TLS端口上按SNI, 或者在HTTP端口上按Host转发到本服务时匹配的主机名
+	PathPrefix          string         `json:",omitempty"` // 在HTTP端口上按路径前缀转发到本服务
+	Tunnel              string         `json:",omitempty"` // agent通过反向隧道注册的服务名, 不为空时请求agent连回来, 不直接连接后端
+	Mux                 string         `json:",omitempty"` // 后端是其他gProxy的ListenMux地址时, 对端注册的服务名, 所有连接共用一条长连接
+	lcp                 int            // listen client port, proxy server在这个端口侦听client的连接
+	lb                  *balancer
+	tlsConf             *tls.Config
+	hsSlots             *handshakeSlots
+	hub                 *tunnelHub
+	muxes               *muxPool
 }
 
 func NewPortProxy(server *net.TCPAddr) *PortProxy {
-	return &PortProxy{
+	p := &PortProxy{
 		Server: server,
-		done:   make(chan struct{}),
 	}
+	p.resetBalancer()
+	return p
 }
 
-// 通过判断done channel是否打开来确定是否正在进行转发
-func (p PortProxy) Running() bool {
-	return p.done != nil
+// resetBalancer 后端或者选择方式改变之后重新创建balancer, 之前的连接不受影响。
+// 只有Server的旧配置也当作一个后端
+func (p *PortProxy) resetBalancer() {
+	if len(p.Backends) == 0 && p.Server != nil {
+		p.Backends = []*net.TCPAddr{p.Server}
+	}
+	if len(p.Backends) > 0 {
+		p.Server = p.Backends[0]
+	}
+	p.lb = newBalancer(p.Balance, p.Backends)
 }
 
-// 新增代理对
-func (p *ProxyServer) addProxy(name string, addr *net.TCPAddr) {
-	proxyPair, ok := p.proxyDict[name]
-	if !ok {
-		proxyPair = NewPortProxy(addr)
-		p.proxyDict[name] = proxyPair
-	}
-	proxyPair.Server = addr
-	Map2File(p.proxyDict)
+// 新增代理对, 已存在时替换它的配置, 正在转发时返回错误。check同Registry.put
+func (p *ProxyServer) addProxy(name string, entry *PortProxy, check func(old *PortProxy) error) error {
+	// 复制所有的配置, 运行时的字段不沿用entry中的, 在这里和开始转发时重新设置
+	proxyPair := *entry
+	proxyPair.lcp, proxyPair.tlsConf, proxyPair.hsSlots = 0, nil, nil
+	proxyPair.hub = p.tunnels
+	proxyPair.muxes = p.muxes
+	proxyPair.resetBalancer()
+	_, err := p.registry.put(name, &proxyPair, check)
+	return err
 }
 
 // 侦听对应代理服务的端口
-func (p *ProxyServer) tcpListen(name string) string {
-	proxy := p.proxyDict[name]
-	proxy.lcp = <-p.port
-	addr := localIP + ":" + strconv.Itoa(proxy.lcp)
+func (p *ProxyServer) tcpListen(proxy *PortProxy, done <-chan struct{}) string {
+	lcp := <-p.port
+	addr := localIP + ":" + strconv.Itoa(lcp)
 
+	proxy.tlsConf = nil
+	if proxy.TLS != nil {
+		conf, err := proxy.TLS.load()
+		if err != nil {
+			log.Printf("加载证书失败: %v\n", err)
+			p.port <- lcp
+			return ""
+		}
+		proxy.tlsConf, proxy.hsSlots = conf, newHandshakeSlots(maxTLSHandshakes)
+	}
 	acceptor, err := epio.NewAcceptor(p.forAccept, p.forNewFd,
-		func() epio.EvHandler { return NewProxyC(p.connector, proxy.Server.String()) },
+		func() epio.EvHandler { return NewProxyC(p.connector, proxy) },
 		addr,
 		epio.ListenBacklog(256),
 		epio.SockRcvBufSize(8*1024))
 	if err != nil {
+		p.port <- lcp
 		return ""
 	}
+	hc := p.startHealthCheck(proxy)
 	go func() {
-		<-proxy.done
-		close(acceptor.Close)
-		p.port <- proxy.lcp
-		fmt.Println("port " + strconv.Itoa(proxy.lcp) + " returned")
+		<-done
+		acceptor.Stop()
+		if hc != nil {
+			hc.stop()
+		}
+		p.port <- lcp
+		fmt.Println("port " + strconv.Itoa(lcp) + " returned")
 	}()
 	// 返回绑定的地址
 	log.Printf("正在侦听: %s\n", addr)
 	return addr
 }
 
+// startHealthCheck 服务配置了健康检查时开始检查, 否则返回nil
+func (p *ProxyServer) startHealthCheck(proxy *PortProxy) *healthChecker {
+	if proxy.Health == nil || proxy.Health.Interval <= 0 || proxy.Tunnel != "" { // 隧道后面的后端不能直接连接
+		return nil
+	}
+	return startHealthCheck(p.forNewFd, p.connector, proxy.lb, *proxy.Health, proxy.ProxyProtocol)
+}
+
 func reuseConfig() net.ListenConfig {
 	cfg := net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
@@ -80,28 +126,3 @@ func reuseConfig() net.ListenConfig {
 	}
 	return cfg
 }
-
-func Map2File(dic map[string]*PortProxy) (err error) {
-	fPtr, err := os.Create(dataFile)
-
-	if err != nil {
-		return
-	}
-
-	fmt.Printf("正在写入: %s\n", dataFile)
-	defer fPtr.Close()
-	encoder := json.NewEncoder(fPtr)
-	err = encoder.Encode(dic)
-	return
-}
-
-func File2Map(dic *map[string]*PortProxy) (err error) {
-	fPtr, err := os.Open(dataFile)
-	if err != nil {
-		return
-	}
-	defer fPtr.Close()
-	decoder := json.NewDecoder(fPtr)
-	decoder.Decode(&dic)
-	return
-}
@@ -0,0 +1,257 @@
+package gproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	epio "g-proxy/epio"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	tlsHandshakeTimeout = 5 * time.Second // 客户端完成TLS握手的超时时间
+	maxTLSHandshakes    = 256             // 每个服务同时握手的连接数, 超过时关闭新的客户端连接
+	maxHandshakeBuffer  = 64 * 1024       // 握手时缓存的客户端数据, 超过时暂停读取客户端
+)
+
+// TLSConfig 在代理端口上终结TLS使用的证书和私钥, 都是代理服务器上的PEM文件
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+}
+
+// load 读取证书, 注册和开始转发时调用
+func (c *TLSConfig) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// errWouldBlock 非阻塞模式下socket中没有数据。
+// tls.Conn遇到Temporary的错误不会记住它, 之后还可以继续读取
+var errWouldBlock net.Error = wouldBlock{}
+
+type wouldBlock struct{}
+
+func (wouldBlock) Error() string   { return "tls: would block" }
+func (wouldBlock) Timeout() bool   { return true }
+func (wouldBlock) Temporary() bool { return true }
+
+var errHandshakeAborted = errors.New("tls handshake aborted")
+
+// handshakeSlots 一个服务同时在握手的连接数, 每个服务分别计数,
+// 一个服务上停住的握手不会让其他服务的客户端也被关闭
+type handshakeSlots struct {
+	n   atomic.Int32
+	max int32
+}
+
+func newHandshakeSlots(max int32) *handshakeSlots {
+	return &handshakeSlots{max: max}
+}
+
+func (h *handshakeSlots) acquire() bool {
+	if h.n.Add(1) > h.max {
+		h.n.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (h *handshakeSlots) release() {
+	h.n.Add(-1)
+}
+
+// tlsStream 是tls.Conn下层的net.Conn。
+//
+// 握手时fd的读写都在evPoll中: evPoll把读到的密文放进in, 握手产生的密文放在out中由evPoll写出去。
+// tls.Conn的握手出错之后不能再继续, 遇到errWouldBlock不能重试, 所以Handshake在单独的goroutine中调用,
+// 它只在in上等待evPoll读到的数据, 不碰fd, 也不占用线程。客户端发来完整的第一个TLS记录之后才启动它,
+// 只建立了TCP连接的客户端不占用goroutine; 每个服务同时握手的连接数不超过maxTLSHandshakes。
+// 客户端在握手完成之前就可能发送数据, in满了之后evPoll暂停读取, 握手取走数据之后再继续。
+// 握手完成之后由evPoll驱动: 读取时socket中没有数据返回errWouldBlock, 加密后的数据暂存在out中,
+// 由endpoint按原来的方式写出去(包括待写队列和水位控制)
+type tlsStream struct {
+	fd      int
+	conn    *tls.Conn
+	started bool // 已经启动了握手的goroutine, 只在evPoll中使用
+
+	mtx         sync.Mutex
+	handshaking bool
+	in          []byte // 握手时evPoll读到还没交给tls.Conn的数据, 握手之后先于fd读取
+	eof         bool   // 握手时客户端关闭了写方向
+	err         error  // 握手被放弃
+	wake        chan struct{}
+	notify      func() // 握手时有密文要写, 通知evPoll
+	out         []byte
+}
+
+func newTLSStream(fd int, conf *tls.Config, pre []byte) *tlsStream {
+	s := &tlsStream{fd: fd, handshaking: true, in: pre, wake: make(chan struct{}, 1)}
+	s.conn = tls.Server(s, conf)
+	return s
+}
+
+// handshake 在单独的goroutine中完成握手
+func (s *tlsStream) handshake() error {
+	err := s.conn.Handshake()
+	s.mtx.Lock()
+	s.handshaking = false
+	s.mtx.Unlock()
+	return err
+}
+
+// feed 握手时evPoll读到的数据, eof表示客户端关闭了写方向
+func (s *tlsStream) feed(data []byte, eof bool) {
+	s.mtx.Lock()
+	s.in = append(s.in, data...)
+	s.eof = s.eof || eof
+	s.mtx.Unlock()
+	s.signal()
+}
+
+// helloReady 是否已经读到了完整的第一个TLS记录, 不是握手记录或者客户端已经关闭了写方向时
+// 也返回true, 由握手返回错误
+func (s *tlsStream) helloReady() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.eof || len(s.in) > 0 && s.in[0] != 0x16 { // handshake
+		return true
+	}
+	return len(s.in) >= 5 && len(s.in) >= 5+(int(s.in[3])<<8|int(s.in[4]))
+}
+
+// readable 握手时evPoll是否还要读取客户端的数据
+func (s *tlsStream) readable() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return !s.eof && len(s.in) < maxHandshakeBuffer
+}
+
+// abort 放弃握手, 等待数据的Handshake返回错误
+func (s *tlsStream) abort() {
+	s.mtx.Lock()
+	s.err = errHandshakeAborted
+	s.mtx.Unlock()
+	s.signal()
+}
+
+func (s *tlsStream) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// writeOut 握手时在evPoll中把out写到fd, 返回是否还有没写完的数据
+func (s *tlsStream) writeOut() (pending bool, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for len(s.out) > 0 {
+		n, err := epio.Write(s.fd, s.out)
+		if err == syscall.EAGAIN {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		s.out = s.out[n:]
+	}
+	s.out = nil
+	return false, nil
+}
+
+func (s *tlsStream) Read(b []byte) (int, error) {
+	s.mtx.Lock()
+	for s.handshaking && len(s.in) == 0 && !s.eof && s.err == nil {
+		s.mtx.Unlock()
+		<-s.wake
+		s.mtx.Lock()
+	}
+	if len(s.in) > 0 {
+		full := len(s.in) >= maxHandshakeBuffer
+		n := copy(b, s.in)
+		s.in = s.in[n:]
+		resume := full && len(s.in) < maxHandshakeBuffer && s.handshaking
+		s.mtx.Unlock()
+		if resume {
+			s.notify()
+		}
+		return n, nil
+	}
+	err, eof, handshaking := s.err, s.eof, s.handshaking
+	s.mtx.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if eof && handshaking {
+		return 0, io.EOF
+	}
+	n, err := epio.Read(s.fd, b)
+	if err == syscall.EAGAIN {
+		return 0, errWouldBlock
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (s *tlsStream) Write(b []byte) (int, error) {
+	s.mtx.Lock()
+	if s.err != nil {
+		s.mtx.Unlock()
+		return 0, s.err
+	}
+	s.out = append(s.out, b...)
+	notify := s.handshaking
+	s.mtx.Unlock()
+	if notify {
+		s.notify()
+	}
+	return len(b), nil
+}
+
+// takeOut 取出等待写到fd的密文
+func (s *tlsStream) takeOut() []byte {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	out := s.out
+	s.out = nil
+	return out
+}
+
+// seal 加密明文, 返回要写到fd的密文
+func (s *tlsStream) seal(data []byte) ([]byte, error) {
+	if _, err := s.conn.Write(data); err != nil {
+		return nil, err
+	}
+	return s.takeOut(), nil
+}
+
+// closeNotify 返回close_notify告警的密文, 在关闭写方向之前发送
+func (s *tlsStream) closeNotify() []byte {
+	s.conn.CloseWrite()
+	return s.takeOut()
+}
+
+func (s *tlsStream) Close() error                       { return nil }
+func (s *tlsStream) LocalAddr() net.Addr                { return sockAddr(epio.LocalAddr(s.fd)) }
+func (s *tlsStream) RemoteAddr() net.Addr               { return sockAddr(epio.RemoteAddr(s.fd)) }
+func (s *tlsStream) SetDeadline(t time.Time) error      { return nil }
+func (s *tlsStream) SetReadDeadline(t time.Time) error  { return nil }
+func (s *tlsStream) SetWriteDeadline(t time.Time) error { return nil }
+
+func sockAddr(addr string) net.Addr {
+	a, _ := net.ResolveTCPAddr("tcp", addr)
+	return a
+}
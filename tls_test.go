@@ -0,0 +1,196 @@
+package gproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// selfSignedCert 在临时目录中生成自签名的证书和私钥
+func selfSignedCert(t *testing.T) *TLSConfig {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gproxy test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	dir := t.TempDir()
+	conf := &TLSConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	os.WriteFile(conf.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(conf.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return conf
+}
+
+func startTLSRelay(t *testing.T, addr, backend string, proxy *PortProxy) string {
+	t.Helper()
+	proxy.TLS = selfSignedCert(t)
+	conf, err := proxy.TLS.load()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	proxy.tlsConf = conf
+	if proxy.hsSlots == nil {
+		proxy.hsSlots = newHandshakeSlots(maxTLSHandshakes)
+	}
+	return startRelayService(t, addr, backend, proxy)
+}
+
+func dialTLS(t *testing.T, addr string) *tls.Conn {
+	t.Helper()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr,
+		&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return conn
+}
+
+func TestRelayTLS(t *testing.T) {
+	t.Run("回显大量数据", func(t *testing.T) {
+		addr := startTLSRelay(t, "127.0.0.1:0", slowEchoServer(t), &PortProxy{})
+		conn := dialTLS(t, addr)
+		defer conn.Close()
+		assertEchoLargeConn(t, conn)
+	})
+
+	t.Run("半关闭", func(t *testing.T) {
+		addr := startTLSRelay(t, "127.0.0.1:0", replyAfterEOFServer(t), &PortProxy{})
+		conn := dialTLS(t, addr)
+		defer conn.Close()
+		conn.Write([]byte("hello tls"))
+		assert.Nil(t, conn.CloseWrite()) // close_notify
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		data, err := io.ReadAll(conn) // 后端的EOF转换成close_notify
+		assert.Nil(t, err)
+		assert.Equal(t, "hello tls", string(data))
+	})
+
+	t.Run("握手的数据分成很多段", func(t *testing.T) {
+		addr := startTLSRelay(t, "127.0.0.1:0", echoServer(t), &PortProxy{})
+		raw, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		conn := tls.Client(trickleConn{raw}, &tls.Config{InsecureSkipVerify: true})
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		assert.Nil(t, conn.Handshake())
+		conn.Write([]byte("hello tls"))
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello tls", string(buf[:n]))
+	})
+
+	t.Run("握手失败", func(t *testing.T) {
+		addr := startTLSRelay(t, "127.0.0.1:0", echoServer(t), &PortProxy{})
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadAll(conn)
+		assert.Nil(t, err) // 代理关闭了连接, 没有转发给后端
+	})
+
+	t.Run("一个服务的握手停住时不影响其他服务", func(t *testing.T) {
+		stalled := &PortProxy{hsSlots: newHandshakeSlots(1)}
+		addrA := startTLSRelay(t, "127.0.0.1:0", echoServer(t), stalled)
+		addrB := startTLSRelay(t, "127.0.0.1:0", echoServer(t), &PortProxy{hsSlots: newHandshakeSlots(1)})
+
+		// 只建立TCP连接不发送数据的客户端不占用握手的名额
+		for i := 0; i < 3; i++ {
+			idle, err := net.DialTimeout("tcp", addrA, 5*time.Second)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer idle.Close()
+		}
+		conn := dialTLS(t, addrA)
+		conn.Close()
+		// 客户端返回时代理可能还没有读完Finished, 等它让出名额
+		assert.Eventually(t, func() bool { return stalled.hsSlots.n.Load() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+		// 发送ClientHello之后不再继续握手
+		raw, err := net.DialTimeout("tcp", addrA, 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		done := make(chan struct{})
+		defer close(done)
+		defer raw.Close()
+		go tls.Client(stallConn{raw, done}, &tls.Config{InsecureSkipVerify: true}).Handshake()
+		assert.Eventually(t, func() bool { return stalled.hsSlots.n.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+		_, err = tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addrA,
+			&tls.Config{InsecureSkipVerify: true})
+		assert.NotNil(t, err, "服务A的名额已经用完")
+
+		conn = dialTLS(t, addrB)
+		defer conn.Close()
+		conn.Write([]byte("hello tls"))
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello tls", string(buf[:n]))
+	})
+}
+
+// stallConn 发送的数据正常写出, 但是读不到服务端的回复, 握手停在等待ServerHello
+type stallConn struct {
+	net.Conn
+	done chan struct{}
+}
+
+func (c stallConn) Read(b []byte) (int, error) {
+	<-c.done
+	return 0, io.EOF
+}
+
+// trickleConn 每次只写几个字节, 代理要多次读取才能拿到完整的握手消息
+type trickleConn struct {
+	net.Conn
+}
+
+func (c trickleConn) Write(b []byte) (int, error) {
+	for i := 0; i < len(b); i += 7 {
+		end := i + 7
+		if end > len(b) {
+			end = len(b)
+		}
+		if _, err := c.Conn.Write(b[i:end]); err != nil {
+			return i, err
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return len(b), nil
+}
@@ -0,0 +1,134 @@
+package gproxy
+
+import (
+	"errors"
+	"fmt"
+	epio "g-proxy/epio"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// 反向隧道: 内网的agent主动连接跳板机的隧道端口, 建立一条多路复用的长连接(同ListenMux),
+// 在上面注册服务。客户端访问服务时跳板机在这条连接上打开一个流, agent按服务名连接本地的服务,
+// 代替Connector.Connect。
+//
+// 连接建立时先完成mux_crypto.go中的握手: 双方用密钥的HMAC证明知道密钥, 密钥不在网络上传输,
+// 每条连接的临时密钥不同, 截获的握手不能重放; 之后的帧都用AES-256-GCM加密。
+// 和gProxy之间的长连接不同的是, 建立连接的agent不打开流, 只用muxService注册服务,
+// 跳板机打开流, agent接受。每个流有自己的窗口, agent不读某个流时不影响其他的流
+var errNoTunnelAgent = errors.New("no tunnel agent")
+
+// tunnelHub 记录每个服务是由哪条agent的连接注册的
+type tunnelHub struct {
+	mtx    sync.Mutex
+	srv    *ProxyServer
+	agents map[string]*muxSession // 服务名 -> 注册它的连接
+}
+
+func newTunnelHub(srv *ProxyServer) *tunnelHub {
+	return &tunnelHub{srv: srv, agents: make(map[string]*muxSession)}
+}
+
+// open 在注册name的agent的连接上打开一个流, 和Connector.Connect一样,
+// 返回nil之后结果通过eh.OnOpen或eh.OnConnectFail异步通知。remote是客户端地址
+func (h *tunnelHub) open(name, remote string, eh epio.EvHandler, timeout int64) error {
+	if h == nil {
+		return errNoTunnelAgent
+	}
+	h.mtx.Lock()
+	s := h.agents[name]
+	h.mtx.Unlock()
+	if s == nil {
+		return errNoTunnelAgent
+	}
+	return s.openStream(name, remote, eh, timeout)
+}
+
+// control agent在连接上注册服务, 回复OK或者ERR
+func (h *tunnelHub) control(s *muxSession, payload []byte) {
+	name, addr, _ := strings.Cut(string(payload), " ")
+	if err := h.register(s, name, addr); err != nil {
+		s.queue(muxService, 0, []byte("ERR "+name+" "+err.Error()))
+		return
+	}
+	fmt.Println("tunnel: agent " + s.addr + " registered " + name + " " + addr)
+	s.queue(muxService, 0, []byte("OK "+name))
+}
+
+// register 之后访问name的连接都在s上打开流
+func (h *tunnelHub) register(s *muxSession, name, addr string) error {
+	if name == "" {
+		return errors.New("empty service name")
+	}
+	backend, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if err := h.srv.registerTunnel(name, backend); err != nil {
+		return err
+	}
+	h.mtx.Lock()
+	h.agents[name] = s
+	h.mtx.Unlock()
+	return nil
+}
+
+// detach agent的连接断开, 它注册的服务失效, 连接上的流已经由muxSession关闭
+func (h *tunnelHub) detach(s *muxSession, err error) {
+	registered := false
+	h.mtx.Lock()
+	for name, c := range h.agents {
+		if c == s {
+			delete(h.agents, name)
+			registered = true
+		}
+	}
+	h.mtx.Unlock()
+	if registered {
+		fmt.Println("tunnel: agent " + s.addr + " disconnected")
+	}
+}
+
+// registerTunnel agent注册的服务, 已经注册过时保留之前的配置, 只是换一条连接。
+// 同名的直连服务不会被agent覆盖
+func (p *ProxyServer) registerTunnel(name string, backend *net.TCPAddr) error {
+	if proxy, ok := p.registry.Get(name); ok {
+		if proxy.Tunnel != name {
+			return errors.New("service " + name + " exists")
+		}
+		return nil
+	}
+	entry := NewPortProxy(backend)
+	entry.Tunnel = name
+	return p.addProxy(name, entry, func(old *PortProxy) error {
+		if old != nil && old.Tunnel != name { // 同时注册了同名的直连服务
+			return errors.New("service " + name + " exists")
+		}
+		return nil
+	})
+}
+
+// ListenTunnel 在addr上接受agent的连接, agent证明知道secret之后注册内网的服务,
+// 之后可以和其他服务一样/forwarding。addr的格式同epio.NewAcceptor
+func (p *ProxyServer) ListenTunnel(addr, secret string) error {
+	if secret == "" {
+		return errors.New("ListenTunnel: empty secret")
+	}
+	k := muxKey(secret)
+	_, err := epio.NewAcceptor(p.forAccept, p.forNewFd,
+		func() epio.EvHandler {
+			s := newMuxSession(p.forNewFd, "", k, false)
+			s.onControl, s.onClose = p.tunnels.control, p.tunnels.detach
+			return s
+		},
+		addr,
+		epio.ListenBacklog(256),
+		epio.SockRcvBufSize(8*1024))
+	if err != nil {
+		return err
+	}
+	log.Printf("正在侦听隧道: %s\n", addr)
+	return nil
+}
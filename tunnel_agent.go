@@ -0,0 +1,125 @@
+package gproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	epio "g-proxy/epio"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tunnelDialTimeout = 10 * time.Second
+	tunnelMaxBackoff  = 30 * time.Second // 连接断开之后重连的最长等待时间
+	tunnelStopTimeout = time.Second      // Run结束时等待流关闭的时间
+)
+
+var errTunnelAuth = errors.New("tunnel authentication failed")
+
+// TunnelAgent 运行在内网服务的旁边, 主动连接跳板机的ListenTunnel端口并注册服务,
+// 跳板机不需要能直接连接这些服务。连接断开之后自动重连
+type TunnelAgent struct {
+	server   string            // 跳板机上隧道端口的地址
+	key      []byte            // muxKey(和ListenTunnel相同的secret)
+	services map[string]string // 服务名 -> 本地服务的地址
+}
+
+func NewTunnelAgent(server, secret string, services map[string]string) *TunnelAgent {
+	return &TunnelAgent{server: server, key: muxKey(secret), services: services}
+}
+
+// Run 保持到跳板机的连接直到ctx结束, 认证失败时返回错误。
+// 跳板机打开的流在agent自己的Reactor中转发到本地的服务
+func (a *TunnelAgent) Run(ctx context.Context) error {
+	r, err := epio.NewReactor(epio.EvPollNum(1), epio.EvReadyNum(512))
+	if err != nil {
+		return err
+	}
+	c, err := epio.NewConnector(r)
+	if err != nil {
+		return err
+	}
+	go r.Run()
+	defer func() {
+		stopCtx, cancel := context.WithTimeout(context.Background(), tunnelStopTimeout)
+		defer cancel()
+		r.Stop(stopCtx)
+	}()
+
+	backoff := time.Second
+	for {
+		registered, err := a.serve(ctx, r, c)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == errTunnelAuth {
+			return err
+		}
+		if registered {
+			backoff = time.Second
+		}
+		fmt.Println("tunnel agent: " + err.Error() + ", reconnect in " + backoff.String())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > tunnelMaxBackoff {
+			backoff = tunnelMaxBackoff
+		}
+	}
+}
+
+// serve 一条到跳板机的连接, 断开时返回原因, registered表示是否注册过服务
+func (a *TunnelAgent) serve(ctx context.Context, r *epio.Reactor, c *epio.Connector) (bool, error) {
+	services := make(map[string]*PortProxy, len(a.services))
+	for name, addr := range a.services {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return false, err
+		}
+		services[name] = NewPortProxy(tcpAddr)
+	}
+
+	var registered atomic.Bool
+	closed := make(chan error, 1)
+	s := newMuxSession(r, a.server, a.key, true)
+	s.resolve = func(name string) *PortProxy { return services[name] }
+	s.c = c
+	s.onControl = func(s *muxSession, payload []byte) {
+		reply, name, _ := strings.Cut(string(payload), " ")
+		if reply == "OK" {
+			registered.Store(true)
+			fmt.Println("tunnel agent: registered " + name)
+		} else {
+			fmt.Println("tunnel agent: register " + name)
+		}
+	}
+	s.onClose = func(s *muxSession, err error) {
+		if err == nil {
+			err = errMuxClosed
+		}
+		closed <- err
+	}
+	// 握手完成之后发送
+	for name, proxy := range services {
+		s.queue(muxService, 0, []byte(name+" "+proxy.Server.String()))
+	}
+	if err := c.Connect(a.server, s, tunnelDialTimeout.Milliseconds()); err != nil {
+		return false, err
+	}
+
+	select {
+	case err := <-closed:
+		if err == errMuxAuth {
+			return false, errTunnelAuth
+		}
+		return registered.Load(), err
+	case <-ctx.Done():
+		s.close()
+		return registered.Load(), ctx.Err()
+	}
+}
@@ -0,0 +1,143 @@
+package gproxy
+
+import (
+	"context"
+	epio "g-proxy/epio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startTunnelServer 只有隧道端口的ProxyServer
+func startTunnelServer(t *testing.T, addr, secret string) *ProxyServer {
+	t.Helper()
+	forAccept, forNewFd, connector := startReactors(t)
+	p := &ProxyServer{forAccept: forAccept, forNewFd: forNewFd, connector: connector,
+		registry: newRegistry()}
+	p.tunnels = newTunnelHub(p)
+	if err := p.ListenTunnel(addr, secret); err != nil {
+		t.Fatal(err.Error())
+	}
+	return p
+}
+
+func TestTunnel(t *testing.T) {
+	p := startTunnelServer(t, "127.0.0.1:33523", "s3cret")
+	ctx, cancel := context.WithCancel(context.Background())
+	agentDone := make(chan error, 1)
+	agent := NewTunnelAgent("127.0.0.1:33523", "s3cret", map[string]string{
+		"echo": echoServer(t),
+		"dead": deadAddr(t).String(),
+	})
+	go func() { agentDone <- agent.Run(ctx) }()
+	defer cancel()
+
+	waitAgent := func(name string, want bool) {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < 3*time.Second; time.Sleep(20 * time.Millisecond) {
+			p.tunnels.mtx.Lock()
+			_, ok := p.tunnels.agents[name]
+			p.tunnels.mtx.Unlock()
+			if ok == want {
+				return
+			}
+		}
+		t.Fatalf("agent for %s: want %v", name, want)
+	}
+	waitAgent("echo", true)
+	waitAgent("dead", true)
+
+	// 客户端端口上的服务, 同/forwarding之后的tcpListen
+	listen := func(name, addr string) {
+		proxy := p.lookupService(name)
+		if !assert.NotNil(t, proxy) {
+			t.FailNow()
+		}
+		assert.Equal(t, name, proxy.Tunnel)
+		_, err := epio.NewAcceptor(p.forAccept, p.forNewFd,
+			func() epio.EvHandler { return NewProxyC(p.connector, proxy) }, addr)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	listen("echo", "127.0.0.1:33524")
+	listen("dead", "127.0.0.1:33525")
+
+	t.Run("通过隧道转发", func(t *testing.T) {
+		var conns []net.Conn
+		for i := 0; i < 3; i++ {
+			conn, err := net.DialTimeout("tcp", "127.0.0.1:33524", 5*time.Second)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer conn.Close()
+			assertEchoLargeConn(t, conn)
+			conns = append(conns, conn)
+		}
+		// 流都在agent注册服务的那条连接上
+		p.tunnels.mtx.Lock()
+		s := p.tunnels.agents["echo"]
+		p.tunnels.mtx.Unlock()
+		s.mtx.Lock()
+		assert.Len(t, s.streams, len(conns))
+		s.mtx.Unlock()
+	})
+
+	t.Run("agent连接本地服务失败", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:33525", 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("agent断开", func(t *testing.T) {
+		cancel()
+		assert.Nil(t, <-agentDone)
+		waitAgent("echo", false)
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:33524", 5*time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("认证失败", func(t *testing.T) {
+		agent := NewTunnelAgent("127.0.0.1:33523", "wrong", map[string]string{"echo": "127.0.0.1:1"})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.Equal(t, errTunnelAuth, agent.Run(ctx))
+	})
+
+	t.Run("没有握手的连接被关闭", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "127.0.0.1:33523")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("SERVICE echo 127.0.0.1:1\n" + strings.Repeat("x", muxHelloLen)))
+		data, err := io.ReadAll(conn)
+		assert.Nil(t, err)
+		assert.Empty(t, data)
+		p.tunnels.mtx.Lock()
+		assert.Empty(t, p.tunnels.agents, "没有注册服务")
+		p.tunnels.mtx.Unlock()
+	})
+
+	t.Run("不覆盖直连的服务", func(t *testing.T) {
+		assert.Nil(t, p.addProxy("direct", NewPortProxy(deadAddr(t)), nil))
+		assert.NotNil(t, p.registerTunnel("direct", deadAddr(t)))
+		assert.Nil(t, p.registerTunnel("echo", deadAddr(t)), "agent重连")
+	})
+}
@@ -0,0 +1,231 @@
+package gproxy
+
+import (
+	"fmt"
+	epio "g-proxy/epio"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// UDP会话默认的空闲超时(毫秒), 服务没有设置IdleTimeout时使用
+const defaultUDPIdle = 60 * 1000
+
+// 每个UDP端口最多的会话数, 源地址可以伪造, 不限制时大量的源地址会耗尽整个进程的fd
+const maxUDPSessions = 1024
+
+// 转发的协议, /forwarding的protocol参数
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+	ProtocolSNI  = "sni"  // 加入共享的TLS端口, 按SNI转发
+	ProtocolHTTP = "http" // 加入HTTP端口, 按Host和路径前缀转发
+)
+
+// udpListener 在代理端口上接收客户端的数据报, 每个客户端地址对应一个udpSession,
+// 会话使用一个连接到后端的UDP socket, 后端的回复再从侦听的socket发回客户端
+type udpListener struct {
+	epio.Event
+	fd       int
+	lb       *balancer
+	r        *epio.Reactor // 会话的socket注册到这里
+	idle     int64
+	mtx      sync.Mutex
+	sessions map[string]*udpSession // key是客户端地址
+	max      int                    // 会话数的上限, 超过时丢弃新客户端的数据报
+	closed   bool
+}
+
+func newUDPListener(addr string, acceptor, r *epio.Reactor, proxy *PortProxy) (*udpListener, error) {
+	fd, err := epio.UDPBind(addr, epio.ReuseAddr(true))
+	if err != nil {
+		return nil, err
+	}
+	l := &udpListener{
+		fd:       fd,
+		lb:       proxy.lb,
+		r:        r,
+		idle:     int64(proxy.IdleTimeout) * 1000,
+		sessions: make(map[string]*udpSession),
+		max:      maxUDPSessions,
+	}
+	if l.idle <= 0 {
+		l.idle = defaultUDPIdle
+	}
+	if err = acceptor.AddEvHandler(l, fd, epio.EvIn); err != nil {
+		epio.Close(fd)
+		return nil, err
+	}
+	return l, nil
+}
+
+// OnRead 把客户端的数据报转发给它的会话对应的后端
+func (l *udpListener) OnRead(fd int, evPollSharedBuff []byte, now int64) bool {
+	for {
+		n, from, err := epio.RecvFrom(fd, evPollSharedBuff)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				break
+			}
+			fmt.Println("udp recvfrom: ", err.Error())
+			return false
+		}
+		s := l.session(from, now)
+		if s == nil {
+			continue // 没有可用的后端或者会话太多, 丢弃
+		}
+		s.lastActive.Store(now)
+		// 后端暂时不可达(ICMP)或者发送缓冲区满时丢弃, 和UDP本身的语义一样
+		epio.Write(s.fd, evPollSharedBuff[:n])
+	}
+	return true
+}
+
+// session 查找客户端的会话, 没有时选择一个后端创建
+func (l *udpListener) session(from syscall.Sockaddr, now int64) *udpSession {
+	key := epio.SockaddrString(from)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if s, ok := l.sessions[key]; ok {
+		return s
+	}
+	if l.closed || len(l.sessions) >= l.max {
+		return nil
+	}
+	i := l.lb.pick(clientIP(key), -1)
+	if i < 0 {
+		return nil
+	}
+	fd, err := epio.UDPConnect(l.lb.backends[i].String())
+	if err != nil {
+		fmt.Println("udp connect: ", err.Error())
+		l.lb.release(i)
+		return nil
+	}
+	s := &udpSession{l: l, key: key, client: from, backend: i}
+	s.fd = fd
+	s.lastActive.Store(now)
+	if err = l.r.AddEvHandler(s, fd, epio.EvIn); err != nil {
+		epio.Close(fd)
+		l.lb.release(i)
+		return nil
+	}
+	s.timer, _ = l.r.ScheduleTimer(s, l.idle, 0)
+	l.sessions[key] = s
+	return s
+}
+
+// stop 在evPoll中关闭侦听的socket和所有会话
+func (l *udpListener) stop() {
+	l.GetReactor().Post(l, func() {
+		if l.GetReactor().RemoveEvHandler(l, l.fd) == nil {
+			l.OnClose(l.fd)
+		}
+	})
+}
+
+func (l *udpListener) OnClose(fd int) {
+	l.mtx.Lock()
+	l.closed = true
+	sessions := l.sessions
+	l.sessions = make(map[string]*udpSession)
+	l.mtx.Unlock()
+	for _, s := range sessions {
+		s.expire()
+	}
+	epio.Close(fd)
+}
+
+// udpSession 一个客户端地址和后端之间的会话, 两个方向都没有数据超过idle时过期
+type udpSession struct {
+	epio.Event
+	l          *udpListener
+	key        string
+	client     syscall.Sockaddr
+	fd         int
+	backend    int
+	lastActive atomic.Int64
+	timer      *epio.Timer
+	closeOnce  sync.Once
+}
+
+// OnRead 把后端的回复从侦听的socket发回客户端
+func (s *udpSession) OnRead(fd int, evPollSharedBuff []byte, now int64) bool {
+	for {
+		n, err := epio.Read(fd, evPollSharedBuff)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				break
+			}
+			if err == syscall.ECONNREFUSED { // 之前发出的数据报后端没有侦听
+				continue
+			}
+			fmt.Println("udp read: ", err.Error())
+			return false
+		}
+		s.lastActive.Store(now)
+		epio.SendTo(s.l.fd, evPollSharedBuff[:n], s.client)
+	}
+	return true
+}
+
+// OnTimeout 期间有数据时按最后一次的时间重新计算, 否则会话过期
+func (s *udpSession) OnTimeout(now int64) bool {
+	if elapsed := now - s.lastActive.Load(); elapsed < s.l.idle {
+		s.timer.Reset(s.l.idle - elapsed)
+		return true
+	}
+	s.l.mtx.Lock()
+	if s.l.sessions[s.key] == s {
+		delete(s.l.sessions, s.key)
+	}
+	s.l.mtx.Unlock()
+	s.expire()
+	return false
+}
+
+// expire 在会话的evPoll中关闭, 避免和OnRead同时进行
+func (s *udpSession) expire() {
+	s.GetReactor().Post(s, func() {
+		if s.GetReactor().RemoveEvHandler(s, s.fd) == nil {
+			s.OnClose(s.fd)
+		}
+	})
+}
+
+func (s *udpSession) OnClose(fd int) {
+	s.closeOnce.Do(func() {
+		if s.timer != nil {
+			s.timer.Cancel()
+		}
+		s.l.mtx.Lock()
+		if s.l.sessions[s.key] == s {
+			delete(s.l.sessions, s.key)
+		}
+		s.l.mtx.Unlock()
+		epio.Close(fd)
+		s.l.lb.release(s.backend)
+	})
+}
+
+// udpListen 在代理端口上转发对应服务的UDP数据报
+func (p *ProxyServer) udpListen(proxy *PortProxy, done <-chan struct{}) string {
+	lcp := <-p.port
+	addr := localIP + ":" + strconv.Itoa(lcp)
+
+	l, err := newUDPListener(addr, p.forAccept, p.forNewFd, proxy)
+	if err != nil {
+		p.port <- lcp
+		return ""
+	}
+	go func() {
+		<-done
+		l.stop()
+		p.port <- lcp
+		fmt.Println("port " + strconv.Itoa(lcp) + " returned")
+	}()
+	log.Printf("正在侦听UDP: %s\n", addr)
+	return addr
+}
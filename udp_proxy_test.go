@@ -0,0 +1,165 @@
+package gproxy
+
+import (
+	"context"
+	epio "g-proxy/epio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// udpEchoServer 在随机端口回显数据报
+func udpEchoServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func startUDPRelay(t *testing.T, addr string, proxy *PortProxy) *udpListener {
+	t.Helper()
+	proxy.resetBalancer()
+	forAccept, err := epio.NewReactor(epio.EvPollNum(1))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	forNewFd, err := epio.NewReactor(epio.EvPollNum(2))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go forAccept.Run()
+	go forNewFd.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		forAccept.Stop(ctx)
+		forNewFd.Stop(ctx)
+	})
+	l, err := newUDPListener(addr, forAccept, forNewFd, proxy)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return l
+}
+
+func (l *udpListener) sessionNum() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return len(l.sessions)
+}
+
+func TestUDPRelay(t *testing.T) {
+	backend := udpEchoServer(t)
+	proxy := &PortProxy{IdleTimeout: 1}
+	proxy.Server = &net.TCPAddr{IP: backend.IP, Port: backend.Port}
+	l := startUDPRelay(t, "127.0.0.1:33512", proxy)
+
+	clients := make([]*net.UDPConn, 2)
+	for i := range clients {
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 33512})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		clients[i] = conn
+	}
+	buf := make([]byte, 1024)
+	for round := 0; round < 3; round++ {
+		for i, conn := range clients {
+			msg := []byte{byte(i), byte(round)}
+			conn.Write(msg)
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, err := conn.Read(buf)
+			assert.Nil(t, err)
+			assert.Equal(t, msg, buf[:n])
+		}
+	}
+	assert.Equal(t, 2, l.sessionNum())
+	assert.Equal(t, int32(2), proxy.lb.status()[0].Conns)
+
+	// 空闲超时后会话过期
+	time.Sleep(2500 * time.Millisecond)
+	assert.Equal(t, 0, l.sessionNum())
+	assert.Equal(t, int32(0), proxy.lb.status()[0].Conns)
+
+	// 过期之后再发送会建立新的会话
+	clients[0].Write([]byte("again"))
+	clients[0].SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := clients[0].Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "again", string(buf[:n]))
+
+	l.stop()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, l.sessionNum())
+	assert.Equal(t, int32(0), proxy.lb.status()[0].Conns)
+}
+
+func TestUDPSessionLimit(t *testing.T) {
+	backend := udpEchoServer(t)
+	proxy := &PortProxy{}
+	proxy.Server = &net.TCPAddr{IP: backend.IP, Port: backend.Port}
+	l := startUDPRelay(t, "127.0.0.1:33513", proxy)
+	l.mtx.Lock()
+	l.max = 2
+	l.mtx.Unlock()
+
+	clients := make([]*net.UDPConn, 3)
+	for i := range clients {
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 33513})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		clients[i] = conn
+	}
+	echo := func(conn *net.UDPConn, msg string) error {
+		conn.Write([]byte(msg))
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		if err == nil {
+			assert.Equal(t, msg, string(buf[:n]))
+		}
+		return err
+	}
+
+	t.Run("超过上限的新客户端被丢弃", func(t *testing.T) {
+		assert.Nil(t, echo(clients[0], "a"))
+		assert.Nil(t, echo(clients[1], "b"))
+		assert.NotNil(t, echo(clients[2], "c"))
+		assert.Equal(t, 2, l.sessionNum())
+		assert.Equal(t, int32(2), proxy.lb.status()[0].Conns)
+	})
+	t.Run("已有的会话不受影响", func(t *testing.T) {
+		assert.Nil(t, echo(clients[0], "a2"))
+		assert.Nil(t, echo(clients[1], "b2"))
+	})
+	t.Run("会话关闭之后可以建立新的", func(t *testing.T) {
+		l.mtx.Lock()
+		s := l.sessions[clients[0].LocalAddr().String()]
+		l.mtx.Unlock()
+		if assert.NotNil(t, s) {
+			s.expire()
+		}
+		time.Sleep(100 * time.Millisecond)
+		assert.Nil(t, echo(clients[2], "c2"))
+		assert.Equal(t, 2, l.sessionNum())
+	})
+	l.stop()
+}
@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetIP(t *testing.T) {
+	r := &http.Request{Header: http.Header{}, RemoteAddr: "10.0.0.1:1234"}
+	ip, err := GetIP(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", ip)
+
+	r.Header.Set("X-Forwarded-For", "unknown, 1.2.3.4, 10.0.0.2")
+	ip, _ = GetIP(r)
+	assert.Equal(t, "1.2.3.4", ip)
+
+	r.Header.Set("X-Real-IP", "5.6.7.8")
+	ip, _ = GetIP(r)
+	assert.Equal(t, "5.6.7.8", ip)
+}